@@ -2,11 +2,14 @@
 package dieselvk
 
 import (
+	"encoding/json"
 	"fmt"
+	"math/bits"
+	"sort"
+	"sync"
 	"unsafe"
 
 	rbt "github.com/emirpasic/gods/trees/redblacktree"
-	"github.com/emirpasic/gods/utils"
 	vk "github.com/vulkan-go/vulkan"
 )
 
@@ -42,35 +45,94 @@ const (
 	POOL_INCOHRENT     = 0
 	POOL_COHERENT      = 1
 	POOL_DEFAULT_PAGES = 1
-	FLOAT32            = 0
-	INT32              = 1
-	BYTES              = 2
+	POOL_DEFAULT_SIZE  = 1 << 20   //Bytes of device memory a pool starts with
+	POOL_CEILING       = 256 << 20 //Default bytes a pool may grow to
+	DEDICATED_SIZE     = 4 << 20   //Default request size given its own device memory
 	MEM_REF            = 0
 	FREE_REF           = 1
+	RESOURCE_LINEAR    = 0 //Buffers and linear tiled images
+	RESOURCE_OPTIMAL   = 1 //Optimal tiled images
 )
 
+//Memory property presets accepted by CoreAllocator.AllocateType
+const (
+	MEMORY_DEVICE_LOCAL = vk.MemoryPropertyFlags(vk.MemoryPropertyDeviceLocalBit)
+	MEMORY_HOST_VISIBLE = vk.MemoryPropertyFlags(vk.MemoryPropertyHostVisibleBit | vk.MemoryPropertyHostCoherentBit)
+	MEMORY_HOST_CACHED  = vk.MemoryPropertyFlags(vk.MemoryPropertyHostVisibleBit | vk.MemoryPropertyHostCachedBit)
+	MEMORY_LAZY         = vk.MemoryPropertyFlags(vk.MemoryPropertyDeviceLocalBit | vk.MemoryPropertyLazilyAllocatedBit)
+)
+
+//Allocator is the common surface of the allocation strategies. CoreAllocator performs a best-fit search
+//over red black trees while CoreBuddyAllocator splits power of two blocks. Run performs one background pass, it
+//never blocks on progress sends and always ends by sending DEFRAG_DONE on a non nil channel
 type Allocator interface {
-	Allocate(size int) error
-	Map(data *unsafe.Pointer, buffer vk.Buffer, handle vk.Device, key int, type_memory int) error
+	Allocate(size int, min_align int) (MemRef, error)
+	Upload(buffer vk.Buffer, ref MemRef, data []byte) error
+	Free(ref MemRef) error
 	Clean()
 	Resize(desired_size int) error
 	Stats() map[string]string
+	Usage() string
 	Destroy()
 	Run(x chan int)
 }
 
+//PoolStats summarizes the pages of a pool. Fragmentation of a page is 1 - max_free / free so a page whose free
+//memory is one block scores 0. mean_free is in bytes per page and mean_usage is the used fraction of a page
 type PoolStats struct {
 	mean_frag     float32
 	frag_variance float32
 	mean_free     float32
 	max_free      float32
 	mean_usage    float32
+	allocations   int
+	free_blocks   int
+}
+
+//MarshalJSON exports the statistics for ShowMemoryMap
+func (stats PoolStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"mean_frag":     stats.mean_frag,
+		"frag_variance": stats.frag_variance,
+		"mean_free":     stats.mean_free,
+		"max_free":      stats.max_free,
+		"mean_usage":    stats.mean_usage,
+		"allocations":   stats.allocations,
+		"free_blocks":   stats.free_blocks,
+	})
+}
+
+//Memory map layout exported by ShowMemoryMap
+type MemoryMapBlock struct {
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+	Used   bool   `json:"used"`
+	Kind   uint8  `json:"kind"`
+}
+
+type MemoryMapPage struct {
+	Index     int              `json:"index"`
+	Size      uint64           `json:"size"`
+	Dedicated bool             `json:"dedicated"`
+	Stats     PoolStats        `json:"stats"`
+	Blocks    []MemoryMapBlock `json:"blocks"`
+}
+
+type MemoryMapPool struct {
+	Type  uint32          `json:"type"`
+	Flags uint32          `json:"flags"`
+	Heap  uint32          `json:"heap"`
+	Size  uint64          `json:"size"`
+	Stats PoolStats       `json:"stats"`
+	Pages []MemoryMapPage `json:"pages"`
 }
 
 type Block64 struct {
 	offset uint64
 	size   uint64
+	align  uint64 //Alignment requested for used blocks, kept when compaction moves the block
 	flag   uint8
+	kind   uint8
 }
 
 type MemHeap struct {
@@ -89,12 +151,28 @@ type MemPage struct {
 	tree_free       rbt.Tree
 	size            uint64
 	index           int
+	generation      uint32         //Incremented each time compaction replaces the page
+	defrag          bool           //Page is being compacted
+	dedicated       bool           //Page is the memory of a single resource, empty slots have size 0
+	mapped          unsafe.Pointer //Persistent mapping of host visible pages
 }
 
 type MemRef struct {
-	key   int
-	page  int
-	usage int
+	key        int
+	page       int
+	usage      int
+	mem_type   uint32
+	generation uint32
+}
+
+//Offset returns the byte offset of the referenced block within its page
+func (ref MemRef) Offset() uint64 {
+	return uint64(ref.key)
+}
+
+//Page returns the index of the page holding the referenced block
+func (ref MemRef) Page() int {
+	return ref.page
 }
 
 type BlockRef struct {
@@ -113,180 +191,535 @@ type MemPool struct {
 	mem_info     vk.MemoryAllocateInfo
 }
 
-//Allocator creates memory pools for each type of available vulkan memory types
+//Allocator creates memory pools for each type of available vulkan memory types. Pools are created lazily the
+//first time a memory type is selected and each holds pool_size bytes split over pool_pages pages. Full pools
+//grow by a page at a time until pool_ceiling or the heap budget is reached. Large resources and those the driver
+//asks dedicated memory for are placed in pages of their own
 type CoreAllocator struct {
-	pool MemPool
+	pools        map[uint32]*MemPool //Key: Memory type index
+	default_type uint32
+	pool_size    uint64
+	pool_pages   int
+	pool_ceiling uint64 //Bytes each pool may grow to
+	dedicated    uint64 //Requests of at least this size get dedicated memory
+	mem_props    vk.PhysicalDeviceMemoryProperties
+	limits       vk.PhysicalDeviceLimits
+	backend      MemoryBackend
+
+	//Compaction state, see defrag.go
+	lock          sync.Mutex
+	idle          *sync.Cond
+	running       sync.Mutex
+	buffers       map[MemRef]*CoreBuffer //Key: Reference of a movable block
+	moved         map[MemRef]MemRef      //Key: Reference from before a move Value: Reference after the move
+	retired       []RetiredPage
+	retire_frames int
+	defrag        *CoreDefrag
+
+	sites map[MemRef]AllocationSite //Call sites of live allocations while leak tracking is on, see leaks.go
+	trace *TraceWriter              //Allocation trace output while tracing is on, see trace.go
 }
 
 func NewCoreAllocator(physical vk.PhysicalDevice, handle vk.Device, max_pool_size uint64, pages int) (*CoreAllocator, error) {
-	core := CoreAllocator{}
-	core.pool = MemPool{
-		pages:  make([]MemPage, 0),
-		size:   max_pool_size,
-		heap:   MemHeap{},
-		status: POOL_COHERENT,
-	}
-
-	mem_props := vk.PhysicalDeviceMemoryProperties{}
-	dev_props := vk.PhysicalDeviceProperties{}
-	vk.GetPhysicalDeviceMemoryProperties(physical, &mem_props)
-	vk.GetPhysicalDeviceProperties(physical, &dev_props)
-	mem_props.Deref()
-	dev_props.Deref()
-	mem_index := int32(0)
-	core.pool.alignment = uint32(dev_props.Limits.BufferImageGranularity)
-
-	//Get memory type index - Here we demand a default operating mode of HostVisible and HostCoherent to handle memory usage
-	for i := 0; i < int(mem_props.MemoryTypeCount); i++ {
-		mem_type := mem_props.MemoryTypes[i]
-		mem_type.Deref()
-		if match_memory_desired(int32(i), mem_type.PropertyFlags, int32(vk.MemoryPropertyHostVisibleBit|vk.MemoryPropertyHostCoherentBit)) {
-			mem_index = int32(i)
-		}
+	return NewCoreAllocatorWithBackend(NewCoreMemory(physical, handle), max_pool_size, pages)
+}
+
+//NewCoreAllocatorWithBackend creates the allocator over any MemoryBackend, pass a FakeMemory backend to run the
+//allocator without a Vulkan device. The host visible coherent pool is created up front and serves Allocate
+func NewCoreAllocatorWithBackend(backend MemoryBackend, max_pool_size uint64, pages int) (*CoreAllocator, error) {
+	core := CoreAllocator{backend: backend}
+	core.pools = make(map[uint32]*MemPool)
+	core.idle = sync.NewCond(&core.lock)
+	core.buffers = make(map[MemRef]*CoreBuffer)
+	core.moved = make(map[MemRef]MemRef)
+	core.retired = make([]RetiredPage, 0)
+	core.pool_size = max_pool_size
+	core.pool_pages = pages
+	core.pool_ceiling = max_u64(POOL_CEILING, max_pool_size)
+	core.dedicated = DEDICATED_SIZE
+	core.mem_props = backend.MemoryProperties()
+	core.limits = backend.Limits()
+	core.default_type = uint32(host_memory_index(core.mem_props))
+
+	if _, err := core.create_pool(core.default_type); err != nil {
+		return &core, err
 	}
+	return &core, nil
+}
 
-	//Get the buffer image granularity (buffer alignment cues)
-	core.pool.vulkan_flags = mem_props.MemoryTypes[mem_index]
+//Creates the pool for a memory type index and allocates its device memory pages
+func (core *CoreAllocator) create_pool(type_index uint32) (*MemPool, error) {
+	mem_type := core.mem_props.MemoryTypes[type_index]
+	pool := MemPool{
+		pages:        make([]MemPage, 0),
+		status:       POOL_COHERENT,
+		alignment:    uint32(core.limits.BufferImageGranularity),
+		vulkan_flags: mem_type,
+	}
 
 	//Get the heap size
-	heap_index := mem_props.MemoryTypes[mem_index].HeapIndex
-	mem_heap := mem_props.MemoryHeaps[heap_index]
-	mem_heap.Deref()
-	heap_size := mem_heap.Size
+	heap_size := uint64(core.mem_props.MemoryHeaps[mem_type.HeapIndex].Size)
 
 	//Warning we aren't tracking
-	if max_pool_size > uint64(heap_size) {
-		return &core, fmt.Errorf("Error Requested Memory Pool size greater than available heap size\n")
+	if core.pool_size > heap_size {
+		return &pool, fmt.Errorf("Error Requested Memory Pool size greater than available heap size\n")
 	}
 
 	//We internally track the heap space available while budgeting helps us determine when client side memory is full
-	core.pool.heap.size = uint64(heap_size)
-	core.pool.heap.budget = uint64(heap_size)
-	core.pool.heap.usage = 0
+	pool.heap = MemHeap{size: heap_size, budget: heap_size, usage: core.heap_usage(mem_type.HeapIndex)}
+	if heaps, ok := core.backend.HeapBudget(); ok {
+		pool.heap = heaps[mem_type.HeapIndex]
+	}
 
 	//Allocate Device Memory for each page
-	page_size := core.pool.size / uint64(pages)
-	mem_info := vk.MemoryAllocateInfo{}
-	mem_info.SType = vk.StructureTypeMemoryAllocateInfo
-	mem_info.AllocationSize = vk.DeviceSize(page_size)
-	mem_info.MemoryTypeIndex = uint32(mem_index)
-	mem_info.PassRef()
-	core.pool.mem_info = mem_info
+	page_size := core.pool_size / uint64(core.pool_pages)
+	pool.mem_info = vk.MemoryAllocateInfo{
+		SType:           vk.StructureTypeMemoryAllocateInfo,
+		AllocationSize:  vk.DeviceSize(page_size),
+		MemoryTypeIndex: type_index,
+	}
 
-	for i := 0; i < pages; i++ {
-		core.NewMemoryPage(page_size, handle, i)
+	for i := 0; i < core.pool_pages; i++ {
+		if err := pool.new_page(core.backend, page_size); err != nil {
+			pool.destroy(core.backend)
+			return &pool, err
+		}
 	}
 
-	return &core, nil
+	core.pools[type_index] = &pool
+	return &pool, nil
 }
 
-//Allocate allocates a new memory binding region and generates the new memory blocks
-//block key is page offset in memory space
+//Returns the pool for the memory type index creating it on first use
+func (core *CoreAllocator) get_pool(type_index uint32) (*MemPool, error) {
+	if pool, ok := core.pools[type_index]; ok {
+		return pool, nil
+	}
+	return core.create_pool(type_index)
+}
+
+//Pool type indices in ascending order so reports are stable
+func (core *CoreAllocator) pool_types() []uint32 {
+	types := make([]uint32, 0, len(core.pools))
+	for type_index := range core.pools {
+		types = append(types, type_index)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+//Allocate allocates a new memory binding region from the host visible coherent pool. Block key is page offset
+//in memory space. Free blocks are searched best fit so the smallest free block able to hold the aligned
+//request is split
 func (core *CoreAllocator) Allocate(size int, min_align int) (MemRef, error) {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	ref, err := core.allocate(core.pools[core.default_type], size, min_align, RESOURCE_LINEAR)
+	if err == nil {
+		core.record_site(ref)
+	}
+	core.trace.allocate(ref, uint64(size), uint64(min_align), err)
+	return ref, err
+}
 
-	//Search pages for free memory
-	var found bool
-	var fnode *rbt.Node
-	var mem_block_key int
-	var mPage MemPage
-	var page_index = 0
-	alloc_size := size
+//AllocateType allocates reqs.Size bytes from the pool of a memory type permitted by reqs.MemoryTypeBits which
+//has every bit in properties, e.g. MEMORY_DEVICE_LOCAL or MEMORY_HOST_CACHED
+func (core *CoreAllocator) AllocateType(reqs vk.MemoryRequirements, properties vk.MemoryPropertyFlags) (MemRef, error) {
+	return core.AllocateResource(reqs, properties, RESOURCE_LINEAR)
+}
 
-	//Match Vulkan Alignment Specifications
+//AllocateResource is AllocateType for a RESOURCE_LINEAR or RESOURCE_OPTIMAL resource kind
+func (core *CoreAllocator) AllocateResource(reqs vk.MemoryRequirements, properties vk.MemoryPropertyFlags, kind uint8) (MemRef, error) {
+	return core.allocate_resource(reqs, properties, kind, vk.Buffer(vk.NullHandle), vk.NullImage)
+}
+
+//AllocateBuffer is AllocateType for a known buffer. Buffers for which the driver prefers or requires a dedicated
+//allocation are given their own device memory
+func (core *CoreAllocator) AllocateBuffer(buffer vk.Buffer, reqs vk.MemoryRequirements, properties vk.MemoryPropertyFlags) (MemRef, error) {
+	return core.allocate_resource(reqs, properties, RESOURCE_LINEAR, buffer, vk.NullImage)
+}
+
+//Allocates image memory honouring the dedicated requirements of the image
+func (core *CoreAllocator) allocate_image(image vk.Image, reqs vk.MemoryRequirements, properties vk.MemoryPropertyFlags, kind uint8) (MemRef, error) {
+	return core.allocate_resource(reqs, properties, kind, vk.Buffer(vk.NullHandle), image)
+}
 
-	if size < min_align {
-		alloc_size = min_align
+func (core *CoreAllocator) allocate_resource(reqs vk.MemoryRequirements, properties vk.MemoryPropertyFlags, kind uint8, buffer vk.Buffer, image vk.Image) (MemRef, error) {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	type_index, err := core.MemoryTypeIndex(reqs.MemoryTypeBits, properties)
+	if err != nil {
+		return MemRef{}, err
+	}
+
+	pool, err := core.get_pool(type_index)
+	if err != nil {
+		return MemRef{}, err
+	}
+
+	var ref MemRef
+	dedicated := core.backend.DedicatedRequirements(buffer, image)
+	if dedicated.Requires || dedicated.Prefers || uint64(reqs.Size) >= core.dedicated {
+		ref, err = core.allocate_dedicated(pool, uint64(reqs.Size), kind, buffer, image)
 	} else {
-		div := size / min_align
-		alloc_size = size + (div+1)*(min_align)
+		ref, err = core.allocate(pool, int(reqs.Size), int(reqs.Alignment), kind)
+	}
+	if err == nil {
+		core.record_site(ref)
 	}
+	core.trace.allocate(ref, uint64(reqs.Size), uint64(reqs.Alignment), err)
+	return ref, err
+}
 
-	for i, page := range core.pool.pages {
-		node := page.tree_free.Root
-		comp_fn := page.tree_free.Comparator
-		found, fnode = rbt_search(node, comp_fn, alloc_size)
-		if found {
-			mem_block_key = fnode.Key.(int)
-			mPage = page
-			page_index = i
-			break
-		}
+//Allocates device memory owned by a single resource as a pool page holding one used block, the caller holds the
+//allocator lock. Dedicated pages count toward the heap budget but not the pool ceiling
+func (core *CoreAllocator) allocate_dedicated(pool *MemPool, size uint64, kind uint8, buffer vk.Buffer, image vk.Image) (MemRef, error) {
+	type_index := pool.mem_info.MemoryTypeIndex
+	core.update_budget()
+	if pool.heap.usage+size > pool.heap.budget {
+		return MemRef{}, fmt.Errorf("Allocate() %d byte dedicated allocation exceeds the budget of heap %d, %d of %d bytes in use\n", size, pool.vulkan_flags.HeapIndex, pool.heap.usage, pool.heap.budget)
+	}
+
+	device_mem, err := core.backend.AllocateDedicated(size, type_index, buffer, image)
+	if err != nil {
+		return MemRef{}, fmt.Errorf("Allocate() failed to allocate %d bytes of dedicated memory type %d %s\n", size, type_index, err)
+	}
+	page, err := pool.add_page(core.backend, device_mem, size, true)
+	if err != nil {
+		return MemRef{}, err
 	}
 
-	//Check if found
-	if found {
-		key := fnode.Key.(int)
-		free_block := mPage.free_block_refs[key]
-		mem_block := free_block
+	page.remove_free(0)
+	page.put_used(Block64{offset: 0, size: size, flag: MARK_USED, kind: kind})
+	return MemRef{key: 0, page: page.index, usage: MEM_REF, mem_type: type_index, generation: page.generation}, nil
+}
 
-		//Obtain Block Handles
-		block := mPage.free_blocks[mem_block.mem_block_id]
-		n_block := Block64{size: uint64(alloc_size), offset: block.offset, flag: MARK_USED}
+//Allocates from the pool and grows it by a page when no free block fits, the caller holds the allocator lock
+func (core *CoreAllocator) allocate(pool *MemPool, size int, min_align int, kind uint8) (MemRef, error) {
+	ref, err := pool.allocate(size, min_align, kind)
+	if err == nil {
+		return ref, nil
+	}
+	if err := core.grow(pool, uint64(align_up(size, min_align))); err != nil {
+		return MemRef{}, err
+	}
+	return pool.allocate(size, min_align, kind)
+}
 
-		//Realign Free Block
-		block.size = block.size - uint64(alloc_size)
-		block.offset = block.offset + uint64(alloc_size)
-		block.flag = MARK_FREE
-		mPage.free_blocks[mem_block.mem_block_id] = block
+//Appends a page large enough for size bytes to the pool. Pages are the pool page size unless the request is
+//larger, growth stops at the pool ceiling and when the heap budget cannot hold the page
+func (core *CoreAllocator) grow(pool *MemPool, size uint64) error {
+	granularity := max_u64(uint64(core.limits.BufferImageGranularity), 1)
+	page_size := max_u64(uint64(pool.mem_info.AllocationSize), uint64(align_up(int(size), int(granularity))))
+	type_index := pool.mem_info.MemoryTypeIndex
 
-		//Store memory block and block reference
-		core.pool.pages[page_index].mem_blocks = append(mPage.mem_blocks, n_block)
-		page := mem_block.page_id
-		block_index := len(core.pool.pages[page_index].mem_blocks) - 1
-		n_block_ref := BlockRef{
-			page_id:      page,
-			mem_block_id: block_index,
+	if err := core.check_growth(pool, size, page_size); err != nil {
+		return err
+	}
+
+	if err := pool.new_page(core.backend, page_size); err != nil {
+		return fmt.Errorf("Allocate() failed to grow memory type %d pool by %d bytes %s\n", type_index, page_size, err)
+	}
+	return nil
+}
+
+//Checks a new page of page_size bytes holding a size byte request stays under the pool ceiling and the heap budget,
+//the caller holds the allocator lock
+func (core *CoreAllocator) check_growth(pool *MemPool, size uint64, page_size uint64) error {
+	type_index := pool.mem_info.MemoryTypeIndex
+	if pool.shared()+page_size > core.pool_ceiling {
+		return fmt.Errorf("Allocate() %d bytes exceeds the %d byte ceiling of memory type %d pool holding %d bytes\n", size, core.pool_ceiling, type_index, pool.shared())
+	}
+
+	core.update_budget()
+	if pool.heap.usage+page_size > pool.heap.budget {
+		return fmt.Errorf("Allocate() %d byte page exceeds the budget of heap %d, %d of %d bytes in use\n", page_size, pool.vulkan_flags.HeapIndex, pool.heap.usage, pool.heap.budget)
+	}
+	return nil
+}
+
+//Refreshes the heap budget and usage of every pool from VK_EXT_memory_budget. Without the extension the budget
+//is the heap size and the usage is the memory the allocator holds on the heap
+func (core *CoreAllocator) update_budget() {
+	heaps, ok := core.backend.HeapBudget()
+	for _, pool := range core.pools {
+		heap_index := pool.vulkan_flags.HeapIndex
+		if ok {
+			pool.heap = heaps[heap_index]
+			continue
 		}
+		pool.heap.budget = pool.heap.size
+		pool.heap.usage = core.heap_usage(heap_index)
+	}
+}
 
-		//Memory block id key is it's offset which is unique
-		mem_block_key = int(n_block.offset)
-		mPage.mem_block_refs[mem_block_key] = n_block_ref
-		mPage.tree_mem.Put(mem_block_key, alloc_size)
+//Bytes of device memory held by the allocator pools on the heap
+func (core *CoreAllocator) heap_usage(heap_index uint32) uint64 {
+	var usage uint64
+	for _, pool := range core.pools {
+		if pool.vulkan_flags.HeapIndex == heap_index {
+			usage += pool.size
+		}
+	}
+	return usage
+}
 
-		//Remove and store new free memory block
-		mPage.tree_free.Remove(key)
-		mPage.tree_free.Put(key, block.size)
+//SetDedicatedSize sets the request size from which allocations are given dedicated device memory
+func (core *CoreAllocator) SetDedicatedSize(size uint64) {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	core.dedicated = size
+}
 
-	} else {
-		return MemRef{}, NewError(vk.ErrorOutOfPoolMemory)
+//SetPoolCeiling sets the number of bytes each memory type pool may grow to
+func (core *CoreAllocator) SetPoolCeiling(ceiling uint64) {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	core.pool_ceiling = ceiling
+}
+
+//MemoryTypeIndex selects the memory type permitted by type_bits with every bit in properties
+func (core *CoreAllocator) MemoryTypeIndex(type_bits uint32, properties vk.MemoryPropertyFlags) (uint32, error) {
+	type_index, ok := select_memory_type(core.mem_props, type_bits, properties)
+	if !ok {
+		return 0, fmt.Errorf("No memory type in bits %b has properties %b\n", type_bits, properties)
+	}
+	return type_index, nil
+}
+
+//MemoryType returns the property flags of the memory type backing the reference
+func (core *CoreAllocator) MemoryType(ref MemRef) vk.MemoryPropertyFlags {
+	return core.mem_props.MemoryTypes[ref.mem_type].PropertyFlags
+}
+
+//Free releases a single allocation and merges the released block with the adjacent free blocks. Blocks on a
+//page under compaction are released once the page has been moved
+func (core *CoreAllocator) Free(ref MemRef) error {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	origin := ref
+	ref = core.wait_compaction(ref)
+
+	pool, ok := core.pools[ref.mem_type]
+	if !ok || ref.page < 0 || ref.page >= len(pool.pages) || ref.usage != MEM_REF {
+		return fmt.Errorf("Free() invalid memory reference page %d key %d\n", ref.page, ref.key)
+	}
+
+	page := &pool.pages[ref.page]
+	if ref.generation != page.generation {
+		return fmt.Errorf("Free() memory reference page %d key %d is not allocated\n", ref.page, ref.key)
+	}
+	block, ok := page.remove_used(ref.key)
+	if !ok {
+		return fmt.Errorf("Free() memory reference page %d key %d is not allocated\n", ref.page, ref.key)
 	}
 
-	return MemRef{mem_block_key, page_index, MEM_REF}, nil
+	page.release(block)
+	if page.dedicated {
+		pool.release_page(core.backend, page)
+	}
+	delete(core.buffers, ref)
+	delete(core.sites, ref)
+	core.trace.free(ref)
+	for origin != ref {
+		next := core.moved[origin]
+		delete(core.moved, origin)
+		origin = next
+	}
+	return nil
 }
 
 //AllocateFromBuffer(vk.Buffer)
 
-//Map binds the keyed buffer memory and allocates and places data into the GPU visible memory. For dedicated GPU memory
-//extend this implementation
-func (core *CoreAllocator) Map(data *unsafe.Pointer, buffer vk.Buffer, handle vk.Device, ref MemRef, type_memory int) error {
+//Bind binds the buffer to the referenced block without writing any data, used for device local memory
+func (core *CoreAllocator) Bind(buffer vk.Buffer, ref MemRef) error {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	page, block, err := core.block(core.wait_compaction(ref))
+	if err != nil {
+		return err
+	}
+	return core.backend.BindBufferMemory(buffer, page.device_mem, block.offset)
+}
 
-	page := core.pool.pages[ref.page]
-	block_ref := page.mem_block_refs[ref.key]
+//Upload binds the buffer to the referenced block and copies data into the start of it. Use UploadSlice to
+//upload typed elements. Device local references must be filled through a staging buffer instead
+func (core *CoreAllocator) Upload(buffer vk.Buffer, ref MemRef, data []byte) error {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	page, mem_ref, err := core.block(core.wait_compaction(ref))
+	if err != nil {
+		return err
+	}
 
-	if &block_ref == nil {
+	if page.mapped == nil {
 		return NewError(vk.ErrorMemoryMapFailed)
 	}
+	if uint64(len(data)) > mem_ref.size {
+		return fmt.Errorf("Upload() %d bytes overflows block of %d bytes\n", len(data), mem_ref.size)
+	}
 
-	//Device memory only has 1 allocation per page
-	mem_ref := page.mem_blocks[block_ref.mem_block_id]
-	dev_ref := core.pool.pages[block_ref.page_id].device_mem
+	if err := core.backend.BindBufferMemory(buffer, page.device_mem, mem_ref.offset); err != nil {
+		return err
+	}
 
-	res := vk.BindBufferMemory(handle, buffer, dev_ref, vk.DeviceSize(mem_ref.offset))
+	copy(unsafe.Slice((*byte)(unsafe.Add(page.mapped, mem_ref.offset)), len(data)), data)
+	return core.flush(ref.mem_type, page.device_mem, page.size, mem_ref.offset, uint64(len(data)))
+}
 
-	if res != vk.Success {
-		return NewError(res)
+//Looks up the page and used block of a reference, the caller holds the allocator lock
+func (core *CoreAllocator) block(ref MemRef) (*MemPage, Block64, error) {
+	pool, ok := core.pools[ref.mem_type]
+	if !ok || ref.page < 0 || ref.page >= len(pool.pages) {
+		return nil, Block64{}, NewError(vk.ErrorMemoryMapFailed)
 	}
 
-	if type_memory == FLOAT32 {
-		map_memory_float32(data, handle, dev_ref, int(mem_ref.size), int(mem_ref.offset))
+	page := &pool.pages[ref.page]
+	if ref.generation != page.generation {
+		return nil, Block64{}, NewError(vk.ErrorMemoryMapFailed)
+	}
+	block_ref, ok := page.mem_block_refs[ref.key]
+	if !ok {
+		return nil, Block64{}, NewError(vk.ErrorMemoryMapFailed)
 	}
+	return page, page.mem_blocks[block_ref.mem_block_id], nil
+}
+
+//Write copies data into the referenced block at offset through the persistent mapping of the page. Only host
+//visible memory is mapped, device local references must be filled through a staging buffer. Writes to
+//non-coherent memory are flushed to the device
+func (core *CoreAllocator) Write(ref MemRef, offset uint64, data []byte) error {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	page, block, err := core.block(core.wait_compaction(ref))
+	if err != nil {
+		return err
+	}
+	if page.mapped == nil {
+		return NewError(vk.ErrorMemoryMapFailed)
+	}
+	if offset+uint64(len(data)) > block.size {
+		return fmt.Errorf("Write() %d bytes at offset %d overflows block of %d bytes\n", len(data), offset, block.size)
+	}
+
+	copy(unsafe.Slice((*byte)(unsafe.Add(page.mapped, block.offset+offset)), len(data)), data)
+	return core.flush(ref.mem_type, page.device_mem, page.size, block.offset+offset, uint64(len(data)))
+}
 
+//Copies data into the referenced block at offset, mapping the page for the copy when it is not persistently mapped.
+//Backend only allocators use it in place of GPU transfers into device local memory
+func (core *CoreAllocator) host_transfer(ref MemRef, offset uint64, data []byte) error {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	page, block, err := core.block(core.wait_compaction(ref))
+	if err != nil {
+		return err
+	}
+	if offset+uint64(len(data)) > block.size {
+		return fmt.Errorf("Write() %d bytes at offset %d overflows block of %d bytes\n", len(data), offset, block.size)
+	}
+
+	dst := page.mapped
+	if dst == nil {
+		mapped, err := core.backend.MapMemory(page.device_mem, 0, page.size)
+		if err != nil {
+			return err
+		}
+		defer core.backend.UnmapMemory(page.device_mem)
+		dst = mapped
+	}
+	copy(unsafe.Slice((*byte)(unsafe.Add(dst, block.offset+offset)), len(data)), data)
+	return core.flush(ref.mem_type, page.device_mem, page.size, block.offset+offset, uint64(len(data)))
+}
+
+//Read copies len(data) bytes from the referenced block at offset through the persistent mapping of the page.
+//Non-coherent memory is invalidated first so device writes are visible. The caller waits for the device to finish
+//writing before reading
+func (core *CoreAllocator) Read(ref MemRef, offset uint64, data []byte) error {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	page, block, err := core.block(core.wait_compaction(ref))
+	if err != nil {
+		return err
+	}
+	if page.mapped == nil {
+		return NewError(vk.ErrorMemoryMapFailed)
+	}
+	if offset+uint64(len(data)) > block.size {
+		return fmt.Errorf("Read() %d bytes at offset %d overflows block of %d bytes\n", len(data), offset, block.size)
+	}
+
+	if err := core.invalidate(ref.mem_type, page.device_mem, page.size, block.offset+offset, uint64(len(data))); err != nil {
+		return err
+	}
+	copy(data, unsafe.Slice((*byte)(unsafe.Add(page.mapped, block.offset+offset)), len(data)))
 	return nil
 }
 
+//Reports whether host writes to the memory type are visible to the device without flushing
+func (core *CoreAllocator) coherent(type_index uint32) bool {
+	flags := core.mem_props.MemoryTypes[type_index].PropertyFlags
+	return flags&vk.MemoryPropertyFlags(vk.MemoryPropertyHostCoherentBit) != 0
+}
+
+//Widens a mapped range to whole nonCoherentAtomSize atoms without passing the end of the device memory
+func (core *CoreAllocator) atom_range(end uint64, offset uint64, size uint64) (uint64, uint64) {
+	return atom_span(uint64(core.limits.NonCoherentAtomSize), end, offset, size)
+}
+
+//Widens offset and size to whole atoms of the given size without passing end
+func atom_span(atom uint64, end uint64, offset uint64, size uint64) (uint64, uint64) {
+	atom = max_u64(atom, 1)
+	start := offset / atom * atom
+	stop := min_u64((offset+size+atom-1)/atom*atom, end)
+	return start, stop - start
+}
+
+//Flushes host writes to a range of mapped device memory of end bytes when the memory type is non-coherent
+func (core *CoreAllocator) flush(type_index uint32, memory vk.DeviceMemory, end uint64, offset uint64, size uint64) error {
+	if size == 0 || core.coherent(type_index) {
+		return nil
+	}
+	start, length := core.atom_range(end, offset, size)
+	return core.backend.FlushMemory(memory, start, length)
+}
+
+//Invalidates a range of mapped device memory of end bytes when the memory type is non-coherent
+func (core *CoreAllocator) invalidate(type_index uint32, memory vk.DeviceMemory, end uint64, offset uint64, size uint64) error {
+	if size == 0 || core.coherent(type_index) {
+		return nil
+	}
+	start, length := core.atom_range(end, offset, size)
+	return core.backend.InvalidateMemory(memory, start, length)
+}
+
+//WriteFloat32 writes the values at a byte offset into the referenced block, see Write
+func (core *CoreAllocator) WriteFloat32(ref MemRef, offset uint64, data []float32) error {
+	return WriteSlice(core, ref, offset, data)
+}
+
+//WriteInt32 writes the values at a byte offset into the referenced block, see Write
+func (core *CoreAllocator) WriteInt32(ref MemRef, offset uint64, data []int32) error {
+	return WriteSlice(core, ref, offset, data)
+}
+
+//Binds the image to the referenced block
+func (core *CoreAllocator) bind_image(image vk.Image, ref MemRef) error {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	page, block, err := core.block(core.wait_compaction(ref))
+	if err != nil {
+		return err
+	}
+	return core.backend.BindImageMemory(image, page.device_mem, block.offset)
+}
+
 //Get memory reference from description structure
 func (core *CoreAllocator) GetMemoryRef(ref MemRef) BlockRef {
-	page := core.pool.pages[ref.page]
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	ref = core.wait_compaction(ref)
+	page := core.pools[ref.mem_type].pages[ref.page]
 	if ref.usage == MEM_REF {
 		return page.mem_block_refs[ref.key]
 	}
@@ -294,108 +727,403 @@ func (core *CoreAllocator) GetMemoryRef(ref MemRef) BlockRef {
 }
 
 //Cleanup checks current allocated memory blocks that have been free'd in runtime. This approach is somewhat
-//Naive since we are blocking the CPU for the background task of cleaning the memory pool.
+//Naive since we are blocking the CPU for the background task of cleaning the memory pool. Clean is also the
+//main thread hook which swaps in buffers moved by compaction so call it once per frame
 func (core *CoreAllocator) Clean() {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	for _, pool := range core.pools {
+		pool.clean()
+	}
+	core.release_retired()
+	core.trace.clean()
+}
 
-	//Check memory blocks for usage
-	for pg_index, page := range core.pool.pages {
-		for _, r_block := range page.mem_block_refs {
-			ref := page.mem_blocks[r_block.mem_block_id]
-			if ref.flag == MARK_FREE {
-				//Return memory back to the free tree and consolidate memory if neccessary
-				free_block := Block64{size: ref.size, offset: ref.offset, flag: MARK_FREE}
-				free_block_ref := BlockRef{}
-				page.free_blocks = append(page.free_blocks, free_block)
-				free_block_ref.page_id = r_block.page_id
-				free_block_ref.mem_block_id = len(page.free_blocks) - 1
-
-				//Check for free blocks occupying relevant memory keys
-				free_blocks := make([]MemRef, 0)
-				link_found := true
-				current_block := free_block
-				fb_size := uint64(0)
-				for link_found {
-					offset_id := int(current_block.offset + current_block.size)
-					if chain_free_block, ok := page.free_block_refs[offset_id]; ok {
-						free_blocks = append(free_blocks, MemRef{offset_id, pg_index, FREE_REF})
-						current_block = page.free_blocks[chain_free_block.mem_block_id]
-						fb_size += (current_block.size)
-					} else {
-						link_found = false
-					}
-				}
+//Creates a new memory page of the desired size in the pool of the memory type index
+func (core *CoreAllocator) NewMemoryPage(type_index uint32, desired_size uint64) error {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	pool, err := core.get_pool(type_index)
+	if err != nil {
+		return err
+	}
+	return pool.new_page(core.backend, desired_size)
+}
 
-				free_block.size += fb_size
+//Returns a string map of relevant statistics and can be used by other tools to visually display memory usage
+//Aggregate keys match CoreBuddyAllocator.Stats, pool keys are prefixed by memory type and page keys by page index
+func (core *CoreAllocator) Stats() map[string]string {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	stats := make(map[string]string)
+	var size, used, free, max_free uint64
+	pages, allocations, free_blocks, dedicated := 0, 0, 0, 0
+
+	for _, type_index := range core.pool_types() {
+		pool := core.pools[type_index]
+		prefix := fmt.Sprintf("type%d.", type_index)
+		pool_stats := pool.stats()
+		pool_stats.write(stats, prefix)
+		stats[prefix+"heap_budget"] = fmt.Sprintf("%d", pool.heap.budget)
+		stats[prefix+"heap_usage"] = fmt.Sprintf("%d", pool.heap.usage)
+
+		pool_dedicated := 0
+		for i := range pool.pages {
+			page := &pool.pages[i]
+			if page.size == 0 {
+				continue
+			}
+			if page.dedicated {
+				pool_dedicated++
+			}
+			page_used, page_free, page_max := page.totals()
+			page.stats().write(stats, fmt.Sprintf("%spage%d.", prefix, i))
+			pages++
+
+			size += page.size
+			used += page_used
+			free += page_free
+			if page_max > max_free {
+				max_free = page_max
+			}
+		}
+		stats[prefix+"dedicated"] = fmt.Sprintf("%d", pool_dedicated)
+		dedicated += pool_dedicated
+		allocations += pool_stats.allocations
+		free_blocks += pool_stats.free_blocks
+	}
 
-				//Remove the free blocks by deleting all references
-				for _, ref := range free_blocks {
-					block_ref := core.GetMemoryRef(ref)
-					page.free_blocks = append(page.free_blocks[:block_ref.mem_block_id], page.free_blocks[block_ref.mem_block_id+1:]...)
-					page.tree_free.Remove(ref.key)
-				}
+	stats["pools"] = fmt.Sprintf("%d", len(core.pools))
+	stats["pages"] = fmt.Sprintf("%d", pages)
+	stats["size"] = fmt.Sprintf("%d", size)
+	stats["used"] = fmt.Sprintf("%d", used)
+	stats["free"] = fmt.Sprintf("%d", free)
+	stats["allocations"] = fmt.Sprintf("%d", allocations)
+	stats["free_blocks"] = fmt.Sprintf("%d", free_blocks)
+	stats["dedicated"] = fmt.Sprintf("%d", dedicated)
+	stats["max_free"] = fmt.Sprintf("%d", max_free)
+	stats["fragmentation"] = fmt.Sprintf("%f", fragmentation(free, max_free))
+	return stats
+}
 
-				//Add block to pooling
-				page.free_block_refs[int(free_block.offset)] = free_block_ref
-				page.tree_free.Put(int(free_block.offset), free_block.size)
+//ShowMemoryMap outputs the block layout and statistics of every pool as a JSON document
+func (core *CoreAllocator) ShowMemoryMap() (string, error) {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	pools := make([]MemoryMapPool, 0, len(core.pools))
+	for _, type_index := range core.pool_types() {
+		pool := core.pools[type_index]
+		pool_map := MemoryMapPool{
+			Type:  type_index,
+			Flags: uint32(pool.vulkan_flags.PropertyFlags),
+			Heap:  pool.vulkan_flags.HeapIndex,
+			Size:  pool.size,
+			Stats: pool.stats(),
+			Pages: make([]MemoryMapPage, 0, len(pool.pages)),
+		}
+		for i := range pool.pages {
+			if pool.pages[i].size > 0 {
+				pool_map.Pages = append(pool_map.Pages, pool.pages[i].memory_map())
+			}
+		}
+		pools = append(pools, pool_map)
+	}
+
+	out, err := json.Marshal(map[string]interface{}{"pools": pools})
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func (core *CoreAllocator) Usage() string {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	var out string
+	for _, type_index := range core.pool_types() {
+		pool := core.pools[type_index]
+		out += fmt.Sprintf("Memory Type %d: flags (%b)\n", type_index, pool.vulkan_flags.PropertyFlags)
+		out += pool.usage()
+	}
+	return out
+}
+
+//Resize grows the host visible pool to desired_size bytes by appending a page for the difference. Pools are not
+//shrunk since live allocations may occupy any page
+func (core *CoreAllocator) Resize(desired_size int) error {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	pool := core.pools[core.default_type]
+	if uint64(desired_size) < pool.size {
+		return fmt.Errorf("Resize() cannot shrink pool of %d bytes to %d bytes\n", pool.size, desired_size)
+	}
+	if uint64(desired_size) == pool.size {
+		return nil
+	}
+	return pool.new_page(core.backend, uint64(desired_size)-pool.size)
+}
 
-				//Remove memory reference
-				core.pool.pages[r_block.page_id].mem_blocks = append(core.pool.pages[r_block.page_id].mem_blocks[:r_block.mem_block_id], core.pool.pages[r_block.page_id].mem_blocks[r_block.mem_block_id+1:]...)
-				delete(page.mem_block_refs, int(free_block.offset))
+//Reset releases every allocation and returns each page to a single free block
+func (core *CoreAllocator) Reset() {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	core.reset()
+}
+
+func (core *CoreAllocator) reset() {
+	for _, pool := range core.pools {
+		pool.reset(core.backend)
+	}
+	core.buffers = make(map[MemRef]*CoreBuffer)
+	core.moved = make(map[MemRef]MemRef)
+	if core.sites != nil {
+		core.sites = make(map[MemRef]AllocationSite)
+	}
+}
+
+//Destroys all memory refernces and tree and sets a free block instance to the page size. Waits for a running
+//compaction pass to finish
+func (core *CoreAllocator) Destroy() {
+	core.running.Lock()
+	defer core.running.Unlock()
+	core.lock.Lock()
+	defer core.lock.Unlock()
+
+	if len(core.sites) > 0 {
+		fmt.Printf("CoreAllocator destroyed with %d live allocations\n%s", len(core.sites), leak_report(core.leaks()))
+	}
+	core.stop_trace()
+	core.reset()
+	for _, pool := range core.pools {
+		pool.destroy(core.backend)
+	}
+	core.pools = make(map[uint32]*MemPool)
+
+	for i := range core.retired {
+		core.retired[i].frames = 0
+	}
+	core.release_retired()
+	if core.defrag != nil {
+		core.defrag.destroy()
+		core.defrag = nil
+	}
+}
+
+//Allocates a page of device memory from the pool memory type and appends it to the pool
+func (pool *MemPool) new_page(backend MemoryBackend, desired_size uint64) error {
+	device_mem, err := backend.AllocateMemory(desired_size, pool.mem_info.MemoryTypeIndex)
+	if err != nil {
+		return err
+	}
+	_, err = pool.add_page(backend, device_mem, desired_size, false)
+	return err
+}
+
+//Adds the device memory to the pool as a page. Dedicated pages take the slot of a released dedicated page so the
+//page indices held by references stay valid
+func (pool *MemPool) add_page(backend MemoryBackend, device_mem vk.DeviceMemory, size uint64, dedicated bool) (*MemPage, error) {
+	page := MemPage{device_mem: device_mem, size: size, index: len(pool.pages), dedicated: dedicated}
+
+	//Host visible pages stay mapped until the pool is destroyed
+	mapped, err := pool.map_page(backend, device_mem, size)
+	if err != nil {
+		backend.FreeMemory(device_mem)
+		return nil, err
+	}
+	page.mapped = mapped
+	page.reset()
+	pool.size += size
+	pool.heap.usage += size
+
+	if dedicated {
+		for i := range pool.pages {
+			if pool.pages[i].dedicated && pool.pages[i].size == 0 {
+				page.index = i
+				page.generation = pool.pages[i].generation + 1
+				pool.pages[i] = page
+				return &pool.pages[i], nil
 			}
 		}
 	}
+	pool.pages = append(pool.pages, page)
+	return &pool.pages[len(pool.pages)-1], nil
 }
 
-//Creates a new memory page of the desired size
-func (core *CoreAllocator) NewMemoryPage(desired_size uint64, handle vk.Device, index int) error {
-	page := MemPage{}
-	page.free_block_refs = make(map[int]BlockRef, 1)
-	page.free_blocks = make([]Block64, 1)
-	page.mem_block_refs = make(map[int]BlockRef)
-	page.mem_blocks = make([]Block64, 0)
-	device_size := vk.DeviceSize(desired_size)
-	core.pool.mem_info.AllocationSize = device_size
-	core.pool.mem_info.PassRef()
-	page.index = index
-	page.size = uint64(device_size)
+//Frees the memory of a dedicated page leaving an empty slot for the next dedicated allocation
+func (pool *MemPool) release_page(backend MemoryBackend, page *MemPage) {
+	if page.mapped != nil {
+		backend.UnmapMemory(page.device_mem)
+	}
+	backend.FreeMemory(page.device_mem)
+	pool.size -= page.size
+	pool.heap.usage -= min_u64(pool.heap.usage, page.size)
 
-	page.tree_mem = *rbt.NewWithIntComparator()
-	page.tree_free = *rbt.NewWithIntComparator()
+	*page = MemPage{index: page.index, generation: page.generation + 1, dedicated: true}
+	page.reset()
+}
+
+//Bytes of the pool held by shared pages
+func (pool *MemPool) shared() uint64 {
+	var size uint64
+	for i := range pool.pages {
+		if !pool.pages[i].dedicated {
+			size += pool.pages[i].size
+		}
+	}
+	return size
+}
+
+//Best fit allocation across the pool pages, see CoreAllocator.Allocate. Linear and optimal resources are kept
+//BufferImageGranularity apart when they would otherwise share a granularity page
+func (pool *MemPool) allocate(size int, min_align int, kind uint8) (MemRef, error) {
 
-	alloc_infos := []vk.MemoryAllocateInfo{core.pool.mem_info}
-	device_mems := []vk.DeviceMemory{page.device_mem}
+	//Match Vulkan Alignment Specifications
+	alloc_size := align_up(size, min_align)
 
-	res := vk.AllocateMemory(handle, &alloc_infos[0], nil, &device_mems[0])
-	if res != vk.Success {
-		return NewError(res)
+	for i := range pool.pages {
+		page := &pool.pages[i]
+		if page.defrag || page.dedicated {
+			continue
+		}
+		key, offset, found := page.best_fit(alloc_size, min_align, kind, int(pool.alignment))
+		if !found {
+			continue
+		}
+
+		//Obtain Block Handles and split the free block into [padding | used | remainder]
+		block, _ := page.remove_free(key)
+		padding := offset - block.offset
+		remainder := block.size - padding - uint64(alloc_size)
+
+		if padding > 0 {
+			page.put_free(Block64{offset: block.offset, size: padding, flag: MARK_FREE})
+		}
+		if remainder > 0 {
+			page.put_free(Block64{offset: offset + uint64(alloc_size), size: remainder, flag: MARK_FREE})
+		}
+
+		//Memory block id key is it's offset which is unique
+		page.put_used(Block64{offset: offset, size: uint64(alloc_size), align: uint64(min_align), flag: MARK_USED, kind: kind})
+		return MemRef{key: int(offset), page: i, usage: MEM_REF, mem_type: pool.mem_info.MemoryTypeIndex, generation: page.generation}, nil
 	}
 
-	page.device_mem = device_mems[0]
+	return MemRef{}, NewError(vk.ErrorOutOfPoolMemory)
+}
 
-	//Store the free blocks
-	page.free_blocks[0] = Block64{offset: 0, size: desired_size, flag: MARK_FREE}
-	page.free_block_refs[0] = BlockRef{page_id: index, mem_block_id: 0}
-	page.tree_free.Put(0, int(page.free_blocks[0].size))
+//Returns used blocks flagged free back to the free trees
+func (pool *MemPool) clean() {
 
-	core.pool.pages = append(core.pool.pages, page)
-	return nil
+	//Check memory blocks for usage
+	for i := range pool.pages {
+		page := &pool.pages[i]
+		if page.defrag {
+			continue
+		}
+		marked := make([]int, 0)
+		for key, r_block := range page.mem_block_refs {
+			if page.mem_blocks[r_block.mem_block_id].flag == MARK_FREE {
+				marked = append(marked, key)
+			}
+		}
 
+		//Return memory back to the free tree and consolidate memory
+		for _, key := range marked {
+			block, _ := page.remove_used(key)
+			page.release(block)
+		}
+	}
 }
 
-//Returns a string map of relevant statistics and can be used by other tools to visually display memory usage
-func (core *CoreAllocator) Stats() map[string]string {
-	return nil
+func (pool *MemPool) reset(backend MemoryBackend) {
+	for i := range pool.pages {
+		if pool.pages[i].dedicated {
+			if pool.pages[i].size > 0 {
+				pool.release_page(backend, &pool.pages[i])
+			}
+			continue
+		}
+		pool.pages[i].reset()
+	}
 }
 
-func (core *CoreAllocator) Usage() string {
+//Maps the whole page when the pool memory type is host visible, device local pages are not mapped
+func (pool *MemPool) map_page(backend MemoryBackend, device_mem vk.DeviceMemory, size uint64) (unsafe.Pointer, error) {
+	if pool.vulkan_flags.PropertyFlags&vk.MemoryPropertyFlags(vk.MemoryPropertyHostVisibleBit) == 0 {
+		return nil, nil
+	}
+	return backend.MapMemory(device_mem, 0, size)
+}
+
+//Unmaps and frees the device memory of every page
+func (pool *MemPool) destroy(backend MemoryBackend) {
+	for _, page := range pool.pages {
+		if page.size == 0 {
+			continue
+		}
+		if page.mapped != nil {
+			backend.UnmapMemory(page.device_mem)
+		}
+		backend.FreeMemory(page.device_mem)
+	}
+	pool.pages = make([]MemPage, 0)
+	pool.heap.usage -= min_u64(pool.heap.usage, pool.size)
+	pool.size = 0
+}
+
+//Aggregates the page statistics of the pool
+func (pool *MemPool) stats() PoolStats {
+	stats := PoolStats{}
+	page_stats := make([]PoolStats, 0, len(pool.pages))
+	for i := range pool.pages {
+		if pool.pages[i].size == 0 {
+			continue
+		}
+		page := pool.pages[i].stats()
+		page_stats = append(page_stats, page)
+		stats.mean_frag += page.mean_frag
+		stats.mean_free += page.mean_free
+		stats.mean_usage += page.mean_usage
+		stats.allocations += page.allocations
+		stats.free_blocks += page.free_blocks
+		if page.max_free > stats.max_free {
+			stats.max_free = page.max_free
+		}
+	}
+	if len(page_stats) == 0 {
+		return stats
+	}
+
+	count := float32(len(page_stats))
+	stats.mean_frag /= count
+	stats.mean_free /= count
+	stats.mean_usage /= count
+	for _, page := range page_stats {
+		delta := page.mean_frag - stats.mean_frag
+		stats.frag_variance += delta * delta
+	}
+	stats.frag_variance /= count
+	return stats
+}
+
+//Prints the used and free blocks of each page
+func (pool *MemPool) usage() string {
 	var out string
-	for i, page := range core.pool.pages {
-		out += fmt.Sprintf("Page %d: (%d)bytes\nUsed Memory\n", i, page.size)
-		for j, block := range page.mem_blocks {
+	for i, page := range pool.pages {
+		if page.size == 0 {
+			continue
+		}
+		if page.dedicated {
+			out += fmt.Sprintf("Page %d: (%d)bytes dedicated\nUsed Memory\n", i, page.size)
+		} else {
+			out += fmt.Sprintf("Page %d: (%d)bytes\nUsed Memory\n", i, page.size)
+		}
+		for j, key := range page.tree_mem.Keys() {
+			block := page.mem_blocks[page.mem_block_refs[key.(int)].mem_block_id]
 			out += fmt.Sprintf("    m%d: offset ( %.8d ) size (%.8d )\n", j, block.offset, block.size)
 		}
 		out += fmt.Sprintf("Free Memory\n")
-		for j, block := range page.free_blocks {
+		for j, key := range page.tree_free.Keys() {
+			block := page.free_blocks[page.free_block_refs[key.(int)].mem_block_id]
 			out += fmt.Sprintf("    m%d: offset ( %.8d ) size (%.8d )\n", j, block.offset, block.size)
 		}
 
@@ -405,66 +1133,217 @@ func (core *CoreAllocator) Usage() string {
 	return out
 }
 
-//TODO add func ShowMemoryMap() map[string]string. Outputs JSON string data structure with Memory Block structure
+//Clears the page bookkeeping to a single free block spanning the page
+func (page *MemPage) reset() {
+	page.mem_blocks = make([]Block64, 0)
+	page.free_blocks = make([]Block64, 0)
+	page.mem_block_refs = make(map[int]BlockRef)
+	page.free_block_refs = make(map[int]BlockRef, 1)
+	page.tree_mem = *rbt.NewWithIntComparator()
+	page.tree_free = *rbt.NewWithIntComparator()
+	page.put_free(Block64{offset: 0, size: page.size, flag: MARK_FREE})
+}
 
-func (core *CoreAllocator) Free() {
-	for i, page := range core.pool.pages {
-		page.mem_blocks = make([]Block64, 0)
-		page.free_blocks = make([]Block64, 0)
-		for key := range page.mem_block_refs {
-			delete(page.mem_block_refs, key)
-		}
-		for key := range page.free_block_refs {
-			delete(page.free_block_refs, key)
+//Returns the used bytes, free bytes and the largest free block of the page
+func (page *MemPage) totals() (uint64, uint64, uint64) {
+	var used, free, max_free uint64
+	for _, block := range page.mem_blocks {
+		used += block.size
+	}
+	for _, block := range page.free_blocks {
+		free += block.size
+		if block.size > max_free {
+			max_free = block.size
 		}
-		page.tree_mem.Clear()
-		page.tree_free.Clear()
+	}
+	return used, free, max_free
+}
 
-		page.tree_mem = *rbt.NewWithIntComparator()
-		page.tree_free = *rbt.NewWithIntComparator()
-		page.free_blocks = append(page.free_blocks, Block64{0, page.size, MARK_FREE})
-		page.free_block_refs = make(map[int]BlockRef, 1)
-		page.mem_block_refs = make(map[int]BlockRef, 1)
-		page.free_block_refs[0] = BlockRef{i, 0}
-		page.tree_free.Put(0, page.size)
+//Statistics of a single page, means are the page values and the variance is zero
+func (page *MemPage) stats() PoolStats {
+	used, free, max_free := page.totals()
+	stats := PoolStats{
+		mean_frag:   fragmentation(free, max_free),
+		mean_free:   float32(free),
+		max_free:    float32(max_free),
+		allocations: len(page.mem_blocks),
+		free_blocks: len(page.free_blocks),
+	}
+	if page.size > 0 {
+		stats.mean_usage = float32(used) / float32(page.size)
+	}
+	return stats
+}
 
+//Exports the page blocks in offset order
+func (page *MemPage) memory_map() MemoryMapPage {
+	page_map := MemoryMapPage{Index: page.index, Size: page.size, Dedicated: page.dedicated, Stats: page.stats()}
+	page_map.Blocks = make([]MemoryMapBlock, 0, len(page.mem_blocks)+len(page.free_blocks))
+	for _, block := range page.mem_blocks {
+		page_map.Blocks = append(page_map.Blocks, MemoryMapBlock{Offset: block.offset, Size: block.size, Used: true, Kind: block.kind})
 	}
+	for _, block := range page.free_blocks {
+		page_map.Blocks = append(page_map.Blocks, MemoryMapBlock{Offset: block.offset, Size: block.size})
+	}
+	sort.Slice(page_map.Blocks, func(i, j int) bool { return page_map.Blocks[i].Offset < page_map.Blocks[j].Offset })
+	return page_map
+}
+
+//Writes the statistics into a Stats() map under the key prefix
+func (stats PoolStats) write(out map[string]string, prefix string) {
+	out[prefix+"mean_frag"] = fmt.Sprintf("%f", stats.mean_frag)
+	out[prefix+"frag_variance"] = fmt.Sprintf("%f", stats.frag_variance)
+	out[prefix+"mean_free"] = fmt.Sprintf("%f", stats.mean_free)
+	out[prefix+"max_free"] = fmt.Sprintf("%f", stats.max_free)
+	out[prefix+"mean_usage"] = fmt.Sprintf("%f", stats.mean_usage)
+	out[prefix+"allocations"] = fmt.Sprintf("%d", stats.allocations)
+	out[prefix+"free_blocks"] = fmt.Sprintf("%d", stats.free_blocks)
 }
 
-//Destroys all memory refernces and tree and sets a free block instance to the page size
-func (core *CoreAllocator) Destroy(handle vk.Device) {
-	core.Free()
-	for _, page := range core.pool.pages {
-		vk.FreeMemory(handle, page.device_mem, nil)
+//Fraction of the free memory outside of the largest free block
+func fragmentation(free uint64, max_free uint64) float32 {
+	if free == 0 {
+		return 0.0
 	}
+	return 1.0 - float32(max_free)/float32(free)
+}
 
+//Stores a used block in the block array, the reference map and the memory tree
+func (page *MemPage) put_used(block Block64) {
+	page.mem_blocks = append(page.mem_blocks, block)
+	page.mem_block_refs[int(block.offset)] = BlockRef{page_id: page.index, mem_block_id: len(page.mem_blocks) - 1}
+	page.tree_mem.Put(int(block.offset), int(block.size))
 }
 
-//Run is a static analyzer that can be used to identify new free blocks upon memory allocations. Pool state should
-//be incohrent until the static analyzer method has identified all free memory blocks.
-func (core *CoreAllocator) Run(x chan int) {
-	core.Clean()
+//Stores a free block in the block array, the reference map and the free tree
+func (page *MemPage) put_free(block Block64) {
+	page.free_blocks = append(page.free_blocks, block)
+	page.free_block_refs[int(block.offset)] = BlockRef{page_id: page.index, mem_block_id: len(page.free_blocks) - 1}
+	page.tree_free.Put(int(block.offset), int(block.size))
+}
+
+//Removes the used block keyed by offset. The last block is swapped into the vacated slot so every
+//other reference index stays valid
+func (page *MemPage) remove_used(key int) (Block64, bool) {
+	ref, ok := page.mem_block_refs[key]
+	if !ok {
+		return Block64{}, false
+	}
+	block := page.mem_blocks[ref.mem_block_id]
+	last := len(page.mem_blocks) - 1
+	if ref.mem_block_id != last {
+		moved := page.mem_blocks[last]
+		page.mem_blocks[ref.mem_block_id] = moved
+		page.mem_block_refs[int(moved.offset)] = ref
+	}
+	page.mem_blocks = page.mem_blocks[:last]
+	delete(page.mem_block_refs, key)
+	page.tree_mem.Remove(key)
+	return block, true
+}
+
+//Removes the free block keyed by offset, see remove_used
+func (page *MemPage) remove_free(key int) (Block64, bool) {
+	ref, ok := page.free_block_refs[key]
+	if !ok {
+		return Block64{}, false
+	}
+	block := page.free_blocks[ref.mem_block_id]
+	last := len(page.free_blocks) - 1
+	if ref.mem_block_id != last {
+		moved := page.free_blocks[last]
+		page.free_blocks[ref.mem_block_id] = moved
+		page.free_block_refs[int(moved.offset)] = ref
+	}
+	page.free_blocks = page.free_blocks[:last]
+	delete(page.free_block_refs, key)
+	page.tree_free.Remove(key)
+	return block, true
+}
+
+//Returns a block to the free tree coalescing it with the free neighbours on both sides
+func (page *MemPage) release(block Block64) {
+	block.flag = MARK_FREE
+
+	//Following free block starts where this block ends
+	if next, ok := page.remove_free(int(block.offset + block.size)); ok {
+		block.size += next.size
+	}
+
+	//Preceding free block is the closest free offset below this block
+	if prev_node, ok := page.tree_free.Floor(int(block.offset)); ok {
+		prev_key := prev_node.Key.(int)
+		if uint64(prev_key)+uint64(prev_node.Value.(int)) == block.offset {
+			prev, _ := page.remove_free(prev_key)
+			block.offset = prev.offset
+			block.size += prev.size
+		}
+	}
+
+	page.put_free(block)
 }
 
 //Host visible memory mapping
-func map_memory_float32(data *unsafe.Pointer, handle vk.Device, device_mem vk.DeviceMemory, size int, offset int) {
-	pointer_mem := uintptr(0)
-	p_mem := Ptr(pointer_mem)
-	data_slice := unsafe.Slice((*float32)(*data), size)
-	vk.MapMemory(handle, device_mem, vk.DeviceSize(offset), vk.DeviceSize(size), 0, &p_mem)
-	dest_slice := unsafe.Slice((*float32)(p_mem), size)
-	copy(dest_slice, data_slice)
-	vk.UnmapMemory(handle, device_mem)
-}
-
-func map_memory_int32(data *unsafe.Pointer, handle vk.Device, device_mem vk.DeviceMemory, size int, offset int) {
-	pointer_mem := uintptr(0)
-	p_mem := Ptr(pointer_mem)
-	data_slice := unsafe.Slice((*int32)(*data), size)
-	vk.MapMemory(handle, device_mem, vk.DeviceSize(offset), vk.DeviceSize(size), 0, &p_mem)
-	dest_slice := unsafe.Slice((*int32)(p_mem), size)
-	copy(dest_slice, data_slice)
-	vk.UnmapMemory(handle, device_mem)
+//Rounds size up to the next multiple of align
+func align_up(size int, align int) int {
+	if align <= 1 {
+		return size
+	}
+	return ((size + align - 1) / align) * align
+}
+
+//Get memory type index - HostVisible and HostCoherent memory is preferred, devices without it fall back to a non-coherent
+//host visible type which the allocator flushes and invalidates
+func host_memory_index(mem_props vk.PhysicalDeviceMemoryProperties) int32 {
+	mem_index := int32(-1)
+	for i := 0; i < int(mem_props.MemoryTypeCount); i++ {
+		mem_type := mem_props.MemoryTypes[i]
+		if match_memory_desired(int32(i), mem_type.PropertyFlags, int32(vk.MemoryPropertyHostVisibleBit|vk.MemoryPropertyHostCoherentBit)) {
+			mem_index = int32(i)
+		}
+	}
+	if mem_index >= 0 {
+		return mem_index
+	}
+	for i := 0; i < int(mem_props.MemoryTypeCount); i++ {
+		if match_memory_desired(int32(i), mem_props.MemoryTypes[i].PropertyFlags, int32(vk.MemoryPropertyHostVisibleBit)) {
+			return int32(i)
+		}
+	}
+	return 0
+}
+
+//Selects a host visible memory type allowed by type_bits, preferring host coherent types
+func host_memory_type(mem_props vk.PhysicalDeviceMemoryProperties, type_bits uint32) (uint32, error) {
+	if index, ok := select_memory_type(mem_props, type_bits, MEMORY_HOST_VISIBLE); ok {
+		return index, nil
+	}
+	if index, ok := select_memory_type(mem_props, type_bits, vk.MemoryPropertyFlags(vk.MemoryPropertyHostVisibleBit)); ok {
+		return index, nil
+	}
+	return 0, fmt.Errorf("No host visible memory type allowed by type bits %x\n", type_bits)
+}
+
+//Selects the memory type allowed by type_bits which has every desired property. Among the matches the type with
+//the fewest extra properties wins so host visible requests avoid device local types on discrete GPUs
+func select_memory_type(mem_props vk.PhysicalDeviceMemoryProperties, type_bits uint32, desired vk.MemoryPropertyFlags) (uint32, bool) {
+	best := uint32(0)
+	best_extra := -1
+	for i := uint32(0); i < mem_props.MemoryTypeCount; i++ {
+		if type_bits&(1<<i) == 0 {
+			continue
+		}
+		flags := mem_props.MemoryTypes[i].PropertyFlags
+		if !match_memory_desired(int32(i), flags, int32(desired)) {
+			continue
+		}
+		extra := bits.OnesCount32(uint32(flags &^ desired))
+		if best_extra < 0 || extra < best_extra {
+			best = i
+			best_extra = extra
+		}
+	}
+	return best, best_extra >= 0
 }
 
 func match_memory_desired(index int32, properties vk.MemoryPropertyFlags, desired int32) bool {
@@ -475,22 +1354,50 @@ func match_memory_desired(index int32, properties vk.MemoryPropertyFlags, desire
 	return false
 }
 
-//Search Tree Min Int
-func rbt_search(node *rbt.Node, comp_fn utils.Comparator, search int) (bool, *rbt.Node) {
-	found := false
+//Search the free tree for the best fit block, the smallest block which holds size bytes once its offset is aligned.
+//Returns the free block key and the aligned placement offset. A used neighbour of the other resource kind on the
+//same granularity page pushes the placement onto the next granularity boundary
+func (page *MemPage) best_fit(size int, align int, kind uint8, granularity int) (int, uint64, bool) {
+	best_key := -1
+	best_size := 0
+	best_offset := 0
+
+	//Walk the free blocks in offset order
+	it := page.tree_free.Iterator()
+	for it.Next() {
+		free_offset := it.Key().(int)
+		free_size := it.Value().(int)
+		if best_key >= 0 && free_size >= best_size {
+			continue
+		}
 
-	//Search Red-Black Tree for appropriate memory
-	for node != nil {
-		if comp_fn(search, node.Value) <= 0 {
-			found = true
-			return found, node
-		} else {
-			if node.Right != nil {
-				node = node.Right
-			} else {
-				return found, node
+		offset := align_up(free_offset, align)
+		if granularity > 1 {
+			//Free blocks are coalesced so used blocks sit directly before and after
+			if prev, ok := page.tree_mem.Floor(free_offset - 1); ok && page.conflicts(prev.Key.(int), kind) {
+				if (free_offset-1)/granularity == offset/granularity {
+					offset = align_up(offset, granularity)
+				}
+			}
+			next := free_offset + free_size
+			if _, ok := page.mem_block_refs[next]; ok && page.conflicts(next, kind) {
+				if (offset+size-1)/granularity == next/granularity {
+					continue
+				}
 			}
 		}
+
+		if offset+size <= free_offset+free_size {
+			best_key = free_offset
+			best_size = free_size
+			best_offset = offset
+		}
 	}
-	return found, node
+	return best_key, uint64(best_offset), best_key >= 0
+}
+
+//Whether the used block keyed by offset holds a resource of a different kind
+func (page *MemPage) conflicts(key int, kind uint8) bool {
+	ref, ok := page.mem_block_refs[key]
+	return ok && page.mem_blocks[ref.mem_block_id].kind != kind
 }
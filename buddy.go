@@ -0,0 +1,303 @@
+package dieselvk
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"unsafe"
+
+	vk "github.com/vulkan-go/vulkan"
+)
+
+/*
+CoreBuddyAllocator manages a single power of two MemPage by recursively halving blocks. A block of order k
+spans min_block << k bytes and its buddy lives at offset ^ (min_block << k), so allocate and free are both
+bounded by the number of orders. Internal fragmentation is bounded by the power of two rounding and external
+fragmentation is limited since buddies coalesce eagerly on Free.
+*/
+const (
+	BUDDY_MIN_BLOCK = 256
+)
+
+type CoreBuddyAllocator struct {
+	page       MemPage
+	backend    MemoryBackend
+	min_block  uint64
+	max_order  int
+	free_lists []map[uint64]bool //Per order set of free block offsets
+	allocated  map[uint64]int    //Key: Block offset Value: Block order
+	requested  map[uint64]uint64 //Key: Block offset Value: Requested size
+	mem_index  uint32
+	heap_size  uint64
+	coherent   bool   //Host writes need no flush
+	atom       uint64 //nonCoherentAtomSize flushes are widened to
+}
+
+func NewCoreBuddyAllocator(physical vk.PhysicalDevice, handle vk.Device, pool_size uint64, min_block uint64) (*CoreBuddyAllocator, error) {
+	return NewCoreBuddyAllocatorWithBackend(NewCoreMemory(physical, handle), pool_size, min_block)
+}
+
+//NewCoreBuddyAllocatorWithBackend creates a buddy allocator whose page is rounded up to the next power of two multiple
+//of min_block
+func NewCoreBuddyAllocatorWithBackend(backend MemoryBackend, pool_size uint64, min_block uint64) (*CoreBuddyAllocator, error) {
+	core := CoreBuddyAllocator{backend: backend}
+
+	if min_block == 0 {
+		min_block = BUDDY_MIN_BLOCK
+	}
+	core.min_block = next_pow2(min_block)
+
+	mem_props := backend.MemoryProperties()
+	core.mem_index = uint32(host_memory_index(mem_props))
+	core.heap_size = uint64(mem_props.MemoryHeaps[mem_props.MemoryTypes[core.mem_index].HeapIndex].Size)
+	core.coherent = mem_props.MemoryTypes[core.mem_index].PropertyFlags&vk.MemoryPropertyFlags(vk.MemoryPropertyHostCoherentBit) != 0
+	core.atom = uint64(backend.Limits().NonCoherentAtomSize)
+
+	if err := core.create_page(pool_size); err != nil {
+		return &core, err
+	}
+	return &core, nil
+}
+
+//Allocates the device memory page and seeds the free list with the single top order block
+func (core *CoreBuddyAllocator) create_page(pool_size uint64) error {
+	size := next_pow2(pool_size)
+	if size < core.min_block {
+		size = core.min_block
+	}
+
+	if size > core.heap_size {
+		return fmt.Errorf("Error Requested Memory Pool size greater than available heap size\n")
+	}
+
+	device_mem, err := core.backend.AllocateMemory(size, core.mem_index)
+	if err != nil {
+		return err
+	}
+
+	core.page = MemPage{device_mem: device_mem, size: size, index: 0}
+
+	//The host visible page stays mapped until Destroy
+	if core.page.mapped, err = core.backend.MapMemory(device_mem, 0, size); err != nil {
+		core.backend.FreeMemory(device_mem)
+		return err
+	}
+	core.max_order = bits.TrailingZeros64(size / core.min_block)
+	core.free_lists = make([]map[uint64]bool, core.max_order+1)
+	for i := range core.free_lists {
+		core.free_lists[i] = make(map[uint64]bool)
+	}
+	core.allocated = make(map[uint64]int)
+	core.requested = make(map[uint64]uint64)
+	core.free_lists[core.max_order][0] = true
+	return nil
+}
+
+//Allocate finds the smallest free order holding the request and splits it down to the requested order
+func (core *CoreBuddyAllocator) Allocate(size int, min_align int) (MemRef, error) {
+	need := uint64(size)
+	if uint64(min_align) > need {
+		need = uint64(min_align)
+	}
+
+	//Blocks are naturally aligned to their own size
+	order := core.order_of(need)
+	if order > core.max_order {
+		return MemRef{}, NewError(vk.ErrorOutOfPoolMemory)
+	}
+
+	current := order
+	for current <= core.max_order && len(core.free_lists[current]) == 0 {
+		current++
+	}
+	if current > core.max_order {
+		return MemRef{}, NewError(vk.ErrorOutOfPoolMemory)
+	}
+
+	var offset uint64
+	for offset = range core.free_lists[current] {
+		break
+	}
+	delete(core.free_lists[current], offset)
+
+	//Split returning the upper halves to the free lists
+	for current > order {
+		current--
+		core.free_lists[current][offset+core.block_size(current)] = true
+	}
+
+	core.allocated[offset] = order
+	core.requested[offset] = uint64(size)
+	return MemRef{key: int(offset), page: 0, usage: MEM_REF, mem_type: core.mem_index}, nil
+}
+
+//Free releases the block and merges it with its buddy for as long as the buddy is free
+func (core *CoreBuddyAllocator) Free(ref MemRef) error {
+	offset := uint64(ref.key)
+	order, ok := core.allocated[offset]
+	if !ok || ref.page != 0 || ref.usage != MEM_REF {
+		return fmt.Errorf("Free() memory reference page %d key %d is not allocated\n", ref.page, ref.key)
+	}
+	delete(core.allocated, offset)
+	delete(core.requested, offset)
+
+	for order < core.max_order {
+		buddy := offset ^ core.block_size(order)
+		if !core.free_lists[order][buddy] {
+			break
+		}
+		delete(core.free_lists[order], buddy)
+		if buddy < offset {
+			offset = buddy
+		}
+		order++
+	}
+	core.free_lists[order][offset] = true
+	return nil
+}
+
+//Upload binds the buffer to the allocated block and copies data into the host visible memory, flushing it when the
+//page memory type is non-coherent
+func (core *CoreBuddyAllocator) Upload(buffer vk.Buffer, ref MemRef, data []byte) error {
+	offset := uint64(ref.key)
+	order, ok := core.allocated[offset]
+	if !ok || core.page.mapped == nil {
+		return NewError(vk.ErrorMemoryMapFailed)
+	}
+	if uint64(len(data)) > core.block_size(order) {
+		return fmt.Errorf("Upload() %d bytes overflows block of %d bytes\n", len(data), core.block_size(order))
+	}
+
+	if err := core.backend.BindBufferMemory(buffer, core.page.device_mem, offset); err != nil {
+		return err
+	}
+
+	copy(unsafe.Slice((*byte)(unsafe.Add(core.page.mapped, offset)), len(data)), data)
+	if core.coherent || len(data) == 0 {
+		return nil
+	}
+	start, size := atom_span(core.atom, core.page.size, offset, uint64(len(data)))
+	return core.backend.FlushMemory(core.page.device_mem, start, size)
+}
+
+//Clean is a no-op since buddies are coalesced as soon as they are freed
+func (core *CoreBuddyAllocator) Clean() {
+}
+
+//Resize replaces the page with one of desired_size bytes. The page can only be replaced while no blocks are allocated
+func (core *CoreBuddyAllocator) Resize(desired_size int) error {
+	if len(core.allocated) > 0 {
+		return fmt.Errorf("Resize() buddy page has %d live allocations\n", len(core.allocated))
+	}
+	core.release_page()
+	return core.create_page(uint64(desired_size))
+}
+
+//Unmaps and frees the page device memory then resets the page and its blocks so a second release is a no-op and
+//nothing is allocated until a new page is created
+func (core *CoreBuddyAllocator) release_page() {
+	if core.page.mapped != nil {
+		core.backend.UnmapMemory(core.page.device_mem)
+	}
+	if core.page.device_mem != vk.NullDeviceMemory {
+		core.backend.FreeMemory(core.page.device_mem)
+	}
+	core.page = MemPage{}
+	core.max_order = -1
+	core.free_lists = nil
+	core.allocated = make(map[uint64]int)
+	core.requested = make(map[uint64]uint64)
+}
+
+//Returns a string map of the buddy page statistics
+func (core *CoreBuddyAllocator) Stats() map[string]string {
+	stats := make(map[string]string)
+	used := uint64(0)
+	requested := uint64(0)
+	for offset, order := range core.allocated {
+		used += core.block_size(order)
+		requested += core.requested[offset]
+	}
+
+	max_free := uint64(0)
+	free_count := 0
+	for order, list := range core.free_lists {
+		free_count += len(list)
+		if len(list) > 0 {
+			max_free = core.block_size(order)
+		}
+	}
+
+	free := core.page.size - used
+	stats["pages"] = "1"
+	stats["size"] = fmt.Sprintf("%d", core.page.size)
+	stats["used"] = fmt.Sprintf("%d", used)
+	stats["free"] = fmt.Sprintf("%d", free)
+	stats["allocations"] = fmt.Sprintf("%d", len(core.allocated))
+	stats["free_blocks"] = fmt.Sprintf("%d", free_count)
+	stats["max_free"] = fmt.Sprintf("%d", max_free)
+	stats["internal_waste"] = fmt.Sprintf("%d", used-requested)
+	stats["fragmentation"] = fmt.Sprintf("%f", fragmentation(free, max_free))
+	return stats
+}
+
+//Usage prints the page layout in the same form as CoreAllocator.Usage
+func (core *CoreBuddyAllocator) Usage() string {
+	out := fmt.Sprintf("Page %d: (%d)bytes\nUsed Memory\n", core.page.index, core.page.size)
+	used := make([]uint64, 0, len(core.allocated))
+	for offset := range core.allocated {
+		used = append(used, offset)
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i] < used[j] })
+	for j, offset := range used {
+		out += fmt.Sprintf("    m%d: offset ( %.8d ) size (%.8d )\n", j, offset, core.block_size(core.allocated[offset]))
+	}
+
+	out += fmt.Sprintf("Free Memory\n")
+	free := make([]Block64, 0)
+	for order, list := range core.free_lists {
+		for offset := range list {
+			free = append(free, Block64{offset: offset, size: core.block_size(order), flag: MARK_FREE})
+		}
+	}
+	sort.Slice(free, func(i, j int) bool { return free[i].offset < free[j].offset })
+	for j, block := range free {
+		out += fmt.Sprintf("    m%d: offset ( %.8d ) size (%.8d )\n", j, block.offset, block.size)
+	}
+
+	out += "\n----------------------\n"
+	return out
+}
+
+//Destroy releases the page device memory, destroying an allocator twice is harmless
+func (core *CoreBuddyAllocator) Destroy() {
+	core.release_page()
+}
+
+//Run only cleans since the buddy tree is always coherent, the pass ends by sending DEFRAG_DONE like every Allocator
+func (core *CoreBuddyAllocator) Run(x chan int) {
+	core.Clean()
+	if x != nil {
+		x <- DEFRAG_DONE
+	}
+}
+
+//Smallest order whose block holds size bytes
+func (core *CoreBuddyAllocator) order_of(size uint64) int {
+	if size <= core.min_block {
+		return 0
+	}
+	return bits.Len64((size - 1) / core.min_block)
+}
+
+func (core *CoreBuddyAllocator) block_size(order int) uint64 {
+	return core.min_block << uint(order)
+}
+
+//Rounds v up to the next power of two
+func next_pow2(v uint64) uint64 {
+	if v <= 1 {
+		return 1
+	}
+	return uint64(1) << uint(bits.Len64(v-1))
+}
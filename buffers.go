@@ -1,18 +1,33 @@
 package dieselvk
 
 import (
+	"fmt"
+
 	vk "github.com/vulkan-go/vulkan"
 )
 
+//VK_KHR_buffer_device_address values missing from the vulkan-go headers
+const (
+	BUFFER_USAGE_DEVICE_ADDRESS    = vk.BufferUsageFlags(0x00020000)    //VK_BUFFER_USAGE_SHADER_DEVICE_ADDRESS_BIT
+	MEMORY_ALLOCATE_DEVICE_ADDRESS = vk.MemoryAllocateFlags(0x00000002) //VK_MEMORY_ALLOCATE_DEVICE_ADDRESS_BIT
+)
+
 type CoreBuffer struct {
-	buffer    []vk.Buffer
-	mode      vk.SharingMode
-	usage     int32
-	reqs      vk.MemoryRequirements
-	mem_index uint32
-	elements  uint32
-	groups    uint32
-	prototype VertexAttribute
+	buffer     []vk.Buffer
+	mode       vk.SharingMode
+	usage      int32
+	reqs       vk.MemoryRequirements
+	size       vk.DeviceSize
+	mem_ref    MemRef
+	mem_index  uint32
+	elements   uint32
+	groups     uint32
+	prototype  VertexAttribute
+	index_type vk.IndexType  //Index buffers only, elements is the index count
+	stride     vk.DeviceSize //Dynamic uniform buffers only, padded size of one of the elements
+	handle     vk.Device     //Buffers created with BUFFER_USAGE_DEVICE_ADDRESS only, device queried for the address
+	view       vk.BufferView //Texel buffers only, formatted view read by the shaders
+	format     vk.Format     //Texel buffers only, format of the view
 }
 
 //Specifies new buffer memory allocation with a vertex attribute description attachment
@@ -31,15 +46,21 @@ func NewCoreVertexBuffer(handle vk.Device, physical vk.PhysicalDevice, bytes_siz
 	buffer_create.SharingMode = core.mode
 
 	buffer_create.Size = dev_size
+	core.size = dev_size
 	core.elements = uint32(dev_size / 4)
 	core.groups = core.elements / 3
 
+	Fatal(check_device_address(physical, vk.BufferUsageFlags(buffer_type)))
 	res := vk.CreateBuffer(handle, &buffer_create, nil, &core.buffer[0])
 
 	if res != vk.Success {
 		Fatal(NewError(res))
 	}
 
+	if vk.BufferUsageFlags(buffer_type)&BUFFER_USAGE_DEVICE_ADDRESS != 0 {
+		core.handle = handle
+	}
+
 	vk.GetBufferMemoryRequirements(handle, core.buffer[0], &core.reqs)
 	core.reqs.Deref()
 
@@ -62,15 +83,21 @@ func NewLayoutBuffer(handle vk.Device, physical vk.PhysicalDevice, bytes_size ui
 	buffer_create.Usage = vk.BufferUsageFlags(buffer_type)
 	buffer_create.SharingMode = core.mode
 	buffer_create.Size = dev_size
+	core.size = dev_size
 	core.elements = uint32(dev_size / 4)
 	core.groups = core.elements
 
+	Fatal(check_device_address(physical, vk.BufferUsageFlags(buffer_type)))
 	res := vk.CreateBuffer(handle, &buffer_create, nil, &core.buffer[0])
 
 	if res != vk.Success {
 		Fatal(NewError(res))
 	}
 
+	if vk.BufferUsageFlags(buffer_type)&BUFFER_USAGE_DEVICE_ADDRESS != 0 {
+		core.handle = handle
+	}
+
 	vk.GetBufferMemoryRequirements(handle, core.buffer[0], &core.reqs)
 	core.reqs.Deref()
 
@@ -78,7 +105,170 @@ func NewLayoutBuffer(handle vk.Device, physical vk.PhysicalDevice, bytes_size ui
 
 }
 
+//Specifies a new index buffer holding count indices of the index type
+func NewCoreIndexBuffer(handle vk.Device, physical vk.PhysicalDevice, count uint32, buffer_type int32, index_type vk.IndexType) *CoreBuffer {
+	index_size := uint32(4)
+	if index_type == vk.IndexTypeUint16 {
+		index_size = 2
+	}
+	core := NewLayoutBuffer(handle, physical, count*index_size, buffer_type)
+	core.elements = count
+	core.index_type = index_type
+	return core
+}
+
+//Returns the bytes, Vulkan index type and count of []uint16 or []uint32 indices
+func index_data(indices interface{}) ([]byte, vk.IndexType, uint32, error) {
+	switch data := indices.(type) {
+	case []uint16:
+		bytes, err := AsBytes(data)
+		return bytes, vk.IndexTypeUint16, uint32(len(data)), err
+	case []uint32:
+		bytes, err := AsBytes(data)
+		return bytes, vk.IndexTypeUint32, uint32(len(data)), err
+	}
+	return nil, vk.IndexTypeUint32, 0, fmt.Errorf("Index buffers hold []uint16 or []uint32 indices, got %T\n", indices)
+}
+
+//Specifies a new dynamic uniform buffer of count elements each padded to stride bytes
+func NewDynamicLayoutBuffer(handle vk.Device, physical vk.PhysicalDevice, count uint32, stride uint64, buffer_type int32) *CoreBuffer {
+	core := NewLayoutBuffer(handle, physical, count*uint32(stride), buffer_type)
+	core.elements = count
+	core.groups = count
+	core.stride = vk.DeviceSize(stride)
+	return core
+}
+
+//Specifies a new uniform or storage texel buffer of bytes_size bytes, the view is created once the buffer is bound
+//to memory with NewBufferView
+func NewCoreTexelBuffer(handle vk.Device, physical vk.PhysicalDevice, bytes_size uint32, buffer_type int32, format vk.Format) (*CoreBuffer, error) {
+	var properties vk.FormatProperties
+	vk.GetPhysicalDeviceFormatProperties(physical, format, &properties)
+	properties.Deref()
+	if err := CheckTexelFormat(format, properties, vk.BufferUsageFlags(buffer_type)); err != nil {
+		return nil, err
+	}
+	var device_properties vk.PhysicalDeviceProperties
+	vk.GetPhysicalDeviceProperties(physical, &device_properties)
+	device_properties.Deref()
+	device_properties.Limits.Deref()
+	if err := CheckTexelElements(format, uint64(bytes_size), device_properties.Limits.MaxTexelBufferElements); err != nil {
+		return nil, err
+	}
+	core := NewLayoutBuffer(handle, physical, bytes_size, buffer_type)
+	core.format = format
+	return core, nil
+}
+
+//CheckTexelFormat reports an error unless the format properties support every texel buffer usage in the flags
+func CheckTexelFormat(format vk.Format, properties vk.FormatProperties, usage vk.BufferUsageFlags) error {
+	uniform := usage&vk.BufferUsageFlags(vk.BufferUsageUniformTexelBufferBit) != 0
+	storage := usage&vk.BufferUsageFlags(vk.BufferUsageStorageTexelBufferBit) != 0
+	if !uniform && !storage {
+		return fmt.Errorf("Texel buffer usage %x has neither the uniform nor storage texel buffer bit\n", usage)
+	}
+	if uniform && properties.BufferFeatures&vk.FormatFeatureFlags(vk.FormatFeatureUniformTexelBufferBit) == 0 {
+		return fmt.Errorf("Format %d does not support uniform texel buffers\n", format)
+	}
+	if storage && properties.BufferFeatures&vk.FormatFeatureFlags(vk.FormatFeatureStorageTexelBufferBit) == 0 {
+		return fmt.Errorf("Format %d does not support storage texel buffers\n", format)
+	}
+	return nil
+}
+
+//Texel byte sizes of the uncompressed color formats, which are the formats texel buffers may use, by contiguous
+//VkFormat ranges
+var texel_sizes = []struct {
+	first vk.Format
+	last  vk.Format
+	size  uint64
+}{
+	{vk.FormatR4g4UnormPack8, vk.FormatR4g4UnormPack8, 1},
+	{vk.FormatR4g4b4a4UnormPack16, vk.FormatA1r5g5b5UnormPack16, 2},
+	{vk.FormatR8Unorm, vk.FormatR8Srgb, 1},
+	{vk.FormatR8g8Unorm, vk.FormatR8g8Srgb, 2},
+	{vk.FormatR8g8b8Unorm, vk.FormatB8g8r8Srgb, 3},
+	{vk.FormatR8g8b8a8Unorm, vk.FormatA2b10g10r10SintPack32, 4},
+	{vk.FormatR16Unorm, vk.FormatR16Sfloat, 2},
+	{vk.FormatR16g16Unorm, vk.FormatR16g16Sfloat, 4},
+	{vk.FormatR16g16b16Unorm, vk.FormatR16g16b16Sfloat, 6},
+	{vk.FormatR16g16b16a16Unorm, vk.FormatR16g16b16a16Sfloat, 8},
+	{vk.FormatR32Uint, vk.FormatR32Sfloat, 4},
+	{vk.FormatR32g32Uint, vk.FormatR32g32Sfloat, 8},
+	{vk.FormatR32g32b32Uint, vk.FormatR32g32b32Sfloat, 12},
+	{vk.FormatR32g32b32a32Uint, vk.FormatR32g32b32a32Sfloat, 16},
+	{vk.FormatR64Uint, vk.FormatR64Sfloat, 8},
+	{vk.FormatR64g64Uint, vk.FormatR64g64Sfloat, 16},
+	{vk.FormatR64g64b64Uint, vk.FormatR64g64b64Sfloat, 24},
+	{vk.FormatR64g64b64a64Uint, vk.FormatR64g64b64a64Sfloat, 32},
+	{vk.FormatB10g11r11UfloatPack32, vk.FormatE5b9g9r9UfloatPack32, 4},
+}
+
+//CheckTexelElements reports an error when bytes_size bytes of the format hold more texels than the device
+//maxTexelBufferElements limit, which the whole range view of a texel buffer would exceed
+func CheckTexelElements(format vk.Format, bytes_size uint64, max_elements uint32) error {
+	for _, sizes := range texel_sizes {
+		if format < sizes.first || format > sizes.last {
+			continue
+		}
+		if elements := bytes_size / sizes.size; elements > uint64(max_elements) {
+			return fmt.Errorf("Texel buffer of %d format %d texels exceeds maxTexelBufferElements %d\n", elements, format, max_elements)
+		}
+		return nil
+	}
+	return fmt.Errorf("Format %d is not an uncompressed color format usable by texel buffers\n", format)
+}
+
+//NewBufferView creates the formatted view of a texel buffer over its whole range, the buffer must be bound to memory
+func (core *CoreBuffer) NewBufferView(handle vk.Device) error {
+	if core.view != vk.NullBufferView {
+		vk.DestroyBufferView(handle, core.view, nil)
+		core.view = vk.NullBufferView
+	}
+	view_info := vk.BufferViewCreateInfo{
+		SType:  vk.StructureTypeBufferViewCreateInfo,
+		Buffer: core.buffer[0],
+		Format: core.format,
+		Offset: 0,
+		Range:  vk.DeviceSize(vk.WholeSize),
+	}
+	if res := vk.CreateBufferView(handle, &view_info, nil, &core.view); res != vk.Success {
+		return NewError(res)
+	}
+	return nil
+}
+
+//MemoryRef returns the allocator reference of the buffer memory, kept current when compaction moves the buffer
+func (core *CoreBuffer) MemoryRef() MemRef {
+	return core.mem_ref
+}
+
+//DeviceAddress returns the GPU address of a buffer created with BUFFER_USAGE_DEVICE_ADDRESS to write into push
+//constants or other buffers. The buffer must be bound to memory, such buffers are never moved by compaction
+func (core *CoreBuffer) DeviceAddress() (uint64, error) {
+	if core.handle == nil {
+		return 0, fmt.Errorf("DeviceAddress() buffer was not created with BUFFER_USAGE_DEVICE_ADDRESS\n")
+	}
+	address := buffer_device_address(core.handle, core.buffer[0])
+	if address == 0 {
+		return 0, fmt.Errorf("DeviceAddress() vkGetBufferDeviceAddress is not available on the device\n")
+	}
+	return address, nil
+}
+
+//Rejects BUFFER_USAGE_DEVICE_ADDRESS on devices without the bufferDeviceAddress feature, which the instances enable
+//whenever it is supported
+func check_device_address(physical vk.PhysicalDevice, usage vk.BufferUsageFlags) error {
+	if usage&BUFFER_USAGE_DEVICE_ADDRESS != 0 && !supports_device_address(physical) {
+		return fmt.Errorf("BUFFER_USAGE_DEVICE_ADDRESS requires VK_KHR_buffer_device_address with the bufferDeviceAddress feature\n")
+	}
+	return nil
+}
+
 func (core *CoreBuffer) Destroy(handle vk.Device) {
+	if core.view != vk.NullBufferView {
+		vk.DestroyBufferView(handle, core.view, nil)
+	}
 	vk.DestroyBuffer(handle, core.buffer[0], nil)
 
 }
@@ -0,0 +1,64 @@
+//Replay runs an allocation trace recorded by CoreAllocator.TraceTo against an allocator strategy backed by fake
+//memory and prints peak usage, failure points and fragmentation over time
+//
+//	replay -trace session.trace -strategy core -pool 4194304 -pages 1 -ceiling 268435456 -interval 100
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/andewx/dieselvk"
+)
+
+func main() {
+	trace_path := flag.String("trace", "", "allocation trace file")
+	strategy := flag.String("strategy", "core", "allocator strategy, core or buddy")
+	pool_size := flag.Uint64("pool", dieselvk.POOL_DEFAULT_SIZE, "initial pool bytes, the page size of core and the page of buddy")
+	pages := flag.Int("pages", dieselvk.POOL_DEFAULT_PAGES, "pages the core pool starts with")
+	ceiling := flag.Uint64("ceiling", dieselvk.POOL_CEILING, "bytes the core pool may grow to")
+	min_block := flag.Uint64("min_block", 256, "smallest buddy block")
+	heap_size := flag.Uint64("heap", 1<<32, "fake heap bytes")
+	interval := flag.Int("interval", 1, "ops between fragmentation samples")
+	flag.Parse()
+
+	if *trace_path == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(*trace_path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	ops, err := dieselvk.ReadTrace(file)
+	file.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s", err)
+		os.Exit(1)
+	}
+
+	var allocator dieselvk.Allocator
+	fake := dieselvk.NewFakeMemory(*heap_size)
+	switch *strategy {
+	case "core":
+		core, err := dieselvk.NewCoreAllocatorWithBackend(fake, *pool_size, *pages)
+		if err == nil {
+			core.SetPoolCeiling(*ceiling)
+		}
+		allocator = core
+	case "buddy":
+		allocator, err = dieselvk.NewCoreBuddyAllocatorWithBackend(fake, *pool_size, *min_block)
+	default:
+		err = fmt.Errorf("unknown strategy %s\n", *strategy)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s", err)
+		os.Exit(1)
+	}
+	defer allocator.Destroy()
+
+	fmt.Printf("Strategy: %s\n%s", *strategy, dieselvk.Replay(allocator, ops, *interval))
+}
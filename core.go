@@ -164,11 +164,11 @@ func (base *BaseCore) CreateInstance(instances []Instance) error {
 		}
 
 		if ref.Selector == RENDER_INSTANCE {
-			base.instances[ref.Name], err = NewCoreRenderInstance(instance, base.instance_names[0], *inst_ext, *layer_ext, api_device, &base.display)
+			base.instances[ref.Name], err = NewCoreRenderInstance(instance, base.instance_names[0], *inst_ext, *layer_ext, api_device, &base.display, base.core_props["allocator"])
 		}
 
 		if ref.Selector == DEVICE_INSTANCE {
-			base.instances[ref.Name], err = NewCoreDeviceInstance(instance, base.instance_names[0], *inst_ext, *layer_ext, api_device)
+			base.instances[ref.Name], err = NewCoreDeviceInstance(instance, base.instance_names[0], *inst_ext, *layer_ext, api_device, base.core_props["allocator"])
 		}
 
 		if err != nil {
@@ -0,0 +1,468 @@
+package dieselvk
+
+import (
+	"fmt"
+	"unsafe"
+
+	vk "github.com/vulkan-go/vulkan"
+)
+
+/*
+Background compaction for CoreAllocator. Run scans the pools for pages whose fragmentation is at least
+DEFRAG_THRESHOLD and whose blocks all belong to buffers registered with Track. The blocks of such a page are
+packed into a fresh page with GPU buffer copies and a replacement vk.Buffer is bound at every new offset.
+
+While a page is compacted its pool is POOL_INCOHRENT. Main thread allocations skip the page while Free, Bind, Map
+and writes on the page wait for the move to finish and follow the moved references afterwards. The replacement
+buffers are swapped into their CoreBuffers by the next Clean call on the main thread, the old page and buffers are
+released retire_frames Clean calls later once no frame in flight can reference them.
+*/
+const (
+	DEFRAG_THRESHOLD = 0.25 //Page fragmentation at which a page is compacted
+	DEFRAG_DONE      = -1   //Sent on the Run channel when a pass has finished
+)
+
+type DefragMove struct {
+	key    int    //Source offset
+	offset uint64 //Destination offset
+	size   uint64
+	align  uint64 //Alignment the block was allocated with
+	buffer *CoreBuffer
+	handle vk.Buffer //Replacement buffer bound at the destination
+	ref    MemRef    //Reference after the move
+}
+
+type DefragPlan struct {
+	pool       *MemPool
+	type_index uint32
+	page       int
+	generation uint32
+	size       uint64
+	src_mem    vk.DeviceMemory
+	dst_mem    vk.DeviceMemory
+	src_mapped unsafe.Pointer //Persistent mappings of host visible pages
+	dst_mapped unsafe.Pointer
+	moves      []DefragMove
+}
+
+//Resources replaced by a compaction pass, released by Clean once their frames have passed
+type RetiredPage struct {
+	device_mem vk.DeviceMemory
+	mapped     bool
+	moves      []DefragMove
+	buffers    []vk.Buffer
+	swapped    bool
+	frames     int
+}
+
+//Device state used to record compaction copies on a transfer capable queue
+type CoreDefrag struct {
+	handle vk.Device
+	queues *CoreQueue
+	family int
+	pool   *CorePool
+}
+
+//EnableDefrag lets Run move blocks with GPU copy commands. Without it compaction copies through host mappings
+//which only FakeMemory supports
+func (core *CoreAllocator) EnableDefrag(handle vk.Device, queues *CoreQueue) error {
+	found, _, family := queues.BindTransferQueue(handle)
+	if !found {
+		return fmt.Errorf("No transfer capable device queue found\n")
+	}
+
+	defrag := CoreDefrag{handle: handle, queues: queues, family: family}
+	pool, err := NewCorePool(&defrag.handle, uint32(family))
+	if err != nil {
+		return err
+	}
+	defrag.pool = pool
+
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	core.defrag = &defrag
+	return nil
+}
+
+//SetRetireFrames sets the number of Clean calls a moved page outlives its replacement, usually the swapchain depth
+func (core *CoreAllocator) SetRetireFrames(frames int) {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	core.retire_frames = frames
+}
+
+//Track registers the buffer bound to ref as movable. Compaction rebinds the buffer by replacing its vk.Buffer so
+//only buffers bound at command record time should be tracked, descriptor sets are not rewritten. Buffers created
+//with BUFFER_USAGE_DEVICE_ADDRESS are rejected since moving them would invalidate addresses already handed out
+func (core *CoreAllocator) Track(ref MemRef, buffer *CoreBuffer) error {
+	if vk.BufferUsageFlags(buffer.usage)&BUFFER_USAGE_DEVICE_ADDRESS != 0 {
+		return fmt.Errorf("Track() buffers with device addresses are never moved\n")
+	}
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	ref = core.wait_compaction(ref)
+	if _, _, err := core.block(ref); err != nil {
+		return err
+	}
+	core.buffers[ref] = buffer
+	buffer.mem_ref = ref
+	return nil
+}
+
+//Run compacts fragmented pages in the background, start it with go allocator.Run(progress). The number of blocks
+//moved is sent on x for each compacted page without blocking, so counts are dropped when x is full. The pass ends
+//by sending DEFRAG_DONE once compaction has released the allocator, see Allocator
+func (core *CoreAllocator) Run(x chan int) {
+	core.compact(x)
+	if x != nil {
+		x <- DEFRAG_DONE
+	}
+}
+
+//Compacts pages until none is worth moving, holding running so Destroy waits for the pass
+func (core *CoreAllocator) compact(x chan int) {
+	core.running.Lock()
+	defer core.running.Unlock()
+
+	for {
+		plan, err := core.plan_defrag()
+		if err != nil || plan == nil {
+			return
+		}
+		err = core.copy_defrag(plan)
+		core.commit_defrag(plan, err)
+		if err != nil {
+			return
+		}
+		select {
+		case x <- len(plan.moves):
+		default:
+		}
+	}
+}
+
+//Selects the most fragmented movable page and allocates the page it is packed into
+func (core *CoreAllocator) plan_defrag() (*DefragPlan, error) {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+
+	var best *DefragPlan
+	best_frag := float32(0)
+	for _, type_index := range core.pool_types() {
+		pool := core.pools[type_index]
+		pool.clean()
+		for i := range pool.pages {
+			page := &pool.pages[i]
+			if page.defrag || page.dedicated || len(page.mem_blocks) == 0 {
+				continue
+			}
+
+			_, free, max_free := page.totals()
+			frag := fragmentation(free, max_free)
+			if frag < DEFRAG_THRESHOLD || (best != nil && frag <= best_frag) {
+				continue
+			}
+
+			//Packing must grow the largest free block or the page would be selected again
+			moves, end, ok := core.plan_page(type_index, page)
+			if !ok || page.size-end <= max_free {
+				continue
+			}
+			best = &DefragPlan{pool: pool, type_index: type_index, page: i, generation: page.generation, size: page.size, src_mem: page.device_mem, src_mapped: page.mapped, moves: moves}
+			best_frag = frag
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+
+	//The destination page is held alongside the source until the move commits so it must fit as pool growth
+	if err := core.check_growth(best.pool, best.size, best.size); err != nil {
+		return nil, err
+	}
+	dst_mem, err := core.backend.AllocateMemory(best.size, best.type_index)
+	if err != nil {
+		return nil, err
+	}
+	if best.dst_mapped, err = best.pool.map_page(core.backend, dst_mem, best.size); err != nil {
+		core.backend.FreeMemory(dst_mem)
+		return nil, err
+	}
+	best.dst_mem = dst_mem
+	best.pool.pages[best.page].defrag = true
+	best.pool.status = POOL_INCOHRENT
+	return best, nil
+}
+
+//Packs the page blocks in offset order from the start of the page, each at the larger of the buffer alignment and
+//the alignment it was allocated with. Returns false if any block is not movable
+func (core *CoreAllocator) plan_page(type_index uint32, page *MemPage) ([]DefragMove, uint64, bool) {
+	moves := make([]DefragMove, 0, len(page.mem_blocks))
+	cursor := uint64(0)
+	for _, key := range page.tree_mem.Keys() {
+		ref := MemRef{key: key.(int), page: page.index, usage: MEM_REF, mem_type: type_index, generation: page.generation}
+		buffer, ok := core.buffers[ref]
+		if !ok {
+			return moves, 0, false
+		}
+
+		block := page.mem_blocks[page.mem_block_refs[ref.key].mem_block_id]
+		align := max_u64(max_u64(uint64(buffer.reqs.Alignment), block.align), 1)
+		offset := uint64(align_up(int(cursor), int(align)))
+		moves = append(moves, DefragMove{key: ref.key, offset: offset, size: block.size, align: block.align, buffer: buffer})
+		cursor = offset + block.size
+	}
+	return moves, cursor, true
+}
+
+//Copies the planned blocks into the new page and creates the replacement buffers
+func (core *CoreAllocator) copy_defrag(plan *DefragPlan) error {
+	core.lock.Lock()
+	defrag := core.defrag
+	core.lock.Unlock()
+
+	if defrag == nil {
+		//Backend only allocators move the bytes through host mappings
+		core.lock.Lock()
+		defer core.lock.Unlock()
+		return core.copy_host(plan)
+	}
+	return defrag.copy_device(core.backend, plan)
+}
+
+func (core *CoreAllocator) copy_host(plan *DefragPlan) error {
+	src, dst := plan.src_mapped, plan.dst_mapped
+	if src == nil {
+		mapped, err := core.backend.MapMemory(plan.src_mem, 0, plan.size)
+		if err != nil {
+			return err
+		}
+		defer core.backend.UnmapMemory(plan.src_mem)
+		src = mapped
+	}
+	if dst == nil {
+		mapped, err := core.backend.MapMemory(plan.dst_mem, 0, plan.size)
+		if err != nil {
+			return err
+		}
+		defer core.backend.UnmapMemory(plan.dst_mem)
+		dst = mapped
+	}
+
+	for _, move := range plan.moves {
+		if err := core.invalidate(plan.type_index, plan.src_mem, plan.size, uint64(move.key), move.size); err != nil {
+			return err
+		}
+		copy(unsafe.Slice((*byte)(unsafe.Add(dst, move.offset)), move.size), unsafe.Slice((*byte)(unsafe.Add(src, move.key)), move.size))
+		if err := core.flush(plan.type_index, plan.dst_mem, plan.size, move.offset, move.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Records one copy region per move between buffers spanning the old and new page and waits for the copy
+func (defrag *CoreDefrag) copy_device(backend MemoryBackend, plan *DefragPlan) error {
+	usage := vk.BufferUsageFlags(vk.BufferUsageTransferSrcBit | vk.BufferUsageTransferDstBit)
+	src, err := defrag.bound_buffer(backend, plan.src_mem, 0, plan.size, usage)
+	if err != nil {
+		return err
+	}
+	defer vk.DestroyBuffer(defrag.handle, src, nil)
+	dst, err := defrag.bound_buffer(backend, plan.dst_mem, 0, plan.size, usage)
+	if err != nil {
+		return err
+	}
+	defer vk.DestroyBuffer(defrag.handle, dst, nil)
+
+	regions := make([]vk.BufferCopy, len(plan.moves))
+	for i, move := range plan.moves {
+		regions[i] = vk.BufferCopy{SrcOffset: vk.DeviceSize(move.key), DstOffset: vk.DeviceSize(move.offset), Size: vk.DeviceSize(move.size)}
+	}
+
+	commands := make([]vk.CommandBuffer, 1)
+	res := vk.AllocateCommandBuffers(defrag.handle, &vk.CommandBufferAllocateInfo{
+		SType:              vk.StructureTypeCommandBufferAllocateInfo,
+		CommandPool:        defrag.pool.pool,
+		Level:              vk.CommandBufferLevelPrimary,
+		CommandBufferCount: uint32(1),
+	}, commands)
+	if res != vk.Success {
+		return NewError(res)
+	}
+	defer vk.FreeCommandBuffers(defrag.handle, defrag.pool.pool, 1, commands)
+
+	vk.BeginCommandBuffer(commands[0], &vk.CommandBufferBeginInfo{
+		SType: vk.StructureTypeCommandBufferBeginInfo,
+		Flags: vk.CommandBufferUsageFlags(vk.CommandBufferUsageOneTimeSubmitBit),
+	})
+	vk.CmdCopyBuffer(commands[0], src, dst, uint32(len(regions)), regions)
+	vk.EndCommandBuffer(commands[0])
+
+	var fence vk.Fence
+	vk.CreateFence(defrag.handle, &vk.FenceCreateInfo{SType: vk.StructureTypeFenceCreateInfo}, nil, &fence)
+	defer vk.DestroyFence(defrag.handle, fence, nil)
+
+	submit_info := vk.SubmitInfo{
+		SType:              vk.StructureTypeSubmitInfo,
+		CommandBufferCount: 1,
+		PCommandBuffers:    commands,
+	}
+	if res := defrag.queues.Submit(defrag.family, []vk.SubmitInfo{submit_info}, fence); res != vk.Success {
+		return NewError(res)
+	}
+	if res := vk.WaitForFences(defrag.handle, 1, []vk.Fence{fence}, vk.True, vk.MaxUint64); res != vk.Success {
+		return NewError(res)
+	}
+
+	//Recreate every moved buffer against its new offset
+	for i := range plan.moves {
+		move := &plan.moves[i]
+		handle, err := defrag.bound_buffer(backend, plan.dst_mem, move.offset, uint64(move.buffer.size), vk.BufferUsageFlags(move.buffer.usage))
+		if err != nil {
+			return err
+		}
+		move.handle = handle
+	}
+	return nil
+}
+
+//Creates a buffer of size bytes bound to memory at offset
+func (defrag *CoreDefrag) bound_buffer(backend MemoryBackend, memory vk.DeviceMemory, offset uint64, size uint64, usage vk.BufferUsageFlags) (vk.Buffer, error) {
+	var buffer vk.Buffer
+	res := vk.CreateBuffer(defrag.handle, &vk.BufferCreateInfo{
+		SType:       vk.StructureTypeBufferCreateInfo,
+		Size:        vk.DeviceSize(size),
+		Usage:       usage,
+		SharingMode: vk.SharingModeExclusive,
+	}, nil, &buffer)
+	if res != vk.Success {
+		return buffer, NewError(res)
+	}
+	if err := backend.BindBufferMemory(buffer, memory, offset); err != nil {
+		vk.DestroyBuffer(defrag.handle, buffer, nil)
+		return vk.Buffer(vk.NullHandle), err
+	}
+	return buffer, nil
+}
+
+func (defrag *CoreDefrag) destroy() {
+	defrag.pool.Destroy(&defrag.handle)
+}
+
+//Replaces the compacted page with the packed page and forwards the moved references
+func (core *CoreAllocator) commit_defrag(plan *DefragPlan, err error) {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	defer core.idle.Broadcast()
+
+	pool := plan.pool
+	old := &pool.pages[plan.page]
+	old.defrag = false
+	defer core.update_status(pool)
+
+	if err != nil {
+		//Keep the original page and release the partially created replacement
+		retired := RetiredPage{device_mem: plan.dst_mem, mapped: plan.dst_mapped != nil, swapped: true}
+		for _, move := range plan.moves {
+			if move.handle != vk.Buffer(vk.NullHandle) {
+				retired.buffers = append(retired.buffers, move.handle)
+			}
+		}
+		core.retired = append(core.retired, retired)
+		return
+	}
+
+	page := MemPage{device_mem: plan.dst_mem, mapped: plan.dst_mapped, size: old.size, index: old.index, generation: old.generation + 1}
+	page.reset()
+	page.remove_free(0)
+
+	cursor := uint64(0)
+	for i := range plan.moves {
+		move := &plan.moves[i]
+		if move.offset > cursor {
+			page.put_free(Block64{offset: cursor, size: move.offset - cursor, flag: MARK_FREE})
+		}
+		page.put_used(Block64{offset: move.offset, size: move.size, align: move.align, flag: MARK_USED, kind: RESOURCE_LINEAR})
+		cursor = move.offset + move.size
+
+		from := MemRef{key: move.key, page: plan.page, usage: MEM_REF, mem_type: plan.type_index, generation: plan.generation}
+		move.ref = MemRef{key: int(move.offset), page: plan.page, usage: MEM_REF, mem_type: plan.type_index, generation: page.generation}
+		core.moved[from] = move.ref
+		core.move_site(from, move.ref)
+		core.trace.move(from, move.ref)
+		delete(core.buffers, from)
+		core.buffers[move.ref] = move.buffer
+	}
+	if cursor < page.size {
+		page.put_free(Block64{offset: cursor, size: page.size - cursor, flag: MARK_FREE})
+	}
+
+	pool.pages[plan.page] = page
+	core.retired = append(core.retired, RetiredPage{device_mem: plan.src_mem, mapped: plan.src_mapped != nil, moves: plan.moves, frames: core.retire_frames})
+}
+
+//Pools are coherent once none of their pages is being compacted
+func (core *CoreAllocator) update_status(pool *MemPool) {
+	pool.status = POOL_COHERENT
+	for i := range pool.pages {
+		if pool.pages[i].defrag {
+			pool.status = POOL_INCOHRENT
+		}
+	}
+}
+
+//Blocks while the page holding ref is compacted and returns the reference after any moves, the caller holds
+//the allocator lock
+func (core *CoreAllocator) wait_compaction(ref MemRef) MemRef {
+	for {
+		for {
+			next, ok := core.moved[ref]
+			if !ok {
+				break
+			}
+			ref = next
+		}
+
+		pool, ok := core.pools[ref.mem_type]
+		if !ok || ref.page < 0 || ref.page >= len(pool.pages) || !pool.pages[ref.page].defrag {
+			return ref
+		}
+		core.idle.Wait()
+	}
+}
+
+//Swaps the replacement buffers into their CoreBuffers and releases retired pages whose frames have passed, the
+//caller holds the allocator lock
+func (core *CoreAllocator) release_retired() {
+	remaining := make([]RetiredPage, 0, len(core.retired))
+	for _, retired := range core.retired {
+		if !retired.swapped {
+			for _, move := range retired.moves {
+				if move.handle != vk.Buffer(vk.NullHandle) {
+					retired.buffers = append(retired.buffers, move.buffer.buffer[0])
+					move.buffer.buffer[0] = move.handle
+				}
+				move.buffer.mem_ref = move.ref
+			}
+			retired.swapped = true
+		}
+
+		if retired.frames > 0 {
+			retired.frames--
+			remaining = append(remaining, retired)
+			continue
+		}
+
+		if core.defrag != nil {
+			for _, buffer := range retired.buffers {
+				vk.DestroyBuffer(core.defrag.handle, buffer, nil)
+			}
+		}
+		if retired.mapped {
+			core.backend.UnmapMemory(retired.device_mem)
+		}
+		core.backend.FreeMemory(retired.device_mem)
+	}
+	core.retired = remaining
+}
@@ -145,6 +145,51 @@ func NewDescriptorLayouts(handle vk.Device, location []uint32, descriptor_type [
 
 }
 
+//Creates a single descriptor set layout holding a binding for each location of the matching descriptor type, visible
+//to the matching shader stages
+func NewDescriptorSetLayout(handle vk.Device, location []uint32, descriptor_type []vk.DescriptorType, stage_flags []vk.ShaderStageFlags) (vk.DescriptorSetLayout, error) {
+	var layout vk.DescriptorSetLayout
+	bindings := make([]vk.DescriptorSetLayoutBinding, len(descriptor_type))
+	for i := 0; i < len(bindings); i++ {
+		bindings[i].Binding = location[i]
+		bindings[i].DescriptorCount = 1
+		bindings[i].DescriptorType = descriptor_type[i]
+		bindings[i].StageFlags = stage_flags[i]
+	}
+
+	layout_info := vk.DescriptorSetLayoutCreateInfo{}
+	layout_info.SType = vk.StructureTypeDescriptorSetLayoutCreateInfo
+	layout_info.BindingCount = uint32(len(bindings))
+	layout_info.PBindings = bindings
+	if res := vk.CreateDescriptorSetLayout(handle, &layout_info, nil, &layout); res != vk.Success {
+		return layout, NewError(res)
+	}
+	return layout, nil
+}
+
+//Binding location and descriptor type a texel buffer is written to
+type TexelBinding struct {
+	location        int
+	descriptor_type vk.DescriptorType
+}
+
+//Texel buffer bindings of the default set layouts for a buffer usage
+func texel_bindings(usage vk.BufferUsageFlags) []TexelBinding {
+	bindings := make([]TexelBinding, 0, 2)
+	if usage&vk.BufferUsageFlags(vk.BufferUsageUniformTexelBufferBit) != 0 {
+		bindings = append(bindings, TexelBinding{location: UNIFORM_TEXEL_BINDING, descriptor_type: vk.DescriptorTypeUniformTexelBuffer})
+	}
+	if usage&vk.BufferUsageFlags(vk.BufferUsageStorageTexelBufferBit) != 0 {
+		bindings = append(bindings, TexelBinding{location: STORAGE_TEXEL_BINDING, descriptor_type: vk.DescriptorTypeStorageTexelBuffer})
+	}
+	return bindings
+}
+
+//Dynamic descriptor types take an offset when the set is bound
+func is_dynamic(descriptor_type vk.DescriptorType) bool {
+	return descriptor_type == vk.DescriptorTypeUniformBufferDynamic || descriptor_type == vk.DescriptorTypeStorageBufferDynamic
+}
+
 //Appends new buffer and binds the buffer data type and location
 func (core *CoreDescriptor) AddBuffer(handle vk.Device, binding int, data_type int, set_id int, buffer CoreBuffer) {
 
@@ -160,14 +205,38 @@ func (core *CoreDescriptor) AddBuffer(handle vk.Device, binding int, data_type i
 	binfo[0].Buffer = core.p_buffers[index].buffer.buffer[0]
 	binfo[0].Offset = vk.DeviceSize(0)
 	binfo[0].Range = core.p_buffers[index].buffer.reqs.Size
+	//Dynamic descriptors view a single element, the element is selected by the dynamic offset at bind time
+	if is_dynamic(vk.DescriptorType(data_type)) && buffer.stride != 0 {
+		binfo[0].Range = buffer.stride
+	}
 
 	write := make([]vk.WriteDescriptorSet, 1)
 	write[0].SType = vk.StructureTypeWriteDescriptorSet
 	write[0].DstBinding = uint32(core.p_buffers[index].binding)
 	write[0].DstSet = core.set[set_id]
 	write[0].DescriptorCount = 1
-	write[0].DescriptorType = vk.DescriptorType(vk.DescriptorTypeUniformBuffer)
+	write[0].DescriptorType = vk.DescriptorType(data_type)
 	write[0].PBufferInfo = binfo
 	vk.UpdateDescriptorSets(handle, 1, write, 0, nil)
 
 }
+
+//Appends a texel buffer and binds its buffer view as a uniform or storage texel buffer
+func (core *CoreDescriptor) AddTexelBuffer(handle vk.Device, binding int, data_type int, set_id int, buffer CoreBuffer) {
+
+	core.p_buffers = append(core.p_buffers, CoreDescriptorBuffer{
+		binding: binding,
+		dtype:   data_type,
+		buffer:  &buffer,
+	})
+
+	write := make([]vk.WriteDescriptorSet, 1)
+	write[0].SType = vk.StructureTypeWriteDescriptorSet
+	write[0].DstBinding = uint32(binding)
+	write[0].DstSet = core.set[set_id]
+	write[0].DescriptorCount = 1
+	write[0].DescriptorType = vk.DescriptorType(data_type)
+	write[0].PTexelBufferView = []vk.BufferView{buffer.view}
+	vk.UpdateDescriptorSets(handle, 1, write, 0, nil)
+
+}
@@ -3,6 +3,7 @@ package dieselvk
 import (
 	"fmt"
 	"os"
+	"unsafe"
 
 	vk "github.com/vulkan-go/vulkan"
 )
@@ -17,8 +18,8 @@ type CoreDeviceInstance struct {
 	validation_layers   BaseLayerExtensions
 	name                string
 
-	//Core Allocatore
-	allocator *CoreAllocator
+	//Core Allocatore, the CoreAllocator unless config["allocator"] selects another strategy
+	allocator BufferAllocator
 
 	//Single Logical Device for the instance
 	logical_device      *CoreDevice
@@ -30,10 +31,15 @@ type CoreDeviceInstance struct {
 	//Swapchain Synchronization
 	recycled_semaphores []vk.Semaphore
 	cmds                []vk.CommandBuffer
+	fence               []vk.Fence //Signaled once the last Submit completes
 
 	//Buffers
 	uniform_buffers map[string]*CoreBuffer
 	vertex_buffers  map[string]*CoreBuffer
+	vertex_streams  map[string]*VertexStreams //Key: Name of the vertex buffer, which is the buffer of binding 0
+	index_buffers   map[string]*CoreBuffer    //Key: Name of the vertex buffer the indices draw
+	storage_buffers map[string]*CoreBuffer
+	texel_buffers   map[string]*CoreBuffer
 
 	//Maps program id's to renderpasses & pipelines
 	programs map[string]string
@@ -46,7 +52,7 @@ type CoreDeviceInstance struct {
 }
 
 //Creates a new core instance from the given structure and attaches the instance to a primary graphics compatbible device
-func NewCoreDeviceInstance(instance vk.Instance, name string, instance_exenstions BaseInstanceExtensions, validation_extensions BaseLayerExtensions, device_extensions []string) (*CoreDeviceInstance, error) {
+func NewCoreDeviceInstance(instance vk.Instance, name string, instance_exenstions BaseInstanceExtensions, validation_extensions BaseLayerExtensions, device_extensions []string, allocator string) (*CoreDeviceInstance, error) {
 	var core CoreDeviceInstance
 	var err error
 
@@ -62,6 +68,10 @@ func NewCoreDeviceInstance(instance vk.Instance, name string, instance_exenstion
 	core.recycled_semaphores = make([]vk.Semaphore, 0)
 	core.uniform_buffers = make(map[string]*CoreBuffer, MAX_UNIFORM_BUFFERS)
 	core.vertex_buffers = make(map[string]*CoreBuffer, MAX_UNIFORM_BUFFERS)
+	core.vertex_streams = make(map[string]*VertexStreams)
+	core.index_buffers = make(map[string]*CoreBuffer, MAX_UNIFORM_BUFFERS)
+	core.storage_buffers = make(map[string]*CoreBuffer, MAX_UNIFORM_BUFFERS)
+	core.texel_buffers = make(map[string]*CoreBuffer, MAX_UNIFORM_BUFFERS)
 	core.global_descriptor_layouts = make(map[string][]vk.DescriptorSetLayout)
 	core.cmds = make([]vk.CommandBuffer, 0)
 	core.shaders = NewCoreShader()
@@ -113,6 +123,19 @@ func NewCoreDeviceInstance(instance vk.Instance, name string, instance_exenstion
 	vk.GetPhysicalDeviceMemoryProperties(core.logical_device.selected_device, core.logical_device.selected_device_memory_properties)
 	core.logical_device.selected_device_memory_properties.Deref()
 
+	//Heap budgets are reported to the allocator when the device supports VK_EXT_memory_budget
+	if has_device_extension(core.logical_device.selected_device, MEMORY_BUDGET_EXTENSION) {
+		core.device_extensions.wanted = append(core.device_extensions.wanted, MEMORY_BUDGET_EXTENSION)
+	}
+
+	//Buffer device addresses are enabled whenever the device supports them, see CoreBuffer.DeviceAddress
+	var p_features unsafe.Pointer
+	if supports_device_address(core.logical_device.selected_device) {
+		core.device_extensions.wanted = append(core.device_extensions.wanted, BUFFER_DEVICE_ADDRESS_EXTENSION)
+		p_features = device_address_features()
+		defer free_device_address_features(p_features)
+	}
+
 	// Select device extensions
 	core.device_extensions = *NewBaseDeviceExtensions(core.device_extensions.wanted, []string{}, core.logical_device.selected_device)
 	has_extensions, ext_string := core.device_extensions.HasWanted()
@@ -132,6 +155,7 @@ func NewCoreDeviceInstance(instance vk.Instance, name string, instance_exenstion
 	var device vk.Device
 	ret = vk.CreateDevice(core.logical_device.selected_device, &vk.DeviceCreateInfo{
 		SType:                   vk.StructureTypeDeviceCreateInfo,
+		PNext:                   p_features,
 		QueueCreateInfoCount:    uint32(len(queue_infos)),
 		PQueueCreateInfos:       queue_infos,
 		EnabledExtensionCount:   uint32(len(dev_extensions)),
@@ -157,22 +181,41 @@ func NewCoreDeviceInstance(instance vk.Instance, name string, instance_exenstion
 	}
 
 	//Create Pipeline and Descriptor Pools - Create Descriptor Pool with Types and Handles Per Type
-	var layout []vk.DescriptorSetLayout
+	layout := make([]vk.DescriptorSetLayout, DESCRIPTOR_SET_HANDLES)
 	types := make([]int, MAX_UNIFORM_BUFFERS)
 	for i := 0; i < MAX_UNIFORM_BUFFERS; i++ {
 		types[i] = int(vk.DescriptorTypeUniformBuffer)
 	}
+	types = append(types, int(vk.DescriptorTypeStorageBuffer), int(vk.DescriptorTypeUniformTexelBuffer), int(vk.DescriptorTypeStorageTexelBuffer))
 
-	layout_types := []vk.DescriptorType{vk.DescriptorTypeUniformBuffer, vk.DescriptorTypeUniformBuffer, vk.DescriptorTypeUniformBuffer}
+	layout_types := []vk.DescriptorType{vk.DescriptorTypeUniformBuffer, vk.DescriptorTypeStorageBuffer, vk.DescriptorTypeUniformTexelBuffer, vk.DescriptorTypeStorageTexelBuffer}
 
 	core.global_descriptor_pool, err = NewDescriptorPool(core.logical_device.handle, DESCRIPTOR_SET_HANDLES, types) //Make pool allocation of 10 Uniform Buffer Types with 3 Descriptor Set Handles Per
-	layout, err = NewDescriptorLayouts(core.logical_device.handle, []uint32{0, 0, 0}, layout_types, vk.ShaderStageFlags(vk.PipelineStageVertexShaderBit|vk.PipelineStageFragmentShaderBit))
+	//Each set holds the uniform buffer at binding 0, the storage buffer and the texel buffers, read by compute shaders
+	bindings := []uint32{0, STORAGE_BUFFER_BINDING, UNIFORM_TEXEL_BINDING, STORAGE_TEXEL_BINDING}
+	compute := vk.ShaderStageFlags(vk.ShaderStageComputeBit)
+	stages := []vk.ShaderStageFlags{compute, compute, compute, compute}
+	for i := 0; i < DESCRIPTOR_SET_HANDLES; i++ {
+		layout[i], err = NewDescriptorSetLayout(core.logical_device.handle, bindings, layout_types, stages)
+	}
 	core.global_descriptor_layouts["default"] = layout
 	//Descriptor Sets set to a default Uniform buffer and Vertex Shader stage. Parameterize for engine flexibility
 	core.frame_descriptor_sets, err = NewCoreDescriptor(core.logical_device.handle, core.global_descriptor_layouts["default"])
 	core.global_descriptor_pool.AllocateSets(core.logical_device.handle, core.frame_descriptor_sets)
 
-	core.allocator, err = NewCoreAllocator(core.logical_device.selected_device, device, 1024, 1)
+	//Created signaled so reads before the first submission do not block
+	core.fence = make([]vk.Fence, 1)
+	vk.CreateFence(core.logical_device.handle, &vk.FenceCreateInfo{
+		SType: vk.StructureTypeFenceCreateInfo,
+		Flags: vk.FenceCreateFlags(vk.FenceCreateSignaledBit),
+	}, nil, &core.fence[0])
+
+	//Buffers are placed by the CoreAllocator unless config["allocator"] selects VMA
+	if allocator == ALLOCATOR_VMA {
+		core.allocator, err = NewCoreVMAAllocator(instance, core.logical_device.selected_device, device)
+	} else {
+		core.allocator, err = NewCoreAllocator(core.logical_device.selected_device, device, POOL_DEFAULT_SIZE, POOL_DEFAULT_PAGES)
+	}
 	return &core, err
 }
 
@@ -195,18 +238,53 @@ func (core CoreDeviceInstance) SetupCommands() {
 }
 
 func (core *CoreDeviceInstance) AddLayoutBuffer(data []float32, name string, usage vk.BufferUsageFlags) {
-	d := Ptr(data)
-	mdata := &d
+	bytes, _ := AsBytes(data)
+	core.add_layout_buffer(bytes, name, usage)
+}
+
+//AddLayoutStruct encodes a Go struct mirroring a GLSL block into a layout buffer, std430 for storage buffers and
+//std140 otherwise
+func (core *CoreDeviceInstance) AddLayoutStruct(value interface{}, name string, usage vk.BufferUsageFlags) error {
+	bytes, err := EncodeLayout(value, usage_layout(usage))
+	if err != nil {
+		return err
+	}
+	return core.add_layout_buffer(bytes, name, usage)
+}
+
+func (core *CoreDeviceInstance) add_layout_buffer(bytes []byte, name string, usage vk.BufferUsageFlags) error {
 	bf := vk.BufferUsageFlags(usage)
-	core.uniform_buffers[name] = NewLayoutBuffer(core.logical_device.handle, core.logical_device.selected_device, uint32(len(data)*4), int32(bf))
-	mem_size := core.uniform_buffers[name].reqs.Size
-	min_align := core.uniform_buffers[name].reqs.Alignment
+	core.uniform_buffers[name] = NewLayoutBuffer(core.logical_device.handle, core.logical_device.selected_device, uint32(len(bytes)), int32(bf))
+	//Layout buffers are written from the host so request host visible memory of an allowed type
+	mem_ref, err := core.allocator.AllocateBuffer(core.uniform_buffers[name].buffer[0], core.uniform_buffers[name].reqs, MEMORY_HOST_VISIBLE)
+	if err != nil {
+		return err
+	}
+	core.uniform_buffers[name].mem_ref = mem_ref
+	if err := core.allocator.Upload(core.uniform_buffers[name].buffer[0], mem_ref, bytes); err != nil {
+		return fmt.Errorf("Failed to bind buffer %s %s\n", name, err)
+	}
+	return nil
+}
 
-	if mem_ref, err := core.allocator.Allocate(int(mem_size), int(min_align)); err == nil {
-		if err := core.allocator.Map(mdata, core.uniform_buffers[name].buffer[0], core.logical_device.handle, mem_ref, FLOAT32); err != nil {
-			fmt.Errorf("Failed to bind buffer %s\n", name)
-		}
+//UpdateLayoutBuffer replaces the contents of a layout buffer, []float32 as given or a struct encoded like
+//AddLayoutStruct. The device instance has no frames in flight so the write waits for the last Submit to complete
+func (core *CoreDeviceInstance) UpdateLayoutBuffer(name string, data interface{}) error {
+	buffer, ok := core.uniform_buffers[name]
+	if !ok {
+		return fmt.Errorf("UpdateLayoutBuffer() no layout buffer named %s\n", name)
+	}
+	bytes, err := layout_data(data, vk.BufferUsageFlags(buffer.usage))
+	if err != nil {
+		return err
+	}
+	if uint64(len(bytes)) > uint64(buffer.size) {
+		return fmt.Errorf("UpdateLayoutBuffer() %d bytes overflows layout buffer %s of %d bytes\n", len(bytes), name, buffer.size)
+	}
+	if res := vk.WaitForFences(core.logical_device.handle, 1, core.fence, vk.True, vk.MaxUint64); res != vk.Success {
+		return NewError(res)
 	}
+	return core.allocator.Write(buffer.MemoryRef(), 0, bytes)
 }
 
 func (core *CoreDeviceInstance) GetLayoutBuffers() map[string]*CoreBuffer {
@@ -224,6 +302,105 @@ func (core *CoreDeviceInstance) BindUniforms(uniforms map[string]*CoreBuffer, bi
 	return nil
 }
 
+//AddStorageBuffer places data in a host visible storage buffer which shaders write and ReadBuffer reads back
+func (core *CoreDeviceInstance) AddStorageBuffer(data []byte, name string) error {
+	bf := vk.BufferUsageFlags(vk.BufferUsageStorageBufferBit | vk.BufferUsageTransferSrcBit | vk.BufferUsageTransferDstBit)
+	buffer := NewLayoutBuffer(core.logical_device.handle, core.logical_device.selected_device, uint32(len(data)), int32(bf))
+	mem_ref, err := core.allocator.AllocateBuffer(buffer.buffer[0], buffer.reqs, MEMORY_HOST_VISIBLE)
+	if err != nil {
+		buffer.Destroy(core.logical_device.handle)
+		return err
+	}
+	buffer.mem_ref = mem_ref
+	core.storage_buffers[name] = buffer
+	if err := core.allocator.Upload(buffer.buffer[0], mem_ref, data); err != nil {
+		return fmt.Errorf("Failed to bind buffer %s %s\n", name, err)
+	}
+	return nil
+}
+
+//BindStorage writes the named storage buffer to STORAGE_BUFFER_BINDING of every descriptor set
+func (core *CoreDeviceInstance) BindStorage(name string) error {
+	buffer, ok := core.storage_buffers[name]
+	if !ok {
+		return fmt.Errorf("BindStorage() no storage buffer named %s\n", name)
+	}
+	for index := 0; index < DESCRIPTOR_SET_HANDLES; index++ {
+		core.frame_descriptor_sets.AddBuffer(core.logical_device.handle, STORAGE_BUFFER_BINDING, int(vk.DescriptorTypeStorageBuffer), index, *buffer)
+	}
+	return nil
+}
+
+//AddTexelBuffer places formatted data such as lookup tables in a host visible uniform or storage texel buffer and
+//creates its view. The format must support the texel buffer usage on the device
+func (core *CoreDeviceInstance) AddTexelBuffer(data []byte, name string, format vk.Format, usage vk.BufferUsageFlags) error {
+	buffer, err := NewCoreTexelBuffer(core.logical_device.handle, core.logical_device.selected_device, uint32(len(data)), int32(usage), format)
+	if err != nil {
+		return err
+	}
+	mem_ref, err := core.allocator.AllocateBuffer(buffer.buffer[0], buffer.reqs, MEMORY_HOST_VISIBLE)
+	if err != nil {
+		buffer.Destroy(core.logical_device.handle)
+		return err
+	}
+	buffer.mem_ref = mem_ref
+	core.texel_buffers[name] = buffer
+	if err := core.allocator.Upload(buffer.buffer[0], mem_ref, data); err != nil {
+		return fmt.Errorf("Failed to bind buffer %s %s\n", name, err)
+	}
+	return buffer.NewBufferView(core.logical_device.handle)
+}
+
+//BindTexelBuffer writes the view of the named texel buffer to UNIFORM_TEXEL_BINDING and or STORAGE_TEXEL_BINDING of
+//every descriptor set following its usage
+func (core *CoreDeviceInstance) BindTexelBuffer(name string) error {
+	buffer, ok := core.texel_buffers[name]
+	if !ok {
+		return fmt.Errorf("BindTexelBuffer() no texel buffer named %s\n", name)
+	}
+	for _, binding := range texel_bindings(vk.BufferUsageFlags(buffer.usage)) {
+		for index := 0; index < DESCRIPTOR_SET_HANDLES; index++ {
+			core.frame_descriptor_sets.AddTexelBuffer(core.logical_device.handle, binding.location, int(binding.descriptor_type), index, *buffer)
+		}
+	}
+	return nil
+}
+
+//Submit submits recorded command buffers to the device queue, ReadBuffer waits for them to complete. Command buffers
+//writing storage buffers read back with ReadBuffer must end with CmdHostReadBarrier so the writes are visible to the host
+func (core *CoreDeviceInstance) Submit(cmds []vk.CommandBuffer) error {
+	if res := vk.WaitForFences(core.logical_device.handle, 1, core.fence, vk.True, vk.MaxUint64); res != vk.Success {
+		return NewError(res)
+	}
+	vk.ResetFences(core.logical_device.handle, 1, core.fence)
+	submit_info := vk.SubmitInfo{
+		SType:              vk.StructureTypeSubmitInfo,
+		CommandBufferCount: uint32(len(cmds)),
+		PCommandBuffers:    cmds,
+	}
+	if res := core.queues.Submit(int(core.device_queue_family), []vk.SubmitInfo{submit_info}, core.fence[0]); res != vk.Success {
+		return NewError(res)
+	}
+	return nil
+}
+
+//ReadBuffer waits on the fence of the last submission then returns the contents of the named storage buffer,
+//see ReadBufferSlice for typed reads
+func (core *CoreDeviceInstance) ReadBuffer(name string) ([]byte, error) {
+	buffer, ok := core.storage_buffers[name]
+	if !ok {
+		return nil, fmt.Errorf("ReadBuffer() no storage buffer named %s\n", name)
+	}
+	if res := vk.WaitForFences(core.logical_device.handle, 1, core.fence, vk.True, vk.MaxUint64); res != vk.Success {
+		return nil, NewError(res)
+	}
+	data := make([]byte, buffer.size)
+	if err := core.allocator.Read(buffer.mem_ref, 0, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
 func (core CoreDeviceInstance) AddShaderPath(path string, shader_type int) {
 	core.shaders.AddShaderPath(path, shader_type)
 }
@@ -237,16 +414,74 @@ func (core *CoreDeviceInstance) NewProgram(paths []string, name string) error {
 /*Adds vertex buffer with allocated memory to the vulkan instance*/
 func (core *CoreDeviceInstance) AddVertexBuffer(data []float32, name string) {
 	prototype := Vertex{}
-	d := Ptr(data)
-	mdata := &d
 	bf := vk.BufferUsageFlags(vk.BufferUsageVertexBufferBit)
 	core.vertex_buffers[name] = NewCoreVertexBuffer(core.logical_device.handle, core.logical_device.selected_device, uint32(len(data)*4), int32(bf), prototype)
-	mem_size := core.vertex_buffers[name].reqs.Size
-	min_align := core.vertex_buffers[name].reqs.Alignment
+	delete(core.vertex_streams, name)
+	//Vertex data is written from the host so request host visible memory of an allowed type
+	if mem_ref, err := core.allocator.AllocateBuffer(core.vertex_buffers[name].buffer[0], core.vertex_buffers[name].reqs, MEMORY_HOST_VISIBLE); err == nil {
+		UploadSlice(core.allocator, core.vertex_buffers[name].buffer[0], mem_ref, data)
+	}
+}
+
+//AddVertexStructs places a slice of vertex structs in host visible memory. The attributes are reflected from the vk
+//tags of the struct, see VertexLayout
+func (core *CoreDeviceInstance) AddVertexStructs(vertices interface{}, name string) error {
+	return core.AddVertexStreams(name, VertexStream{Vertices: vertices})
+}
+
+//AddVertexStreams places one vertex buffer per stream in host visible memory, stream i is bound to binding i of the
+//reflected VertexLayout
+func (core *CoreDeviceInstance) AddVertexStreams(name string, streams ...VertexStream) error {
+	layout, data, vertices, instances, err := stream_data(streams)
+	if err != nil {
+		return err
+	}
+	bf := vk.BufferUsageFlags(vk.BufferUsageVertexBufferBit)
+	draw := &VertexStreams{buffers: make([]*CoreBuffer, 0, len(data)), vertices: vertices, instances: instances}
+	for _, bytes := range data {
+		buffer := NewCoreVertexBuffer(core.logical_device.handle, core.logical_device.selected_device, uint32(len(bytes)), int32(bf), layout)
+		mem_ref, err := core.allocator.AllocateBuffer(buffer.buffer[0], buffer.reqs, MEMORY_HOST_VISIBLE)
+		if err == nil {
+			buffer.mem_ref = mem_ref
+			if err = core.allocator.Upload(buffer.buffer[0], mem_ref, bytes); err != nil {
+				core.allocator.Free(mem_ref)
+			}
+		}
+		if err != nil {
+			buffer.Destroy(core.logical_device.handle)
+			draw.release(core.logical_device.handle, core.allocator)
+			return err
+		}
+		draw.buffers = append(draw.buffers, buffer)
+	}
+	draw.buffers[0].elements = vertices
+	draw.buffers[0].groups = vertices
+	core.vertex_buffers[name] = draw.buffers[0]
+	core.vertex_streams[name] = draw
+	return nil
+}
 
-	if mem_ref, err := core.allocator.Allocate(int(mem_size), int(min_align)); err == nil {
-		core.allocator.Map(mdata, core.vertex_buffers[name].buffer[0], core.logical_device.handle, mem_ref, int(core.vertex_buffers[name].reqs.MemoryTypeBits))
+//AddIndexBuffer places []uint16 or []uint32 indices in host visible memory
+func (core *CoreDeviceInstance) AddIndexBuffer(indices interface{}, name string) error {
+	bytes, index_type, count, err := index_data(indices)
+	if err != nil {
+		return err
+	}
+	bf := vk.BufferUsageFlags(vk.BufferUsageIndexBufferBit)
+	buffer := NewCoreIndexBuffer(core.logical_device.handle, core.logical_device.selected_device, count, int32(bf), index_type)
+	mem_ref, err := core.allocator.AllocateBuffer(buffer.buffer[0], buffer.reqs, MEMORY_HOST_VISIBLE)
+	if err == nil {
+		buffer.mem_ref = mem_ref
+		if err = core.allocator.Upload(buffer.buffer[0], mem_ref, bytes); err != nil {
+			core.allocator.Free(mem_ref)
+		}
 	}
+	if err != nil {
+		buffer.Destroy(core.logical_device.handle)
+		return err
+	}
+	core.index_buffers[name] = buffer
+	return nil
 }
 
 func (core *CoreDeviceInstance) AddPipeline(name string, program_name string, buffer CoreBuffer, pass string) *CorePipeline {
@@ -300,6 +535,17 @@ func (core *CoreDeviceInstance) Destroy() {
 		vertex_buffer.Destroy(core.logical_device.handle)
 	}
 
+	//Binding 0 of each set of vertex streams is destroyed with the vertex buffers
+	for _, draw := range core.vertex_streams {
+		for _, buffer := range draw.buffers[1:] {
+			buffer.Destroy(core.logical_device.handle)
+		}
+	}
+
+	for _, index_buffer := range core.index_buffers {
+		index_buffer.Destroy(core.logical_device.handle)
+	}
+
 	core.global_descriptor_pool.Destroy(core.logical_device.handle)
 
 	for _, layouts := range core.global_descriptor_layouts {
@@ -312,7 +558,17 @@ func (core *CoreDeviceInstance) Destroy() {
 		buffer.Destroy(core.logical_device.handle)
 	}
 
-	core.allocator.Destroy(core.logical_device.handle)
+	for _, buffer := range core.storage_buffers {
+		buffer.Destroy(core.logical_device.handle)
+	}
+
+	for _, buffer := range core.texel_buffers {
+		buffer.Destroy(core.logical_device.handle)
+	}
+
+	vk.DestroyFence(core.logical_device.handle, core.fence[0], nil)
+
+	core.allocator.Destroy()
 
 	vk.DestroyDevice(core.logical_device.handle, nil)
 }
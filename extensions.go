@@ -7,6 +7,11 @@ import (
 	vk "github.com/vulkan-go/vulkan"
 )
 
+const (
+	MEMORY_BUDGET_EXTENSION         = "VK_EXT_memory_budget"
+	BUFFER_DEVICE_ADDRESS_EXTENSION = "VK_KHR_buffer_device_address"
+)
+
 type Etxensions interface {
 	HasRequired() (bool, []string)
 	HasWanted() (bool, []string)
@@ -181,3 +186,33 @@ func LoadShaderModule(device vk.Device, data []byte) (vk.ShaderModule, error) {
 	}
 	return module, nil
 }
+
+//Reports whether the physical device supports VK_KHR_buffer_device_address with the bufferDeviceAddress feature
+func supports_device_address(gpu vk.PhysicalDevice) bool {
+	return has_device_extension(gpu, BUFFER_DEVICE_ADDRESS_EXTENSION) && query_device_address(gpu)
+}
+
+//Enables storage buffer writes from the vertex and fragment shader stages where the physical device supports them
+func storage_features(gpu vk.PhysicalDevice) vk.PhysicalDeviceFeatures {
+	var supported vk.PhysicalDeviceFeatures
+	vk.GetPhysicalDeviceFeatures(gpu, &supported)
+	supported.Deref()
+	return vk.PhysicalDeviceFeatures{
+		VertexPipelineStoresAndAtomics: supported.VertexPipelineStoresAndAtomics,
+		FragmentStoresAndAtomics:       supported.FragmentStoresAndAtomics,
+	}
+}
+
+//Reports whether the physical device supports the named device extension
+func has_device_extension(gpu vk.PhysicalDevice, name string) bool {
+	names, err := DeviceExtensions(gpu)
+	if err != nil {
+		return false
+	}
+	for _, ext := range names {
+		if ext == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package dieselvk
+
+import (
+	"fmt"
+	"unsafe"
+
+	vk "github.com/vulkan-go/vulkan"
+)
+
+/*
+CoreFrameAllocator is a linear allocator for per-frame transient data such as dynamic uniforms. The backing
+memory is split into one region per swapchain image and kept persistently mapped. Allocations bump the region
+head and are never freed individually, instead the whole region is rewound once the fence guarding that
+frame has signaled so the GPU is no longer reading it.
+*/
+const (
+	FRAME_ALLOCATOR_SIZE = 65536 //Default bytes per frame region
+)
+
+type FrameRegion struct {
+	offset uint64
+	size   uint64
+	head   uint64
+	fence  vk.Fence
+}
+
+//FrameRef references a sub-range of a frame region. Offset is relative to the start of the frame buffer and
+//can be passed as a dynamic descriptor offset or vertex buffer offset
+type FrameRef struct {
+	frame  int
+	offset uint64
+	size   uint64
+}
+
+func (ref FrameRef) Offset() uint64 {
+	return ref.offset
+}
+
+func (ref FrameRef) Size() uint64 {
+	return ref.size
+}
+
+type CoreFrameAllocator struct {
+	page      MemPage
+	backend   MemoryBackend
+	handle    vk.Device
+	buffer    *CoreBuffer
+	mapped    unsafe.Pointer
+	regions   []FrameRegion
+	alignment uint64
+	coherent  bool   //Host writes need no flush
+	atom      uint64 //nonCoherentAtomSize flushes are widened to
+}
+
+//NewCoreFrameAllocator creates a persistently mapped buffer with the given usage holding frames regions of region_size bytes
+func NewCoreFrameAllocator(physical vk.PhysicalDevice, handle vk.Device, frames int, region_size uint64, usage vk.BufferUsageFlags) (*CoreFrameAllocator, error) {
+	backend := NewCoreMemory(physical, handle)
+	limits := backend.Limits()
+	alignment := max_u64(uint64(limits.MinUniformBufferOffsetAlignment), uint64(limits.MinStorageBufferOffsetAlignment))
+	region_size = uint64(align_up(int(region_size), int(alignment)))
+
+	buffer := NewLayoutBuffer(handle, physical, uint32(region_size*uint64(frames)), int32(usage))
+	core, err := new_frame_allocator(backend, frames, region_size, alignment, uint64(buffer.reqs.Size), buffer.reqs.MemoryTypeBits)
+	if err != nil {
+		buffer.Destroy(handle)
+		return core, err
+	}
+	core.handle = handle
+	core.buffer = buffer
+
+	if err := backend.BindBufferMemory(buffer.buffer[0], core.page.device_mem, 0); err != nil {
+		core.Destroy()
+		return core, err
+	}
+	return core, nil
+}
+
+//NewCoreFrameAllocatorWithBackend creates the frame regions without a vk.Buffer, used to drive the allocator from
+//a FakeMemory backend. The memory type is selected from type_bits as if they were the buffer requirements
+func NewCoreFrameAllocatorWithBackend(backend MemoryBackend, frames int, region_size uint64, alignment uint64, type_bits uint32) (*CoreFrameAllocator, error) {
+	region_size = uint64(align_up(int(region_size), int(alignment)))
+	return new_frame_allocator(backend, frames, region_size, alignment, region_size*uint64(frames), type_bits)
+}
+
+func new_frame_allocator(backend MemoryBackend, frames int, region_size uint64, alignment uint64, mem_size uint64, type_bits uint32) (*CoreFrameAllocator, error) {
+	core := CoreFrameAllocator{backend: backend, alignment: alignment}
+	if frames <= 0 || region_size == 0 {
+		return &core, fmt.Errorf("Frame allocator requires at least one non empty frame region\n")
+	}
+
+	//The memory type must be one the frame buffer can be bound to, non-coherent types are flushed on Write
+	mem_props := backend.MemoryProperties()
+	mem_index, err := host_memory_type(mem_props, type_bits)
+	if err != nil {
+		return &core, err
+	}
+	core.coherent = mem_props.MemoryTypes[mem_index].PropertyFlags&vk.MemoryPropertyFlags(vk.MemoryPropertyHostCoherentBit) != 0
+	core.atom = uint64(backend.Limits().NonCoherentAtomSize)
+	device_mem, err := backend.AllocateMemory(mem_size, mem_index)
+	if err != nil {
+		return &core, err
+	}
+	core.page = MemPage{device_mem: device_mem, size: mem_size}
+
+	//Persistently map the whole page
+	if core.mapped, err = backend.MapMemory(device_mem, 0, mem_size); err != nil {
+		backend.FreeMemory(device_mem)
+		return &core, err
+	}
+
+	core.regions = make([]FrameRegion, frames)
+	for i := range core.regions {
+		core.regions[i] = FrameRegion{offset: uint64(i) * region_size, size: region_size}
+	}
+	return &core, nil
+}
+
+//Track associates the fence guarding a frame's submission with the frame region
+func (core *CoreFrameAllocator) Track(frame int, fence vk.Fence) {
+	core.regions[frame].fence = fence
+}
+
+//Begin rewinds the frame region if the GPU has finished with it. Untracked regions are always rewound. Returns
+//whether the region was reset
+func (core *CoreFrameAllocator) Begin(frame int) bool {
+	region := &core.regions[frame]
+	if region.fence != vk.Fence(vk.NullHandle) && core.handle != nil {
+		if vk.GetFenceStatus(core.handle, region.fence) != vk.Success {
+			return false
+		}
+	}
+	region.head = 0
+	return true
+}
+
+//Allocate bumps the frame region head by an aligned sub-range of size bytes
+func (core *CoreFrameAllocator) Allocate(frame int, size int) (FrameRef, error) {
+	if frame < 0 || frame >= len(core.regions) {
+		return FrameRef{}, fmt.Errorf("Frame allocator has no region for frame %d\n", frame)
+	}
+	region := &core.regions[frame]
+	head := uint64(align_up(int(region.head), int(core.alignment)))
+	if head+uint64(size) > region.size {
+		return FrameRef{}, NewError(vk.ErrorOutOfPoolMemory)
+	}
+	region.head = head + uint64(size)
+	return FrameRef{frame: frame, offset: region.offset + head, size: uint64(size)}, nil
+}
+
+//Bytes returns the persistently mapped host memory of the referenced sub-range, call Flush after writing it
+func (core *CoreFrameAllocator) Bytes(ref FrameRef) []byte {
+	return unsafe.Slice((*byte)(unsafe.Add(core.mapped, ref.offset)), ref.size)
+}
+
+//Flush makes host writes to the referenced sub-range visible to the device when the frame memory is non-coherent
+func (core *CoreFrameAllocator) Flush(ref FrameRef) error {
+	if core.coherent || ref.size == 0 {
+		return nil
+	}
+	start, size := atom_span(core.atom, core.page.size, ref.offset, ref.size)
+	return core.backend.FlushMemory(core.page.device_mem, start, size)
+}
+
+//Write allocates a sub-range of the frame region and copies data into it
+func (core *CoreFrameAllocator) Write(frame int, data []byte) (FrameRef, error) {
+	ref, err := core.Allocate(frame, len(data))
+	if err != nil {
+		return ref, err
+	}
+	copy(core.Bytes(ref), data)
+	return ref, core.Flush(ref)
+}
+
+//Used returns the bytes handed out from the frame region since its last reset
+func (core *CoreFrameAllocator) Used(frame int) uint64 {
+	return core.regions[frame].head
+}
+
+//GetBuffer returns the vk.Buffer spanning every frame region, nil for backend only allocators
+func (core *CoreFrameAllocator) GetBuffer() *CoreBuffer {
+	return core.buffer
+}
+
+func (core *CoreFrameAllocator) Destroy() {
+	if core.mapped != nil {
+		core.backend.UnmapMemory(core.page.device_mem)
+		core.mapped = nil
+	}
+	if core.buffer != nil {
+		core.buffer.Destroy(core.handle)
+		core.buffer = nil
+	}
+	core.backend.FreeMemory(core.page.device_mem)
+}
+
+func max_u64(a uint64, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min_u64(a uint64, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
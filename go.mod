@@ -3,8 +3,8 @@ module github.com/andewx/dieselvk
 go 1.18
 
 require (
-	github.com/emirpasic/gods v1.18.1 // indirect
-	github.com/go-gl/glfw/v3.3/glfw v0.0.0-20221017161538-93cebf72946b // indirect
-	github.com/vulkan-go/vma v0.0.0-20210826152021-dfd82bd90352 // indirect
-	github.com/vulkan-go/vulkan v0.0.0-20221012123230-8e2684a41107 // indirect
+	github.com/emirpasic/gods v1.18.1
+	github.com/go-gl/glfw/v3.3/glfw v0.0.0-20221017161538-93cebf72946b
+	github.com/vulkan-go/vma v0.0.0-20210826152021-dfd82bd90352
+	github.com/vulkan-go/vulkan v0.0.0-20221012123230-8e2684a41107
 )
@@ -0,0 +1,108 @@
+package dieselvk
+
+import (
+	"fmt"
+
+	vk "github.com/vulkan-go/vulkan"
+)
+
+/*
+CoreImageAllocator sub-allocates vk.Image memory from the pools of a CoreAllocator. Images share pages with
+buffers so optimal tiled images are placed as RESOURCE_OPTIMAL blocks which the pools keep BufferImageGranularity
+apart from linear resources. The allocator owns the memory of every image it binds and Destroy releases it.
+*/
+type ImageAlloc struct {
+	ref   MemRef
+	owned bool //Image was created through CreateImage and is destroyed with its memory
+}
+
+type CoreImageAllocator struct {
+	allocator *CoreAllocator
+	handle    vk.Device
+	images    map[vk.Image]ImageAlloc
+}
+
+func NewCoreImageAllocator(handle vk.Device, allocator *CoreAllocator) *CoreImageAllocator {
+	core := CoreImageAllocator{allocator: allocator, handle: handle}
+	core.images = make(map[vk.Image]ImageAlloc)
+	return &core
+}
+
+//CreateImage creates the image and binds memory of the requested properties to it. The image is destroyed by Free
+func (core *CoreImageAllocator) CreateImage(info *vk.ImageCreateInfo, properties vk.MemoryPropertyFlags) (vk.Image, error) {
+	var image vk.Image
+	if res := vk.CreateImage(core.handle, info, nil, &image); res != vk.Success {
+		return image, NewError(res)
+	}
+
+	if _, err := core.Allocate(image, info.Tiling, properties); err != nil {
+		vk.DestroyImage(core.handle, image, nil)
+		return vk.Image(vk.NullHandle), err
+	}
+
+	alloc := core.images[image]
+	alloc.owned = true
+	core.images[image] = alloc
+	return image, nil
+}
+
+//Allocate queries the image memory requirements and binds memory of the requested properties
+func (core *CoreImageAllocator) Allocate(image vk.Image, tiling vk.ImageTiling, properties vk.MemoryPropertyFlags) (MemRef, error) {
+	var reqs vk.MemoryRequirements
+	vk.GetImageMemoryRequirements(core.handle, image, &reqs)
+	reqs.Deref()
+	return core.AllocateImage(image, reqs, tiling, properties)
+}
+
+//AllocateImage binds memory satisfying reqs to the image. Images are often larger than a pool page in which case
+//the pool grows by a page holding the image, render targets the driver asks dedicated memory for get their own
+func (core *CoreImageAllocator) AllocateImage(image vk.Image, reqs vk.MemoryRequirements, tiling vk.ImageTiling, properties vk.MemoryPropertyFlags) (MemRef, error) {
+	if _, ok := core.images[image]; ok {
+		return MemRef{}, fmt.Errorf("AllocateImage() image already has bound memory\n")
+	}
+
+	kind := uint8(RESOURCE_LINEAR)
+	if tiling == vk.ImageTilingOptimal {
+		kind = RESOURCE_OPTIMAL
+	}
+
+	ref, err := core.allocator.allocate_image(image, reqs, properties, kind)
+	if err != nil {
+		return MemRef{}, err
+	}
+
+	if err := core.allocator.bind_image(image, ref); err != nil {
+		core.allocator.Free(ref)
+		return MemRef{}, err
+	}
+
+	core.images[image] = ImageAlloc{ref: ref}
+	return ref, nil
+}
+
+//GetMemoryRef returns the allocator reference of the image memory
+func (core *CoreImageAllocator) GetMemoryRef(image vk.Image) (MemRef, bool) {
+	alloc, ok := core.images[image]
+	return alloc.ref, ok
+}
+
+//Free releases the image memory and destroys images created through CreateImage
+func (core *CoreImageAllocator) Free(image vk.Image) error {
+	alloc, ok := core.images[image]
+	if !ok {
+		return fmt.Errorf("Free() image has no memory bound by the image allocator\n")
+	}
+	delete(core.images, image)
+
+	if alloc.owned && core.handle != nil {
+		vk.DestroyImage(core.handle, image, nil)
+	}
+	return core.allocator.Free(alloc.ref)
+}
+
+//Destroy releases the memory of every image still bound by the allocator
+func (core *CoreImageAllocator) Destroy() {
+	for image := range core.images {
+		core.Free(image)
+	}
+}
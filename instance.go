@@ -12,7 +12,11 @@ const (
 	SWAPCHAIN_COUNT            = 3
 	MAX_UNIFORM_BUFFERS        = 10
 	MAX_DESCRIPTOR_SET_BUFFERS = 10
-	DESCRIPTOR_SET_HANDLES     = 3
+	DESCRIPTOR_SET_HANDLES     = 3 //Frame sets, one per frame in flight, swapchains holding more images reuse them
+	DYNAMIC_UNIFORM_BINDING    = 1 //Binding of the per object dynamic uniform buffer in the default set layouts
+	STORAGE_BUFFER_BINDING     = 2 //Binding of the storage buffer in the default set layouts
+	UNIFORM_TEXEL_BINDING      = 3 //Binding of the uniform texel buffer in the default set layouts
+	STORAGE_TEXEL_BINDING      = 4 //Binding of the storage texel buffer in the default set layouts
 )
 
 type SPIRV_Constants struct {
@@ -78,6 +82,9 @@ type CoreInstance interface {
 	AddShaderPath(path string, shader_type int)
 	AddRenderPass(name string) *CoreRenderPass
 	AddVertexBuffer(data []float32, name string)
+	AddVertexStructs(vertices interface{}, name string) error
+	AddVertexStreams(name string, streams ...VertexStream) error
+	AddIndexBuffer(indices interface{}, name string) error
 	CreateQueues() error
 	Destroy()
 	GetHandle() vk.Device
@@ -89,8 +96,15 @@ type CoreInstance interface {
 	SetupCommands()
 	AllocatorUsage()
 	AddLayoutBuffer(data []float32, name string, usage vk.BufferUsageFlags)
+	AddLayoutStruct(value interface{}, name string, usage vk.BufferUsageFlags) error
+	UpdateLayoutBuffer(name string, data interface{}) error
 	GetLayoutBuffers() map[string]*CoreBuffer
 	BindUniforms(uniforms map[string]*CoreBuffer, binding []int) error
+	AddStorageBuffer(data []byte, name string) error
+	BindStorage(name string) error
+	ReadBuffer(name string) ([]byte, error)
+	AddTexelBuffer(data []byte, name string, format vk.Format, usage vk.BufferUsageFlags) error
+	BindTexelBuffer(name string) error
 }
 
 type CoreRenderInstance struct {
@@ -102,6 +116,7 @@ type CoreRenderInstance struct {
 	validation_layers   BaseLayerExtensions
 	name                string
 	allocator           *CoreAllocator
+	buffer_allocator    BufferAllocator //Host visible buffers, the CoreAllocator unless config["allocator"] selects another
 
 	//Single Logical Device for the instance
 	logical_device      *CoreDevice
@@ -112,16 +127,31 @@ type CoreRenderInstance struct {
 	render_queue_family uint32
 
 	//Swap chain handles
-	swapchain     *CoreSwapchain
-	per_frame     []PerFrame
-	current_frame int
+	swapchain       *CoreSwapchain
+	per_frame       []PerFrame
+	current_frame   int
+	frame_allocator *CoreFrameAllocator
+	stage_allocator *CoreStageAllocator
+	image_allocator *CoreImageAllocator
 
 	//Swapchain Synchronization
 	recycled_semaphores []vk.Semaphore
 
 	//Buffers
 	uniform_buffers map[string]*CoreBuffer
+	uniform_copies  map[string][]*CoreBuffer //Key: Name of the layout buffer, one copy per frame set and frame in flight
+	layout_updates  map[string]*LayoutUpdate
+	layout_errors   map[string]error //Key: Name of the layout buffer, first failed frame copy write since its last update
 	vertex_buffers  map[string]*CoreBuffer
+	vertex_streams  map[string]*VertexStreams //Key: Name of the vertex buffer, which is the buffer of binding 0
+	index_buffers   map[string]*CoreBuffer    //Key: Name of the vertex buffer the indices draw
+	storage_buffers map[string]*CoreBuffer
+	texel_buffers   map[string]*CoreBuffer
+
+	//Per object uniforms, one element of the bound dynamic buffer is selected for each draw
+	dynamic_buffers  map[string]*CoreBuffer
+	dynamic_uniform  string
+	dynamic_elements []uint32
 
 	//Pipelines and renderpasses
 	pipeline     *CorePipeline
@@ -141,8 +171,44 @@ type CoreRenderInstance struct {
 	pconstant []SPIRV_Constants
 }
 
+//Vertex buffers bound one per binding of a VertexLayout with the vertex and instance counts drawn from them
+type VertexStreams struct {
+	buffers   []*CoreBuffer
+	vertices  uint32
+	instances uint32
+}
+
+//Returns the vk.Buffer of every binding in binding order
+func (draw *VertexStreams) handles() []vk.Buffer {
+	handles := make([]vk.Buffer, len(draw.buffers))
+	for i, buffer := range draw.buffers {
+		handles[i] = buffer.buffer[0]
+	}
+	return handles
+}
+
+func (draw *VertexStreams) destroy(handle vk.Device) {
+	for _, buffer := range draw.buffers {
+		buffer.Destroy(handle)
+	}
+}
+
+//Frees the memory of every buffer before destroying them, used when a later stream of the set fails to upload
+func (draw *VertexStreams) release(handle vk.Device, allocator Allocator) {
+	for _, buffer := range draw.buffers {
+		allocator.Free(buffer.mem_ref)
+	}
+	draw.destroy(handle)
+}
+
+//Pending contents of a layout buffer and the frame copies which have not been rewritten yet
+type LayoutUpdate struct {
+	data  []byte
+	stale []bool
+}
+
 //Creates a new core instance from the given structure and attaches the instance to a primary graphics compatbible device
-func NewCoreRenderInstance(instance vk.Instance, name string, instance_exenstions BaseInstanceExtensions, validation_extensions BaseLayerExtensions, device_extensions []string, display *CoreDisplay) (*CoreRenderInstance, error) {
+func NewCoreRenderInstance(instance vk.Instance, name string, instance_exenstions BaseInstanceExtensions, validation_extensions BaseLayerExtensions, device_extensions []string, display *CoreDisplay, allocator string) (*CoreRenderInstance, error) {
 	var core CoreRenderInstance
 	var err error
 	update_step = 0.01
@@ -160,7 +226,15 @@ func NewCoreRenderInstance(instance vk.Instance, name string, instance_exenstion
 	core.programs = make(map[string]string, 4)
 	core.recycled_semaphores = make([]vk.Semaphore, 0)
 	core.uniform_buffers = make(map[string]*CoreBuffer, MAX_UNIFORM_BUFFERS)
+	core.uniform_copies = make(map[string][]*CoreBuffer, MAX_UNIFORM_BUFFERS)
+	core.layout_updates = make(map[string]*LayoutUpdate)
+	core.layout_errors = make(map[string]error)
 	core.vertex_buffers = make(map[string]*CoreBuffer, MAX_UNIFORM_BUFFERS)
+	core.vertex_streams = make(map[string]*VertexStreams)
+	core.index_buffers = make(map[string]*CoreBuffer, MAX_UNIFORM_BUFFERS)
+	core.dynamic_buffers = make(map[string]*CoreBuffer, MAX_UNIFORM_BUFFERS)
+	core.storage_buffers = make(map[string]*CoreBuffer, MAX_UNIFORM_BUFFERS)
+	core.texel_buffers = make(map[string]*CoreBuffer, MAX_UNIFORM_BUFFERS)
 	core.Builders = make(map[string]*PipelineBuilder, 1)
 	core.global_descriptor_layouts = make(map[string][]vk.DescriptorSetLayout)
 
@@ -223,6 +297,19 @@ func NewCoreRenderInstance(instance vk.Instance, name string, instance_exenstion
 	vk.GetPhysicalDeviceMemoryProperties(core.logical_device.selected_device, core.logical_device.selected_device_memory_properties)
 	core.logical_device.selected_device_memory_properties.Deref()
 
+	//Heap budgets are reported to the allocator when the device supports VK_EXT_memory_budget
+	if has_device_extension(core.logical_device.selected_device, MEMORY_BUDGET_EXTENSION) {
+		core.device_extensions.wanted = append(core.device_extensions.wanted, MEMORY_BUDGET_EXTENSION)
+	}
+
+	//Buffer device addresses are enabled whenever the device supports them, see CoreBuffer.DeviceAddress
+	var p_features unsafe.Pointer
+	if supports_device_address(core.logical_device.selected_device) {
+		core.device_extensions.wanted = append(core.device_extensions.wanted, BUFFER_DEVICE_ADDRESS_EXTENSION)
+		p_features = device_address_features()
+		defer free_device_address_features(p_features)
+	}
+
 	// Select device extensions
 	core.device_extensions = *NewBaseDeviceExtensions(core.device_extensions.wanted, []string{}, core.logical_device.selected_device)
 	has_extensions, ext_string := core.device_extensions.HasWanted()
@@ -238,10 +325,15 @@ func NewCoreRenderInstance(instance vk.Instance, name string, instance_exenstion
 	queue_infos := core.queues.GetCreateInfos()
 	dev_extensions := core.device_extensions.GetExtensions()
 
+	//Vertex and fragment shaders may only write storage buffers with the store features enabled
+	features := storage_features(core.logical_device.selected_device)
+
 	//Create Device
 	var device vk.Device
 	ret = vk.CreateDevice(core.logical_device.selected_device, &vk.DeviceCreateInfo{
 		SType:                   vk.StructureTypeDeviceCreateInfo,
+		PNext:                   p_features,
+		PEnabledFeatures:        []vk.PhysicalDeviceFeatures{features},
 		QueueCreateInfoCount:    uint32(len(queue_infos)),
 		PQueueCreateInfos:       queue_infos,
 		EnabledExtensionCount:   uint32(len(dev_extensions)),
@@ -266,16 +358,47 @@ func NewCoreRenderInstance(instance vk.Instance, name string, instance_exenstion
 		return &core, err
 	}
 
-	//New Core Allocator - Allocate 1KB Allocator Heap
-	core.allocator, err = NewCoreAllocator(core.logical_device.selected_device, core.logical_device.handle, 1024, 1)
+	//New Core Allocator - Pools start with one page and grow on demand up to the pool ceiling
+	core.allocator, err = NewCoreAllocator(core.logical_device.selected_device, core.logical_device.handle, POOL_DEFAULT_SIZE, POOL_DEFAULT_PAGES)
+	if err != nil {
+		return &core, err
+	}
+
+	//Layout buffers may be placed by another strategy for comparison, staging and images stay on the CoreAllocator
+	core.buffer_allocator, err = new_buffer_allocator(allocator, core.allocator, instance, core.logical_device.selected_device, core.logical_device.handle)
+	if err != nil {
+		return &core, err
+	}
+
+	//Fragmented pages are compacted with GPU copies on a transfer capable queue
+	if err = core.allocator.EnableDefrag(core.logical_device.handle, core.queues); err != nil {
+		return &core, err
+	}
+
+	//Image memory such as the swapchain depth attachment is sub-allocated from the same pools
+	core.image_allocator = NewCoreImageAllocator(core.logical_device.handle, core.allocator)
+
+	//Device local buffers are uploaded through a staging ring on a transfer capable queue
+	core.stage_allocator, err = NewCoreStageAllocator(core.logical_device.selected_device, core.logical_device.handle, core.allocator, core.queues, STAGE_ALLOCATOR_SIZE)
+	if err != nil {
+		return &core, err
+	}
 
 	//Pipeline and Descriptor Set Configuration - Ideally this is pre-configured and determined from SPIR-V reflection from the shaders and
 	//user defined pipeline layouts and supports multiple pipeline configuration
-	var descriptor_layouts []vk.DescriptorSetLayout
-	pool_types := []int{int(vk.DescriptorTypeUniformBuffer), int(vk.DescriptorTypeUniformBufferDynamic), int(vk.DescriptorTypeStorageBuffer), int(vk.DescriptorTypeStorageBufferDynamic), int(vk.DescriptorTypeUniformTexelBuffer)}
-	layout_types := []vk.DescriptorType{vk.DescriptorTypeUniformBuffer, vk.DescriptorTypeUniformBuffer, vk.DescriptorTypeUniformBuffer}
+	descriptor_layouts := make([]vk.DescriptorSetLayout, DESCRIPTOR_SET_HANDLES)
+	pool_types := []int{int(vk.DescriptorTypeUniformBuffer), int(vk.DescriptorTypeUniformBufferDynamic), int(vk.DescriptorTypeStorageBuffer), int(vk.DescriptorTypeStorageBufferDynamic), int(vk.DescriptorTypeUniformTexelBuffer), int(vk.DescriptorTypeStorageTexelBuffer)}
+	layout_types := []vk.DescriptorType{vk.DescriptorTypeUniformBuffer, vk.DescriptorTypeUniformBufferDynamic, vk.DescriptorTypeStorageBuffer, vk.DescriptorTypeUniformTexelBuffer, vk.DescriptorTypeStorageTexelBuffer}
 	core.global_descriptor_pool, err = NewDescriptorPool(core.logical_device.handle, DESCRIPTOR_SET_HANDLES, pool_types) //Make pool allocation of 10 Uniform Buffer Types with 3 Descriptor Set Handles Per
-	descriptor_layouts, err = NewDescriptorLayouts(core.logical_device.handle, []uint32{0, 0, 0}, layout_types, vk.ShaderStageFlags(vk.ShaderStageVertexBit))
+	//Each frame set holds the uniform buffer at binding 0, the per object dynamic uniform buffer, a storage buffer
+	//and the uniform and storage texel buffers. The storage buffer is also visible to fragment and compute shaders
+	bindings := []uint32{0, DYNAMIC_UNIFORM_BINDING, STORAGE_BUFFER_BINDING, UNIFORM_TEXEL_BINDING, STORAGE_TEXEL_BINDING}
+	vertex := vk.ShaderStageFlags(vk.ShaderStageVertexBit)
+	storage := vk.ShaderStageFlags(vk.ShaderStageVertexBit | vk.ShaderStageFragmentBit | vk.ShaderStageComputeBit)
+	stages := []vk.ShaderStageFlags{vertex, vertex, storage, vertex, vertex}
+	for i := 0; i < DESCRIPTOR_SET_HANDLES; i++ {
+		descriptor_layouts[i], err = NewDescriptorSetLayout(core.logical_device.handle, bindings, layout_types, stages)
+	}
 	core.global_descriptor_layouts["default"] = descriptor_layouts
 	//Descriptor Sets set to a default Uniform buffer and Vertex Shader stage. Parameterize for engine flexibility
 	core.frame_descriptor_sets, err = NewCoreDescriptor(core.logical_device.handle, core.global_descriptor_layouts["default"])
@@ -311,34 +434,352 @@ func (core *CoreRenderInstance) NewProgram(paths []string, name string) error {
 /*Adds vertex buffer with allocated memory to the vulkan instance*/
 func (core *CoreRenderInstance) AddVertexBuffer(data []float32, name string) {
 	prototype := Vertex{}
-	d := Ptr(data)
-	mdata := &d
-	bf := vk.BufferUsageFlags(vk.BufferUsageVertexBufferBit)
+	bytes, _ := AsBytes(data)
+	bf := vk.BufferUsageFlags(vk.BufferUsageVertexBufferBit | vk.BufferUsageTransferDstBit)
 	core.vertex_buffers[name] = NewCoreVertexBuffer(core.logical_device.handle, core.logical_device.selected_device, uint32(len(data)*4), int32(bf), prototype)
-	mem_size := core.vertex_buffers[name].reqs.Size
-	min_align := core.vertex_buffers[name].reqs.Alignment
+	delete(core.vertex_streams, name)
 
-	if mem_ref, err := core.allocator.Allocate(int(mem_size), int(min_align)); err == nil {
-		if err := core.allocator.Map(mdata, core.vertex_buffers[name].buffer[0], core.logical_device.handle, mem_ref, FLOAT32); err != nil {
-			fmt.Errorf("Failed to bind buffer %s\n", name)
+	//Vertex data is static so it is staged into device local memory. The draw commands carry no barrier against
+	//the transfer so wait for the data to become resident
+	ref, err := core.stage_allocator.Upload(core.vertex_buffers[name].buffer[0], core.vertex_buffers[name].reqs, bytes)
+	if err != nil {
+		Fatal(fmt.Errorf("Failed to upload vertex buffer %s %s\n", name, err))
+	}
+	core.stage_allocator.Wait(ref)
+	core.allocator.Track(ref.Ref(), core.vertex_buffers[name])
+}
+
+//AddVertexStructs stages a slice of vertex structs into device local memory. The attributes of the pipelines
+//drawing it are reflected from the vk tags of the struct, see VertexLayout
+func (core *CoreRenderInstance) AddVertexStructs(vertices interface{}, name string) error {
+	return core.AddVertexStreams(name, VertexStream{Vertices: vertices})
+}
+
+//AddVertexStreams stages one vertex buffer per stream into device local memory, stream i is bound to binding i of
+//the reflected VertexLayout. Draws cover the shortest per vertex stream once per element of the shortest
+//instanced stream
+func (core *CoreRenderInstance) AddVertexStreams(name string, streams ...VertexStream) error {
+	layout, data, vertices, instances, err := stream_data(streams)
+	if err != nil {
+		return err
+	}
+	bf := vk.BufferUsageFlags(vk.BufferUsageVertexBufferBit | vk.BufferUsageTransferDstBit)
+	draw := &VertexStreams{buffers: make([]*CoreBuffer, 0, len(data)), vertices: vertices, instances: instances}
+	for _, bytes := range data {
+		buffer := NewCoreVertexBuffer(core.logical_device.handle, core.logical_device.selected_device, uint32(len(bytes)), int32(bf), layout)
+		if err := core.stage_buffer(buffer, bytes); err != nil {
+			draw.release(core.logical_device.handle, core.allocator)
+			return fmt.Errorf("Failed to upload vertex buffer %s %s\n", name, err)
 		}
+		draw.buffers = append(draw.buffers, buffer)
 	}
+	draw.buffers[0].elements = vertices
+	draw.buffers[0].groups = vertices
+	core.vertex_buffers[name] = draw.buffers[0]
+	core.vertex_streams[name] = draw
+	return nil
+}
+
+//Stages bytes into the device local memory of buffer and tracks the buffer once the data is resident. On failure
+//the allocation is freed and the buffer destroyed
+func (core *CoreRenderInstance) stage_buffer(buffer *CoreBuffer, bytes []byte) error {
+	ref, err := core.stage_allocator.Upload(buffer.buffer[0], buffer.reqs, bytes)
+	if err == nil {
+		if err = core.stage_allocator.Wait(ref); err == nil {
+			err = core.allocator.Track(ref.Ref(), buffer)
+		}
+		if err != nil {
+			core.allocator.Free(ref.Ref())
+		}
+	}
+	if err != nil {
+		buffer.Destroy(core.logical_device.handle)
+	}
+	return err
+}
+
+//AddIndexBuffer stages []uint16 or []uint32 indices into device local memory. A vertex buffer of the same name is
+//drawn indexed once it has an index buffer
+func (core *CoreRenderInstance) AddIndexBuffer(indices interface{}, name string) error {
+	bytes, index_type, count, err := index_data(indices)
+	if err != nil {
+		return err
+	}
+	bf := vk.BufferUsageFlags(vk.BufferUsageIndexBufferBit | vk.BufferUsageTransferDstBit)
+	buffer := NewCoreIndexBuffer(core.logical_device.handle, core.logical_device.selected_device, count, int32(bf), index_type)
+
+	if err := core.stage_buffer(buffer, bytes); err != nil {
+		return fmt.Errorf("Failed to upload index buffer %s %s\n", name, err)
+	}
+	core.index_buffers[name] = buffer
+	return nil
+}
+
+//Defragment starts a background compaction pass over the allocator pools. Progress is reported on the returned
+//channel which receives DEFRAG_DONE when the pass ends
+func (core *CoreRenderInstance) Defragment() chan int {
+	progress := make(chan int, 16)
+	go core.allocator.Run(progress)
+	return progress
 }
 
 func (core *CoreRenderInstance) AddLayoutBuffer(data []float32, name string, usage vk.BufferUsageFlags) {
-	d := Ptr(data)
-	mdata := &d
+	bytes, _ := AsBytes(data)
+	core.add_layout_buffer(bytes, name, usage)
+}
+
+//AddLayoutStruct encodes a Go struct mirroring a GLSL block into a layout buffer, std430 for storage buffers and
+//std140 otherwise
+func (core *CoreRenderInstance) AddLayoutStruct(value interface{}, name string, usage vk.BufferUsageFlags) error {
+	bytes, err := EncodeLayout(value, usage_layout(usage))
+	if err != nil {
+		return err
+	}
+	return core.add_layout_buffer(bytes, name, usage)
+}
+
+//Layout buffers hold a copy per frame set so the host updates the copy of one frame while the GPU reads another
+func (core *CoreRenderInstance) add_layout_buffer(bytes []byte, name string, usage vk.BufferUsageFlags) error {
 	bf := vk.BufferUsageFlags(usage)
-	core.uniform_buffers[name] = NewLayoutBuffer(core.logical_device.handle, core.logical_device.selected_device, uint32(len(data)*4), int32(bf))
-	//Allocate the min alignment
-	mem_size := core.uniform_buffers[name].reqs.Size
-	min_align := core.uniform_buffers[name].reqs.Alignment
-
-	if mem_ref, err := core.allocator.Allocate(int(mem_size), int(min_align)); err == nil {
-		if err := core.allocator.Map(mdata, core.uniform_buffers[name].buffer[0], core.logical_device.handle, mem_ref, FLOAT32); err != nil {
-			fmt.Errorf("Failed to bind buffer %s\n", name)
+	copies := make([]*CoreBuffer, 0, DESCRIPTOR_SET_HANDLES)
+	for index := 0; index < DESCRIPTOR_SET_HANDLES; index++ {
+		buffer := NewLayoutBuffer(core.logical_device.handle, core.logical_device.selected_device, uint32(len(bytes)), int32(bf))
+		//Layout buffers are written from the host so request host visible memory of an allowed type
+		mem_ref, err := core.buffer_allocator.AllocateBuffer(buffer.buffer[0], buffer.reqs, MEMORY_HOST_VISIBLE)
+		if err != nil {
+			buffer.Destroy(core.logical_device.handle)
+			return err
+		}
+		buffer.mem_ref = mem_ref
+		copies = append(copies, buffer)
+		core.uniform_copies[name] = copies
+		core.uniform_buffers[name] = copies[0]
+		if err := core.buffer_allocator.Upload(buffer.buffer[0], mem_ref, bytes); err != nil {
+			return fmt.Errorf("Failed to bind buffer %s %s\n", name, err)
+		}
+	}
+	return nil
+}
+
+//UpdateLayoutBuffer replaces the contents of a layout buffer, []float32 as given or a struct encoded like
+//AddLayoutStruct. Each frame copy is rewritten once the fence of its frame signals, so frames in flight keep
+//reading the data they were submitted with. A frame copy of the buffer which failed to be written since its last
+//update is reported after the new data is queued, the failed copy is rewritten with the new data on its next frame
+func (core *CoreRenderInstance) UpdateLayoutBuffer(name string, data interface{}) error {
+	copies, ok := core.uniform_copies[name]
+	if !ok {
+		return fmt.Errorf("UpdateLayoutBuffer() no layout buffer named %s\n", name)
+	}
+	bytes, err := layout_data(data, vk.BufferUsageFlags(copies[0].usage))
+	if err != nil {
+		return err
+	}
+	if uint64(len(bytes)) > uint64(copies[0].size) {
+		return fmt.Errorf("UpdateLayoutBuffer() %d bytes overflows layout buffer %s of %d bytes\n", len(bytes), name, copies[0].size)
+	}
+
+	update := &LayoutUpdate{data: bytes, stale: make([]bool, len(copies))}
+	for index := range update.stale {
+		update.stale[index] = true
+	}
+	core.layout_updates[name] = update
+
+	//Copies beyond the frames in flight are read by no frame, before the swapchain exists that is every copy, so
+	//they are written straight away
+	for index := len(core.per_frame); index < len(copies); index++ {
+		if err := core.write_layout_update(name, index); err != nil {
+			return err
+		}
+	}
+
+	err = core.layout_errors[name]
+	delete(core.layout_errors, name)
+	return err
+}
+
+//Writes the pending update of a layout buffer into the copy of the frame
+func (core *CoreRenderInstance) write_layout_update(name string, frame int) error {
+	update := core.layout_updates[name]
+	if !update.stale[frame] {
+		return nil
+	}
+	buffer := core.uniform_copies[name][frame]
+	if err := core.buffer_allocator.Write(buffer.MemoryRef(), 0, update.data); err != nil {
+		return err
+	}
+	update.stale[frame] = false
+	for _, stale := range update.stale {
+		if stale {
+			return nil
+		}
+	}
+	delete(core.layout_updates, name)
+	return nil
+}
+
+//Applies pending layout buffer updates to the copies of a frame whose fence has signaled
+func (core *CoreRenderInstance) apply_layout_updates(frame int) {
+	for name := range core.layout_updates {
+		err := core.write_layout_update(name, frame)
+		if _, failed := core.layout_errors[name]; err != nil && !failed {
+			core.layout_errors[name] = fmt.Errorf("Failed to update layout buffer %s %s\n", name, err)
+		}
+	}
+}
+
+//AddDynamicLayoutStruct creates a dynamic uniform buffer from a slice or array of structs encoded as std140 blocks.
+//Each element is padded to minUniformBufferOffsetAlignment so draws select it with a dynamic offset
+func (core *CoreRenderInstance) AddDynamicLayoutStruct(elements interface{}, name string) error {
+	alignment := uint64(core.allocator.limits.MinUniformBufferOffsetAlignment)
+	bytes, stride, err := EncodeDynamicLayout(elements, LAYOUT_STD140, alignment)
+	if err != nil {
+		return err
+	}
+	count := uint32(uint64(len(bytes)) / stride)
+	buffer := NewDynamicLayoutBuffer(core.logical_device.handle, core.logical_device.selected_device, count, stride, int32(vk.BufferUsageUniformBufferBit))
+	mem_ref, err := core.buffer_allocator.AllocateBuffer(buffer.buffer[0], buffer.reqs, MEMORY_HOST_VISIBLE)
+	if err != nil {
+		buffer.Destroy(core.logical_device.handle)
+		return err
+	}
+	buffer.mem_ref = mem_ref
+	core.dynamic_buffers[name] = buffer
+	if err := core.buffer_allocator.Upload(buffer.buffer[0], mem_ref, bytes); err != nil {
+		return fmt.Errorf("Failed to bind buffer %s %s\n", name, err)
+	}
+	return nil
+}
+
+//BindDynamicUniform writes the named dynamic uniform buffer to DYNAMIC_UNIFORM_BINDING of every frame set. Draws use
+//element 0 until SetDynamicElements selects others
+func (core *CoreRenderInstance) BindDynamicUniform(name string) error {
+	buffer, ok := core.dynamic_buffers[name]
+	if !ok {
+		return fmt.Errorf("BindDynamicUniform() no dynamic uniform buffer named %s\n", name)
+	}
+	for index := 0; index < DESCRIPTOR_SET_HANDLES; index++ {
+		core.frame_descriptor_sets.AddBuffer(core.logical_device.handle, DYNAMIC_UNIFORM_BINDING, int(vk.DescriptorTypeUniformBufferDynamic), index, *buffer)
+	}
+	core.dynamic_uniform = name
+	core.dynamic_elements = []uint32{0}
+	return nil
+}
+
+//SetDynamicElements draws the mesh once per element of the bound dynamic uniform buffer in the given order, binding
+//the frame set with the dynamic offset of the element before each draw. Takes effect when commands are next set up
+func (core *CoreRenderInstance) SetDynamicElements(elements []uint32) error {
+	buffer, ok := core.dynamic_buffers[core.dynamic_uniform]
+	if !ok {
+		return fmt.Errorf("SetDynamicElements() no dynamic uniform buffer is bound\n")
+	}
+	for _, element := range elements {
+		if element >= buffer.elements {
+			return fmt.Errorf("SetDynamicElements() element %d out of range of %d elements\n", element, buffer.elements)
+		}
+	}
+	core.dynamic_elements = append([]uint32(nil), elements...)
+	return nil
+}
+
+//Dynamic offsets of the draws, a single zero offset keeps the dynamic binding valid when nothing is bound to it
+func (core *CoreRenderInstance) dynamic_offsets() []uint32 {
+	buffer, ok := core.dynamic_buffers[core.dynamic_uniform]
+	if !ok {
+		return []uint32{0}
+	}
+	offsets := make([]uint32, len(core.dynamic_elements))
+	for i, element := range core.dynamic_elements {
+		offsets[i] = element * uint32(buffer.stride)
+	}
+	return offsets
+}
+
+//AddStorageBuffer places data in a host visible storage buffer which shaders write and ReadBuffer reads back
+func (core *CoreRenderInstance) AddStorageBuffer(data []byte, name string) error {
+	bf := vk.BufferUsageFlags(vk.BufferUsageStorageBufferBit | vk.BufferUsageTransferSrcBit | vk.BufferUsageTransferDstBit)
+	buffer := NewLayoutBuffer(core.logical_device.handle, core.logical_device.selected_device, uint32(len(data)), int32(bf))
+	mem_ref, err := core.buffer_allocator.AllocateBuffer(buffer.buffer[0], buffer.reqs, MEMORY_HOST_VISIBLE)
+	if err != nil {
+		buffer.Destroy(core.logical_device.handle)
+		return err
+	}
+	buffer.mem_ref = mem_ref
+	core.storage_buffers[name] = buffer
+	if err := core.buffer_allocator.Upload(buffer.buffer[0], mem_ref, data); err != nil {
+		return fmt.Errorf("Failed to bind buffer %s %s\n", name, err)
+	}
+	return nil
+}
+
+//BindStorage writes the named storage buffer to STORAGE_BUFFER_BINDING of every frame set
+func (core *CoreRenderInstance) BindStorage(name string) error {
+	buffer, ok := core.storage_buffers[name]
+	if !ok {
+		return fmt.Errorf("BindStorage() no storage buffer named %s\n", name)
+	}
+	for index := 0; index < DESCRIPTOR_SET_HANDLES; index++ {
+		core.frame_descriptor_sets.AddBuffer(core.logical_device.handle, STORAGE_BUFFER_BINDING, int(vk.DescriptorTypeStorageBuffer), index, *buffer)
+	}
+	return nil
+}
+
+//AddTexelBuffer places formatted data such as lookup tables in a host visible uniform or storage texel buffer and
+//creates its view. The format must support the texel buffer usage on the device
+func (core *CoreRenderInstance) AddTexelBuffer(data []byte, name string, format vk.Format, usage vk.BufferUsageFlags) error {
+	buffer, err := NewCoreTexelBuffer(core.logical_device.handle, core.logical_device.selected_device, uint32(len(data)), int32(usage), format)
+	if err != nil {
+		return err
+	}
+	mem_ref, err := core.buffer_allocator.AllocateBuffer(buffer.buffer[0], buffer.reqs, MEMORY_HOST_VISIBLE)
+	if err != nil {
+		buffer.Destroy(core.logical_device.handle)
+		return err
+	}
+	buffer.mem_ref = mem_ref
+	core.texel_buffers[name] = buffer
+	if err := core.buffer_allocator.Upload(buffer.buffer[0], mem_ref, data); err != nil {
+		return fmt.Errorf("Failed to bind buffer %s %s\n", name, err)
+	}
+	return buffer.NewBufferView(core.logical_device.handle)
+}
+
+//BindTexelBuffer writes the view of the named texel buffer to UNIFORM_TEXEL_BINDING and or STORAGE_TEXEL_BINDING of
+//every frame set following its usage
+func (core *CoreRenderInstance) BindTexelBuffer(name string) error {
+	buffer, ok := core.texel_buffers[name]
+	if !ok {
+		return fmt.Errorf("BindTexelBuffer() no texel buffer named %s\n", name)
+	}
+	for _, binding := range texel_bindings(vk.BufferUsageFlags(buffer.usage)) {
+		for index := 0; index < DESCRIPTOR_SET_HANDLES; index++ {
+			core.frame_descriptor_sets.AddTexelBuffer(core.logical_device.handle, binding.location, int(binding.descriptor_type), index, *buffer)
 		}
 	}
+	return nil
+}
+
+//ReadBuffer waits on the fences of the frames in flight, any of which may write the buffer, then returns the
+//contents of the named storage buffer, see ReadBufferSlice for typed reads. Shader writes are made visible by the
+//host read barrier ending each frame's commands
+func (core *CoreRenderInstance) ReadBuffer(name string) ([]byte, error) {
+	buffer, ok := core.storage_buffers[name]
+	if !ok {
+		return nil, fmt.Errorf("ReadBuffer() no storage buffer named %s\n", name)
+	}
+	fences := make([]vk.Fence, 0, len(core.per_frame))
+	for _, frame := range core.per_frame {
+		fences = append(fences, frame.fence[0])
+	}
+	if len(fences) > 0 {
+		if res := vk.WaitForFences(core.logical_device.handle, uint32(len(fences)), fences, vk.True, vk.MaxUint64); res != vk.Success {
+			return nil, NewError(res)
+		}
+	}
+	data := make([]byte, buffer.size)
+	if err := core.buffer_allocator.Read(buffer.mem_ref, 0, data); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
 func (core *CoreRenderInstance) GetLayoutBuffers() map[string]*CoreBuffer {
@@ -349,7 +790,11 @@ func (core *CoreRenderInstance) GetLayoutBuffers() map[string]*CoreBuffer {
 func (core *CoreRenderInstance) BindUniforms(uniforms map[string]*CoreBuffer, binding []int) error {
 
 	for index := 0; index < 3; index++ {
-		for _, uniform := range uniforms {
+		for name, uniform := range uniforms {
+			//Each frame set points at the copy of its frame
+			if copies, ok := core.uniform_copies[name]; ok && copies[0] == uniform {
+				uniform = copies[index]
+			}
 			core.frame_descriptor_sets.AddBuffer(core.logical_device.handle, binding[index], int(vk.DescriptorTypeUniformBuffer), index, *uniform)
 		}
 	}
@@ -360,16 +805,51 @@ func (core *CoreRenderInstance) NewSwapchain() *CoreSwapchain {
 	var err error
 	core.swapchain = NewCoreSwapchain(core, SWAPCHAIN_COUNT, core.display)
 	core.swapchain.init(core, core.swapchain.depth, core.display)
-	core.per_frame = make([]PerFrame, core.swapchain.depth)
-	for index := 0; index < core.swapchain.depth; index++ {
+
+	//Surfaces may require more images than there are frame sets and layout buffer copies, so the frames in flight
+	//are capped at DESCRIPTOR_SET_HANDLES and cycle over the swapchain images
+	frames := core.swapchain.depth
+	if frames > DESCRIPTOR_SET_HANDLES {
+		frames = DESCRIPTOR_SET_HANDLES
+	}
+	core.per_frame = make([]PerFrame, frames)
+	for index := 0; index < frames; index++ {
 		core.per_frame[index], err = NewPerFrame(core, index)
 	}
 	if err != nil {
 		Fatal(fmt.Errorf("Could not initiate per frame data\n"))
 	}
+
+	//Transient per frame data regions are rewound once the frame fence signals, a previous swapchain's regions are
+	//released first
+	if core.frame_allocator != nil {
+		vk.DeviceWaitIdle(core.logical_device.handle)
+		core.frame_allocator.Destroy()
+	}
+	frame_usage := vk.BufferUsageFlags(vk.BufferUsageUniformBufferBit | vk.BufferUsageStorageBufferBit | vk.BufferUsageVertexBufferBit | vk.BufferUsageIndexBufferBit)
+	core.frame_allocator, err = NewCoreFrameAllocator(core.logical_device.selected_device, core.logical_device.handle, frames, FRAME_ALLOCATOR_SIZE, frame_usage)
+	if err != nil {
+		Fatal(fmt.Errorf("Could not create frame allocator %s\n", err))
+	}
+	for index := 0; index < frames; index++ {
+		core.frame_allocator.Track(index, core.per_frame[index].fence[0])
+	}
+
+	//Pages replaced by compaction may still be referenced by every frame in flight
+	core.allocator.SetRetireFrames(frames)
 	return core.swapchain
 }
 
+//AddFrameData copies transient data into the current frame region. The data remains valid until the frame
+//is next acquired
+func (core *CoreRenderInstance) AddFrameData(data []byte) (FrameRef, error) {
+	return core.frame_allocator.Write(core.current_frame, data)
+}
+
+func (core *CoreRenderInstance) GetFrameAllocator() *CoreFrameAllocator {
+	return core.frame_allocator
+}
+
 func (core *CoreRenderInstance) SetupCommands() {
 	core.setup_commands()
 }
@@ -403,7 +883,7 @@ func (core *CoreRenderInstance) GetPhysicalDevice() vk.PhysicalDevice {
 func (core *CoreRenderInstance) destroy_per_frame() {
 
 	//Destroying all per frame data - Warning Vulkan validation will throw an exception
-	for index := 0; index < core.swapchain.depth; index++ {
+	for index := 0; index < len(core.per_frame); index++ {
 		vk.ResetFences(core.logical_device.handle, uint32(1), core.per_frame[index].fence)
 		vk.ResetCommandPool(core.logical_device.handle, core.per_frame[index].pool.pool, vk.CommandPoolResetFlags(vk.CommandPoolResetReleaseResourcesBit))
 		vk.DestroySemaphore(core.logical_device.handle, core.per_frame[index].image_acquired[0], nil)
@@ -447,9 +927,8 @@ func (core *CoreRenderInstance) submit_pipeline(image uint32) vk.Result {
 		PSignalSemaphores:    core.per_frame[core.current_frame].queue_complete,
 	}
 
-	queue := core.render_queue
-
-	res_queue := vk.QueueSubmit(*queue, 1, []vk.SubmitInfo{submitInfo}, core.per_frame[core.current_frame].fence[0])
+	//Submissions go through the queue locks as compaction may submit copies from another goroutine
+	res_queue := core.queues.Submit(int(core.render_queue_family), []vk.SubmitInfo{submitInfo}, core.per_frame[core.current_frame].fence[0])
 
 	return res_queue
 }
@@ -465,14 +944,14 @@ func (core *CoreRenderInstance) Update(delta_time float32) {
 	}
 
 	if res != vk.Success {
-		vk.QueueWaitIdle(*core.render_queue)
+		core.queues.WaitIdle(int(core.render_queue_family))
 	}
 
 	core.setup_command(int(core.current_frame), image_index)
 
 	core.submit_pipeline(image_index)
 
-	res = core.present_image(*core.render_queue, image_index)
+	res = core.present_image(image_index)
 
 	if res == vk.ErrorOutOfDate || res == vk.Suboptimal {
 		core.resize()
@@ -480,7 +959,7 @@ func (core *CoreRenderInstance) Update(delta_time float32) {
 		Fatal(fmt.Errorf("Failed to present swapchain image\n"))
 	}
 
-	core.current_frame = (core.current_frame + 1) % core.swapchain.depth
+	core.current_frame = (core.current_frame + 1) % len(core.per_frame)
 	core.pconstant[0].frame_delta += update_step
 	if core.pconstant[0].frame_delta > 1.0 {
 		update_step = -0.01
@@ -492,7 +971,7 @@ func (core *CoreRenderInstance) Update(delta_time float32) {
 	return
 }
 
-func (core *CoreRenderInstance) present_image(queue vk.Queue, image_index uint32) vk.Result {
+func (core *CoreRenderInstance) present_image(image_index uint32) vk.Result {
 
 	present_info := vk.PresentInfo{}
 	present_info.SType = vk.StructureTypePresentInfo
@@ -503,7 +982,7 @@ func (core *CoreRenderInstance) present_image(queue vk.Queue, image_index uint32
 	present_info.SwapchainCount = 1
 	present_info.PImageIndices = []uint32{image_index}
 
-	return vk.QueuePresent(queue, &present_info)
+	return core.queues.Present(int(core.render_queue_family), &present_info)
 
 }
 
@@ -556,10 +1035,40 @@ func (core *CoreRenderInstance) Destroy() {
 		buffer.Destroy(core.logical_device.handle)
 	}
 
+	//The first copy is the one held in uniform_buffers
+	for _, copies := range core.uniform_copies {
+		for _, buffer := range copies[1:] {
+			buffer.Destroy(core.logical_device.handle)
+		}
+	}
+
 	for _, buffer := range core.vertex_buffers {
 		buffer.Destroy(core.logical_device.handle)
 	}
 
+	//Binding 0 of each set of vertex streams is destroyed with the vertex buffers
+	for _, draw := range core.vertex_streams {
+		for _, buffer := range draw.buffers[1:] {
+			buffer.Destroy(core.logical_device.handle)
+		}
+	}
+
+	for _, buffer := range core.index_buffers {
+		buffer.Destroy(core.logical_device.handle)
+	}
+
+	for _, buffer := range core.dynamic_buffers {
+		buffer.Destroy(core.logical_device.handle)
+	}
+
+	for _, buffer := range core.storage_buffers {
+		buffer.Destroy(core.logical_device.handle)
+	}
+
+	for _, buffer := range core.texel_buffers {
+		buffer.Destroy(core.logical_device.handle)
+	}
+
 	for index, view := range core.swapchain.image_views {
 		if view != vk.NullImageView {
 			vk.DestroyImageView(core.logical_device.handle, core.swapchain.image_views[index], nil)
@@ -579,7 +1088,22 @@ func (core *CoreRenderInstance) Destroy() {
 		vk.DestroySurface(*core.instance, core.display.surface, nil)
 	}
 
-	core.allocator.Destroy(core.logical_device.handle)
+	if core.frame_allocator != nil {
+		core.frame_allocator.Destroy()
+	}
+
+	if core.stage_allocator != nil {
+		core.stage_allocator.Destroy()
+	}
+
+	if core.image_allocator != nil {
+		core.image_allocator.Destroy()
+	}
+
+	if core.buffer_allocator != nil && core.buffer_allocator != BufferAllocator(core.allocator) {
+		core.buffer_allocator.Destroy()
+	}
+	core.allocator.Destroy()
 
 	vk.DestroyDevice(core.logical_device.handle, nil)
 }
@@ -596,11 +1120,14 @@ func (core *CoreRenderInstance) acquire_next_image(image *uint32) vk.Result {
 
 	if core.per_frame[core.current_frame].fence[0] != vk.Fence(vk.NullHandle) {
 		vk.WaitForFences(core.logical_device.handle, 1, core.per_frame[core.current_frame].fence, vk.True, vk.MaxUint64)
+		core.frame_allocator.Begin(core.current_frame)
+		core.apply_layout_updates(core.current_frame)
+		core.allocator.Clean()
 		vk.ResetFences(core.logical_device.handle, 1, core.per_frame[core.current_frame].fence)
 	}
 
 	if core.per_frame[core.current_frame].pool.pool != vk.CommandPool(vk.NullHandle) {
-		vk.QueueWaitIdle(*core.render_queue)
+		core.queues.WaitIdle(int(core.render_queue_family))
 		vk.ResetCommandPool(core.logical_device.handle, core.per_frame[core.current_frame].pool.pool, 0)
 	}
 
@@ -650,23 +1177,40 @@ func (core *CoreRenderInstance) setup_command(index int, image_index uint32) {
 	gather, _ := core.frame_descriptor_sets.GatherSets()
 	frame_set := make([]vk.DescriptorSet, 1)
 	frame_set[0] = gather[index]
-	vk.CmdBindDescriptorSets(cmd[0], vk.PipelineBindPointGraphics, core.pipeline.layouts["pipe0"], 0, 1, frame_set, 0, nil)
 	vk.CmdPushConstants(cmd[0], core.pipeline.layouts["pipe0"], vk.ShaderStageFlags(vk.ShaderStageVertexBit), 0, 4, unsafe.Pointer(&core.pconstant[0]))
 	vk.CmdSetViewport(cmd[0], 0, 1, viewports)
 	vk.CmdSetScissor(cmd[0], 0, 1, rects)
 	tri_buffer := core.vertex_buffers["triangle"]
-	offsets := []vk.DeviceSize{vk.DeviceSize(0)}
-	vk.CmdBindVertexBuffers(cmd[0], 0, 1, tri_buffer.buffer, offsets)
-	vk.CmdDraw(cmd[0], tri_buffer.groups, 1, 0, 0)
+	vertex_handles, vertices, instances := tri_buffer.buffer, tri_buffer.groups, uint32(1)
+	if draw, ok := core.vertex_streams["triangle"]; ok {
+		vertex_handles, vertices, instances = draw.handles(), draw.vertices, draw.instances
+	}
+	offsets := make([]vk.DeviceSize, len(vertex_handles))
+	vk.CmdBindVertexBuffers(cmd[0], 0, uint32(len(vertex_handles)), vertex_handles, offsets)
+	indices, indexed := core.index_buffers["triangle"]
+	if indexed {
+		vk.CmdBindIndexBuffer(cmd[0], indices.buffer[0], 0, indices.index_type)
+	}
+	//One draw per selected per object element, each rebinding the frame set at the element offset
+	for _, offset := range core.dynamic_offsets() {
+		vk.CmdBindDescriptorSets(cmd[0], vk.PipelineBindPointGraphics, core.pipeline.layouts["pipe0"], 0, 1, frame_set, 1, []uint32{offset})
+		if indexed {
+			vk.CmdDrawIndexed(cmd[0], indices.elements, instances, 0, 0, 0)
+		} else {
+			vk.CmdDraw(cmd[0], vertices, instances, 0, 0)
+		}
+	}
 
 	vk.CmdEndRenderPass(cmd[0])
+	//Storage buffer writes of the frame are made visible to ReadBuffer once its fence signals
+	CmdHostReadBarrier(cmd[0], vk.PipelineStageFlags(vk.PipelineStageVertexShaderBit|vk.PipelineStageFragmentShaderBit))
 	vk.EndCommandBuffer(cmd[0])
 
 }
 
 func (core *CoreRenderInstance) setup_commands() {
-	// Command Buffer Per Render-Pass per swapchain image which means they are interchangeable
-	for i := 0; i < core.swapchain.depth; i++ {
+	// Command Buffer Per Render-Pass per frame in flight, re-recorded for the acquired image each frame
+	for i := 0; i < len(core.per_frame); i++ {
 		core.setup_command(i, uint32(i))
 	}
 }
@@ -703,5 +1247,8 @@ func (core *CoreRenderInstance) resize() {
 
 func (core *CoreRenderInstance) AllocatorUsage() {
 	output := core.allocator.Usage()
+	if core.buffer_allocator != BufferAllocator(core.allocator) {
+		output += core.buffer_allocator.Usage()
+	}
 	fmt.Printf(output)
 }
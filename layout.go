@@ -0,0 +1,242 @@
+package dieselvk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+
+	vk "github.com/vulkan-go/vulkan"
+)
+
+/*
+Reflection encoder for GLSL std140 and std430 buffer blocks. A Go struct mirrors the GLSL block member for member
+and is encoded with the alignment and padding of the layout:
+
+	float32 int32 uint32 bool       float int uint bool
+	float64                         double
+	[N]T of scalars with N 2 to 4   vecN dvecN ivecN uvecN bvecN
+	[C][R]T of scalars              matCxR, C column vectors of R components
+	[N]T otherwise and []T          arrays
+	struct                          nested structs
+
+A [N]T field tagged `layout:"array"` is an array even when it would be a vector, e.g. float weights[4], and fields
+tagged `layout:"-"` are skipped. Scalars and vectors are aligned to their size with vec3 aligned as vec4, so a
+float following a vec3 fills its last 4 bytes. Arrays are strided by their element size rounded up to the element
+alignment and structs are padded to their alignment. std140 additionally rounds the alignment of arrays, matrices
+and structs up to that of a vec4, std430 as used by storage buffers does not.
+*/
+
+const (
+	LAYOUT_STD140 = 0 //Uniform buffers
+	LAYOUT_STD430 = 1 //Storage buffers and push constants
+)
+
+//EncodeLayout serialises a struct, array, slice or scalar into the std140 or std430 layout
+func EncodeLayout(value interface{}, layout int) ([]byte, error) {
+	if layout != LAYOUT_STD140 && layout != LAYOUT_STD430 {
+		return nil, fmt.Errorf("EncodeLayout() unknown layout %d\n", layout)
+	}
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		return nil, fmt.Errorf("EncodeLayout() value is nil\n")
+	}
+
+	measure := layout_encoder{layout: layout}
+	_, size, err := measure.value(v, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	encoder := layout_encoder{layout: layout, out: make([]byte, size)}
+	encoder.value(v, false, 0)
+	return encoder.out, nil
+}
+
+//WriteLayout encodes the value and copies it into the referenced block at a byte offset, see CoreAllocator.Write
+func WriteLayout(allocator *CoreAllocator, ref MemRef, offset uint64, value interface{}, layout int) error {
+	bytes, err := EncodeLayout(value, layout)
+	if err != nil {
+		return err
+	}
+	return allocator.Write(ref, offset, bytes)
+}
+
+//EncodeDynamicLayout encodes each element of a slice or array into its own block padded to a multiple of the
+//alignment, typically minUniformBufferOffsetAlignment, so element i is selected by the dynamic offset i * stride.
+//Returns the bytes and the stride
+func EncodeDynamicLayout(elements interface{}, layout int, alignment uint64) ([]byte, uint64, error) {
+	v := reflect.ValueOf(elements)
+	if !v.IsValid() || (v.Kind() != reflect.Slice && v.Kind() != reflect.Array) {
+		return nil, 0, fmt.Errorf("EncodeDynamicLayout() expected a slice or array of elements, got %T\n", elements)
+	}
+	if v.Len() == 0 {
+		return nil, 0, fmt.Errorf("EncodeDynamicLayout() no elements\n")
+	}
+
+	blocks := make([][]byte, v.Len())
+	stride := uint64(0)
+	for i := 0; i < v.Len(); i++ {
+		block, err := EncodeLayout(v.Index(i).Interface(), layout)
+		if err != nil {
+			return nil, 0, err
+		}
+		blocks[i] = block
+		stride = max_u64(stride, uint64(len(block)))
+	}
+	stride = uint64(align_up(int(stride), int(max_u64(alignment, 1))))
+
+	out := make([]byte, stride*uint64(len(blocks)))
+	for i, block := range blocks {
+		copy(out[uint64(i)*stride:], block)
+	}
+	return out, stride, nil
+}
+
+//Bytes of layout buffer data, []float32 is copied as is like AddLayoutBuffer and other values are encoded in the
+//layout of the usage like AddLayoutStruct
+func layout_data(data interface{}, usage vk.BufferUsageFlags) ([]byte, error) {
+	if floats, ok := data.([]float32); ok {
+		return AsBytes(floats)
+	}
+	return EncodeLayout(data, usage_layout(usage))
+}
+
+//Layout of the block held by a buffer of the usage, std430 for storage buffers and std140 otherwise
+func usage_layout(usage vk.BufferUsageFlags) int {
+	storage := usage&vk.BufferUsageFlags(vk.BufferUsageStorageBufferBit) != 0
+	uniform := usage&vk.BufferUsageFlags(vk.BufferUsageUniformBufferBit) != 0
+	if storage && !uniform {
+		return LAYOUT_STD430
+	}
+	return LAYOUT_STD140
+}
+
+//Walks a value computing its base alignment and size, values are written into out unless it is nil
+type layout_encoder struct {
+	layout int
+	out    []byte
+}
+
+func (enc *layout_encoder) value(v reflect.Value, array bool, offset uint64) (uint64, uint64, error) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return 0, 0, fmt.Errorf("EncodeLayout() nil %s\n", v.Type())
+		}
+		return enc.value(v.Elem(), array, offset)
+	case reflect.Bool, reflect.Int32, reflect.Uint32, reflect.Float32, reflect.Float64:
+		size := scalar_size(v.Kind())
+		enc.scalar(v, offset)
+		return size, size, nil
+	case reflect.Array:
+		if !array && v.Len() >= 2 && v.Len() <= 4 && scalar_size(v.Type().Elem().Kind()) != 0 {
+			return enc.vector(v, offset)
+		}
+		return enc.array(v, offset)
+	case reflect.Slice:
+		return enc.array(v, offset)
+	case reflect.Struct:
+		return enc.structure(v, offset)
+	}
+	return 0, 0, fmt.Errorf("EncodeLayout() %s has no GLSL layout\n", v.Type())
+}
+
+//Alignment and size of a value without writing it
+func (enc *layout_encoder) measure(v reflect.Value, array bool) (uint64, uint64, error) {
+	measure := layout_encoder{layout: enc.layout}
+	return measure.value(v, array, 0)
+}
+
+//Vectors of 2 components align to twice the component size, vectors of 3 and 4 components to four times
+func (enc *layout_encoder) vector(v reflect.Value, offset uint64) (uint64, uint64, error) {
+	size := scalar_size(v.Type().Elem().Kind())
+	for i := 0; i < v.Len(); i++ {
+		enc.scalar(v.Index(i), offset+uint64(i)*size)
+	}
+	if v.Len() == 2 {
+		return 2 * size, 2 * size, nil
+	}
+	return 4 * size, uint64(v.Len()) * size, nil
+}
+
+func (enc *layout_encoder) array(v reflect.Value, offset uint64) (uint64, uint64, error) {
+	elem := v.Type().Elem()
+	if elem.Kind() == reflect.Slice {
+		return 0, 0, fmt.Errorf("EncodeLayout() arrays of slices have no GLSL layout\n")
+	}
+	probe := reflect.Zero(elem)
+	if v.Len() > 0 {
+		probe = v.Index(0)
+	}
+	align, size, err := enc.measure(probe, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	if enc.layout == LAYOUT_STD140 {
+		align = max_u64(align, 16)
+	}
+
+	stride := uint64(align_up(int(size), int(align)))
+	for i := 0; i < v.Len(); i++ {
+		if _, _, err := enc.value(v.Index(i), false, offset+uint64(i)*stride); err != nil {
+			return 0, 0, err
+		}
+	}
+	return align, stride * uint64(v.Len()), nil
+}
+
+func (enc *layout_encoder) structure(v reflect.Value, offset uint64) (uint64, uint64, error) {
+	align, cursor := uint64(1), uint64(0)
+	for i := 0; i < v.NumField(); i++ {
+		tag := v.Type().Field(i).Tag.Get("layout")
+		if tag == "-" {
+			continue
+		}
+		field_align, field_size, err := enc.measure(v.Field(i), tag == "array")
+		if err != nil {
+			return 0, 0, err
+		}
+		cursor = uint64(align_up(int(cursor), int(field_align)))
+		if enc.out != nil {
+			enc.value(v.Field(i), tag == "array", offset+cursor)
+		}
+		cursor += field_size
+		align = max_u64(align, field_align)
+	}
+	if enc.layout == LAYOUT_STD140 {
+		align = max_u64(align, 16)
+	}
+	return align, uint64(align_up(int(cursor), int(align))), nil
+}
+
+func (enc *layout_encoder) scalar(v reflect.Value, offset uint64) {
+	if enc.out == nil {
+		return
+	}
+	out := enc.out[offset:]
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			binary.LittleEndian.PutUint32(out, 1)
+		}
+	case reflect.Int32:
+		binary.LittleEndian.PutUint32(out, uint32(v.Int()))
+	case reflect.Uint32:
+		binary.LittleEndian.PutUint32(out, uint32(v.Uint()))
+	case reflect.Float32:
+		binary.LittleEndian.PutUint32(out, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		binary.LittleEndian.PutUint64(out, math.Float64bits(v.Float()))
+	}
+}
+
+//Byte size of the GLSL scalar a Go kind encodes, 0 for kinds which are not scalars
+func scalar_size(kind reflect.Kind) uint64 {
+	switch kind {
+	case reflect.Bool, reflect.Int32, reflect.Uint32, reflect.Float32:
+		return 4
+	case reflect.Float64:
+		return 8
+	}
+	return 0
+}
@@ -0,0 +1,113 @@
+package dieselvk
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+)
+
+/*
+Opt-in leak tracking for CoreAllocator. With TrackLeaks enabled every allocation records the first call site
+outside of dieselvk so allocations made by the instances are attributed to the application code which requested
+them. Freed allocations are forgotten, moves made by compaction keep their original call site and Destroy reports
+whatever is still live.
+*/
+
+//AllocationSite is a live allocation and the call site which made it
+type AllocationSite struct {
+	Ref   MemRef
+	Size  uint64
+	Frame StackFrame
+}
+
+//TrackLeaks starts or stops recording allocation call sites. Allocations made while tracking is off are not reported
+func (core *CoreAllocator) TrackLeaks(enable bool) {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	if !enable {
+		core.sites = nil
+		return
+	}
+	if core.sites == nil {
+		core.sites = make(map[MemRef]AllocationSite)
+	}
+}
+
+//Leaks returns the live tracked allocations ordered by memory type, page and offset
+func (core *CoreAllocator) Leaks() []AllocationSite {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	return core.leaks()
+}
+
+//LeakReport formats the live tracked allocations one per line
+func (core *CoreAllocator) LeakReport() string {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	return leak_report(core.leaks())
+}
+
+func (core *CoreAllocator) leaks() []AllocationSite {
+	sites := make([]AllocationSite, 0, len(core.sites))
+	for _, site := range core.sites {
+		sites = append(sites, site)
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		a, b := sites[i].Ref, sites[j].Ref
+		if a.mem_type != b.mem_type {
+			return a.mem_type < b.mem_type
+		}
+		if a.page != b.page {
+			return a.page < b.page
+		}
+		return a.key < b.key
+	})
+	return sites
+}
+
+func leak_report(sites []AllocationSite) string {
+	var out string
+	for _, site := range sites {
+		out += fmt.Sprintf("%d bytes memory type %d page %d offset %d allocated at %s:%d (%s)\n", site.Size, site.Ref.mem_type, site.Ref.page, site.Ref.key, site.Frame.File, site.Frame.LineNumber, site.Frame.Name)
+	}
+	return out
+}
+
+//Records the call site of a new allocation, the caller holds the allocator lock
+func (core *CoreAllocator) record_site(ref MemRef) {
+	if core.sites == nil {
+		return
+	}
+	_, block, err := core.block(ref)
+	if err != nil {
+		return
+	}
+	core.sites[ref] = AllocationSite{Ref: ref, Size: block.size, Frame: allocation_site()}
+}
+
+//Moves the call site of a block relocated by compaction, the caller holds the allocator lock
+func (core *CoreAllocator) move_site(from MemRef, to MemRef) {
+	if site, ok := core.sites[from]; ok {
+		delete(core.sites, from)
+		site.Ref = to
+		core.sites[to] = site
+	}
+}
+
+//Returns the first stack frame outside of dieselvk, or the outermost dieselvk frame when the allocation was not
+//requested from outside of the package
+func allocation_site() StackFrame {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(2, pcs)
+	own, _ := packageAndName(runtime.FuncForPC(reflect.ValueOf(allocation_site).Pointer()))
+	var site StackFrame
+	for _, pc := range pcs[:n] {
+		frame := newStackFrame(pc)
+		if frame.Package != own {
+			return frame
+		}
+		site = frame
+	}
+	return site
+}
@@ -1,4 +1,427 @@
 package dieselvk
 
+import (
+	"fmt"
+	"unsafe"
+
+	vk "github.com/vulkan-go/vulkan"
+)
+
+//MemoryBackend is the device memory provider that allocators call through. CoreMemory issues the real
+//Vulkan calls while FakeMemory hands out host byte slices so allocator bookkeeping can be exercised
+//without a GPU
+type MemoryBackend interface {
+	MemoryProperties() vk.PhysicalDeviceMemoryProperties
+	Limits() vk.PhysicalDeviceLimits
+	AllocateMemory(size uint64, type_index uint32) (vk.DeviceMemory, error)
+	FreeMemory(memory vk.DeviceMemory)
+	BindBufferMemory(buffer vk.Buffer, memory vk.DeviceMemory, offset uint64) error
+	BindImageMemory(image vk.Image, memory vk.DeviceMemory, offset uint64) error
+	MapMemory(memory vk.DeviceMemory, offset uint64, size uint64) (unsafe.Pointer, error)
+	UnmapMemory(memory vk.DeviceMemory)
+	FlushMemory(memory vk.DeviceMemory, offset uint64, size uint64) error
+	InvalidateMemory(memory vk.DeviceMemory, offset uint64, size uint64) error
+	HeapBudget() ([]MemHeap, bool)
+	DedicatedRequirements(buffer vk.Buffer, image vk.Image) DedicatedRequirements
+	AllocateDedicated(size uint64, type_index uint32, buffer vk.Buffer, image vk.Image) (vk.DeviceMemory, error)
+}
+
+//DedicatedRequirements reports whether the driver prefers or requires a resource to own its device memory
+type DedicatedRequirements struct {
+	Prefers  bool
+	Requires bool
+}
+
+//CoreMemory provides GPU/Host memory allocation through the Vulkan device
 type CoreMemory struct {
+	physical  vk.PhysicalDevice
+	handle    vk.Device
+	mem_props vk.PhysicalDeviceMemoryProperties
+	dev_props vk.PhysicalDeviceProperties
+	budget    bool //VK_EXT_memory_budget is supported and enabled on the device
+	dedicated bool //Vulkan 1.1 dedicated allocations and memory requirements queries are available
+	address   bool //VK_KHR_buffer_device_address is supported and enabled, memory is allocated addressable
+}
+
+func NewCoreMemory(physical vk.PhysicalDevice, handle vk.Device) *CoreMemory {
+	core := CoreMemory{physical: physical, handle: handle}
+	vk.GetPhysicalDeviceMemoryProperties(physical, &core.mem_props)
+	vk.GetPhysicalDeviceProperties(physical, &core.dev_props)
+	core.mem_props.Deref()
+	core.dev_props.Deref()
+	core.dev_props.Limits.Deref()
+	for i := 0; i < int(core.mem_props.MemoryTypeCount); i++ {
+		core.mem_props.MemoryTypes[i].Deref()
+	}
+	for i := 0; i < int(core.mem_props.MemoryHeapCount); i++ {
+		core.mem_props.MemoryHeaps[i].Deref()
+	}
+	core.budget = has_device_extension(physical, MEMORY_BUDGET_EXTENSION)
+	core.dedicated = core.dev_props.ApiVersion >= vk.MakeVersion(1, 1, 0)
+	core.address = supports_device_address(physical)
+	return &core
+}
+
+func (core *CoreMemory) MemoryProperties() vk.PhysicalDeviceMemoryProperties {
+	return core.mem_props
+}
+
+func (core *CoreMemory) Limits() vk.PhysicalDeviceLimits {
+	return core.dev_props.Limits
+}
+
+func (core *CoreMemory) AllocateMemory(size uint64, type_index uint32) (vk.DeviceMemory, error) {
+	p_next, release := core.allocate_flags(nil)
+	defer release()
+
+	var device_mem vk.DeviceMemory
+	mem_info := vk.MemoryAllocateInfo{
+		SType:           vk.StructureTypeMemoryAllocateInfo,
+		PNext:           p_next,
+		AllocationSize:  vk.DeviceSize(size),
+		MemoryTypeIndex: type_index,
+	}
+	if res := vk.AllocateMemory(core.handle, &mem_info, nil, &device_mem); res != vk.Success {
+		return device_mem, NewError(res)
+	}
+	return device_mem, nil
+}
+
+//Chains VkMemoryAllocateFlagsInfo with the device address bit in front of next when buffer device addresses are
+//enabled, so any buffer bound to the memory can be addressed. Call release once the memory is allocated
+func (core *CoreMemory) allocate_flags(next unsafe.Pointer) (unsafe.Pointer, func()) {
+	if !core.address {
+		return next, func() {}
+	}
+	flags_info := vk.MemoryAllocateFlagsInfo{
+		SType: vk.StructureTypeMemoryAllocateFlagsInfo,
+		PNext: next,
+		Flags: MEMORY_ALLOCATE_DEVICE_ADDRESS,
+	}
+	p_flags, _ := flags_info.PassRef()
+	return unsafe.Pointer(p_flags), flags_info.Free
+}
+
+func (core *CoreMemory) FreeMemory(memory vk.DeviceMemory) {
+	vk.FreeMemory(core.handle, memory, nil)
+}
+
+func (core *CoreMemory) BindBufferMemory(buffer vk.Buffer, memory vk.DeviceMemory, offset uint64) error {
+	return NewError(vk.BindBufferMemory(core.handle, buffer, memory, vk.DeviceSize(offset)))
+}
+
+func (core *CoreMemory) BindImageMemory(image vk.Image, memory vk.DeviceMemory, offset uint64) error {
+	return NewError(vk.BindImageMemory(core.handle, image, memory, vk.DeviceSize(offset)))
+}
+
+func (core *CoreMemory) MapMemory(memory vk.DeviceMemory, offset uint64, size uint64) (unsafe.Pointer, error) {
+	var p_mem unsafe.Pointer
+	if res := vk.MapMemory(core.handle, memory, vk.DeviceSize(offset), vk.DeviceSize(size), 0, &p_mem); res != vk.Success {
+		return nil, NewError(res)
+	}
+	return p_mem, nil
+}
+
+func (core *CoreMemory) UnmapMemory(memory vk.DeviceMemory) {
+	vk.UnmapMemory(core.handle, memory)
+}
+
+//FlushMemory makes host writes to a mapped range of non-coherent memory visible to the device. The range must be
+//aligned to nonCoherentAtomSize or end at the end of the allocation
+func (core *CoreMemory) FlushMemory(memory vk.DeviceMemory, offset uint64, size uint64) error {
+	ranges := []vk.MappedMemoryRange{{SType: vk.StructureTypeMappedMemoryRange, Memory: memory, Offset: vk.DeviceSize(offset), Size: vk.DeviceSize(size)}}
+	return NewError(vk.FlushMappedMemoryRanges(core.handle, 1, ranges))
+}
+
+//InvalidateMemory makes device writes to a mapped range of non-coherent memory visible to the host, see FlushMemory
+func (core *CoreMemory) InvalidateMemory(memory vk.DeviceMemory, offset uint64, size uint64) error {
+	ranges := []vk.MappedMemoryRange{{SType: vk.StructureTypeMappedMemoryRange, Memory: memory, Offset: vk.DeviceSize(offset), Size: vk.DeviceSize(size)}}
+	return NewError(vk.InvalidateMappedMemoryRanges(core.handle, 1, ranges))
+}
+
+//DedicatedRequirements queries VkMemoryDedicatedRequirements for the buffer, or the image when the buffer is null
+func (core *CoreMemory) DedicatedRequirements(buffer vk.Buffer, image vk.Image) DedicatedRequirements {
+	if !core.dedicated || (buffer == vk.Buffer(vk.NullHandle) && image == vk.NullImage) {
+		return DedicatedRequirements{}
+	}
+	_, dedicated, _ := query_dedicated_requirements(core.handle, buffer, image)
+	return dedicated
+}
+
+//AllocateDedicated allocates memory owned by a single buffer or image. The resource is named to the driver
+//through VkMemoryDedicatedAllocateInfo when it is known
+func (core *CoreMemory) AllocateDedicated(size uint64, type_index uint32, buffer vk.Buffer, image vk.Image) (vk.DeviceMemory, error) {
+	if !core.dedicated || (buffer == vk.Buffer(vk.NullHandle) && image == vk.NullImage) {
+		return core.AllocateMemory(size, type_index)
+	}
+
+	dedicated_info := vk.MemoryDedicatedAllocateInfo{
+		SType:  vk.StructureTypeMemoryDedicatedAllocateInfo,
+		Buffer: buffer,
+		Image:  image,
+	}
+	p_dedicated, _ := dedicated_info.PassRef()
+	defer dedicated_info.Free()
+
+	p_next, release := core.allocate_flags(unsafe.Pointer(p_dedicated))
+	defer release()
+
+	var device_mem vk.DeviceMemory
+	mem_info := vk.MemoryAllocateInfo{
+		SType:           vk.StructureTypeMemoryAllocateInfo,
+		PNext:           p_next,
+		AllocationSize:  vk.DeviceSize(size),
+		MemoryTypeIndex: type_index,
+	}
+	if res := vk.AllocateMemory(core.handle, &mem_info, nil, &device_mem); res != vk.Success {
+		return device_mem, NewError(res)
+	}
+	return device_mem, nil
+}
+
+//HeapBudget queries the per heap budget and process usage through VK_EXT_memory_budget. Returns false when the
+//extension is not available
+func (core *CoreMemory) HeapBudget() ([]MemHeap, bool) {
+	if !core.budget {
+		return nil, false
+	}
+	budget, usage, ok := query_memory_budget(core.physical)
+	if !ok {
+		return nil, false
+	}
+
+	heaps := make([]MemHeap, core.mem_props.MemoryHeapCount)
+	for i := range heaps {
+		heaps[i] = MemHeap{size: uint64(core.mem_props.MemoryHeaps[i].Size), budget: budget[i], usage: usage[i]}
+	}
+	return heaps, true
+}
+
+//FakeMemory is an in-process memory backend. Each device memory handle is the address of a host byte slice
+//so mapped writes land in ordinary Go memory. Memory type 0 is device local, type 1 is host visible and coherent
+//and type 2 is host visible and cached but not coherent. Device local memory has its own heap of heap_size bytes
+//and the host visible types share the other
+type FakeMemory struct {
+	mem_props vk.PhysicalDeviceMemoryProperties
+	limits    vk.PhysicalDeviceLimits
+	blocks    map[vk.DeviceMemory][]byte
+	types     map[vk.DeviceMemory]uint32
+	mapped    map[vk.DeviceMemory]bool
+	dedicated map[unsafe.Pointer]DedicatedRequirements //Key: Buffer or image handle
+	owned     map[vk.DeviceMemory]bool                 //Dedicated allocations
+	usage     []uint64
+	budgets   []uint64 //Reported heap budgets, zero until SetHeapBudget
+	flushed   []MappedRange
+	invalid   []MappedRange
+}
+
+//MappedRange is a flushed or invalidated range of device memory recorded by FakeMemory
+type MappedRange struct {
+	Memory vk.DeviceMemory
+	Offset uint64
+	Size   uint64
+}
+
+func NewFakeMemory(heap_size uint64) *FakeMemory {
+	fake := FakeMemory{}
+	fake.blocks = make(map[vk.DeviceMemory][]byte)
+	fake.types = make(map[vk.DeviceMemory]uint32)
+	fake.mapped = make(map[vk.DeviceMemory]bool)
+	fake.dedicated = make(map[unsafe.Pointer]DedicatedRequirements)
+	fake.owned = make(map[vk.DeviceMemory]bool)
+
+	fake.mem_props.MemoryHeapCount = 2
+	fake.mem_props.MemoryHeaps[0] = vk.MemoryHeap{Size: vk.DeviceSize(heap_size), Flags: vk.MemoryHeapFlags(vk.MemoryHeapDeviceLocalBit)}
+	fake.mem_props.MemoryHeaps[1] = vk.MemoryHeap{Size: vk.DeviceSize(heap_size)}
+	fake.mem_props.MemoryTypeCount = 3
+	fake.mem_props.MemoryTypes[0] = vk.MemoryType{PropertyFlags: vk.MemoryPropertyFlags(vk.MemoryPropertyDeviceLocalBit), HeapIndex: 0}
+	fake.mem_props.MemoryTypes[1] = vk.MemoryType{PropertyFlags: vk.MemoryPropertyFlags(vk.MemoryPropertyHostVisibleBit | vk.MemoryPropertyHostCoherentBit), HeapIndex: 1}
+	fake.mem_props.MemoryTypes[2] = vk.MemoryType{PropertyFlags: vk.MemoryPropertyFlags(vk.MemoryPropertyHostVisibleBit | vk.MemoryPropertyHostCachedBit), HeapIndex: 1}
+	fake.usage = make([]uint64, fake.mem_props.MemoryHeapCount)
+	fake.budgets = make([]uint64, fake.mem_props.MemoryHeapCount)
+
+	fake.limits.BufferImageGranularity = 1024
+	fake.limits.NonCoherentAtomSize = 64
+	fake.limits.MinUniformBufferOffsetAlignment = 256
+	fake.limits.MinStorageBufferOffsetAlignment = 64
+	fake.limits.MinTexelBufferOffsetAlignment = 64
+	return &fake
+}
+
+func (fake *FakeMemory) MemoryProperties() vk.PhysicalDeviceMemoryProperties {
+	return fake.mem_props
+}
+
+func (fake *FakeMemory) Limits() vk.PhysicalDeviceLimits {
+	return fake.limits
+}
+
+func (fake *FakeMemory) AllocateMemory(size uint64, type_index uint32) (vk.DeviceMemory, error) {
+	if type_index >= fake.mem_props.MemoryTypeCount || size == 0 {
+		return vk.DeviceMemory(vk.NullHandle), NewError(vk.ErrorInitializationFailed)
+	}
+	heap := fake.mem_props.MemoryTypes[type_index].HeapIndex
+	if fake.usage[heap]+size > uint64(fake.mem_props.MemoryHeaps[heap].Size) || (fake.budgets[heap] > 0 && fake.usage[heap]+size > fake.budgets[heap]) {
+		return vk.DeviceMemory(vk.NullHandle), NewError(vk.ErrorOutOfDeviceMemory)
+	}
+	data := make([]byte, size)
+	memory := vk.DeviceMemory(unsafe.Pointer(&data[0]))
+	fake.blocks[memory] = data
+	fake.types[memory] = type_index
+	fake.usage[heap] += size
+	return memory, nil
+}
+
+func (fake *FakeMemory) FreeMemory(memory vk.DeviceMemory) {
+	if data, ok := fake.blocks[memory]; ok {
+		heap := fake.mem_props.MemoryTypes[fake.types[memory]].HeapIndex
+		fake.usage[heap] -= uint64(len(data))
+		delete(fake.blocks, memory)
+		delete(fake.types, memory)
+		delete(fake.mapped, memory)
+		delete(fake.owned, memory)
+	}
+}
+
+func (fake *FakeMemory) BindBufferMemory(buffer vk.Buffer, memory vk.DeviceMemory, offset uint64) error {
+	data, ok := fake.blocks[memory]
+	if !ok || offset >= uint64(len(data)) {
+		return fmt.Errorf("FakeMemory: bind offset %d outside of device memory\n", offset)
+	}
+	return nil
+}
+
+func (fake *FakeMemory) BindImageMemory(image vk.Image, memory vk.DeviceMemory, offset uint64) error {
+	data, ok := fake.blocks[memory]
+	if !ok || offset >= uint64(len(data)) {
+		return fmt.Errorf("FakeMemory: bind offset %d outside of device memory\n", offset)
+	}
+	return nil
+}
+
+func (fake *FakeMemory) MapMemory(memory vk.DeviceMemory, offset uint64, size uint64) (unsafe.Pointer, error) {
+	data, ok := fake.blocks[memory]
+	if !ok || offset+size > uint64(len(data)) {
+		return nil, NewError(vk.ErrorMemoryMapFailed)
+	}
+
+	//Vulkan forbids mapping memory which is already host mapped
+	if fake.mapped[memory] {
+		return nil, fmt.Errorf("FakeMemory: device memory is already mapped\n")
+	}
+	fake.mapped[memory] = true
+	return unsafe.Pointer(&data[offset]), nil
+}
+
+func (fake *FakeMemory) UnmapMemory(memory vk.DeviceMemory) {
+	delete(fake.mapped, memory)
+}
+
+//FlushMemory records the range after checking it is valid for vkFlushMappedMemoryRanges
+func (fake *FakeMemory) FlushMemory(memory vk.DeviceMemory, offset uint64, size uint64) error {
+	if err := fake.check_range(memory, offset, size); err != nil {
+		return err
+	}
+	fake.flushed = append(fake.flushed, MappedRange{Memory: memory, Offset: offset, Size: size})
+	return nil
+}
+
+//InvalidateMemory records the range after checking it is valid for vkInvalidateMappedMemoryRanges
+func (fake *FakeMemory) InvalidateMemory(memory vk.DeviceMemory, offset uint64, size uint64) error {
+	if err := fake.check_range(memory, offset, size); err != nil {
+		return err
+	}
+	fake.invalid = append(fake.invalid, MappedRange{Memory: memory, Offset: offset, Size: size})
+	return nil
+}
+
+//Mapped ranges must lie in mapped memory, start on a nonCoherentAtomSize multiple and either span whole atoms or
+//end at the end of the allocation
+func (fake *FakeMemory) check_range(memory vk.DeviceMemory, offset uint64, size uint64) error {
+	atom := uint64(fake.limits.NonCoherentAtomSize)
+	end := uint64(len(fake.blocks[memory]))
+	if !fake.mapped[memory] || offset+size > end {
+		return NewError(vk.ErrorMemoryMapFailed)
+	}
+	if offset%atom != 0 || (size%atom != 0 && offset+size != end) {
+		return fmt.Errorf("FakeMemory: range offset %d size %d is not aligned to the %d byte atom\n", offset, size, atom)
+	}
+	return nil
+}
+
+//Flushed returns the ranges flushed so far
+func (fake *FakeMemory) Flushed() []MappedRange {
+	return fake.flushed
+}
+
+//Invalidated returns the ranges invalidated so far
+func (fake *FakeMemory) Invalidated() []MappedRange {
+	return fake.invalid
+}
+
+//HeapBudget reports the budgets set by SetHeapBudget, acting as a device with VK_EXT_memory_budget once any
+//budget has been set
+func (fake *FakeMemory) HeapBudget() ([]MemHeap, bool) {
+	heaps := make([]MemHeap, fake.mem_props.MemoryHeapCount)
+	enabled := false
+	for i := range heaps {
+		heaps[i] = MemHeap{size: uint64(fake.mem_props.MemoryHeaps[i].Size), budget: fake.budgets[i], usage: fake.usage[i]}
+		if fake.budgets[i] > 0 {
+			enabled = true
+		} else {
+			heaps[i].budget = heaps[i].size
+		}
+	}
+	return heaps, enabled
+}
+
+//DedicatedRequirements returns the requirements set by SetDedicated
+func (fake *FakeMemory) DedicatedRequirements(buffer vk.Buffer, image vk.Image) DedicatedRequirements {
+	if buffer != vk.Buffer(vk.NullHandle) {
+		return fake.dedicated[unsafe.Pointer(buffer)]
+	}
+	return fake.dedicated[unsafe.Pointer(image)]
+}
+
+//AllocateDedicated allocates from the fake heap and records the memory as dedicated
+func (fake *FakeMemory) AllocateDedicated(size uint64, type_index uint32, buffer vk.Buffer, image vk.Image) (vk.DeviceMemory, error) {
+	memory, err := fake.AllocateMemory(size, type_index)
+	if err == nil {
+		fake.owned[memory] = true
+	}
+	return memory, err
+}
+
+//SetDedicated makes the buffer, or the image when the buffer is null, report the dedicated requirements
+func (fake *FakeMemory) SetDedicated(buffer vk.Buffer, image vk.Image, dedicated DedicatedRequirements) {
+	if buffer != vk.Buffer(vk.NullHandle) {
+		fake.dedicated[unsafe.Pointer(buffer)] = dedicated
+		return
+	}
+	fake.dedicated[unsafe.Pointer(image)] = dedicated
+}
+
+//Dedicated returns the number of live dedicated allocations
+func (fake *FakeMemory) Dedicated() int {
+	return len(fake.owned)
+}
+
+//SetHeapBudget limits the heap to budget bytes as if the driver reported it through VK_EXT_memory_budget
+func (fake *FakeMemory) SetHeapBudget(heap int, budget uint64) {
+	fake.budgets[heap] = budget
+}
+
+//Bytes returns the host slice backing a fake device memory handle
+func (fake *FakeMemory) Bytes(memory vk.DeviceMemory) []byte {
+	return fake.blocks[memory]
+}
+
+//Mappings returns the number of device memory allocations currently host mapped
+func (fake *FakeMemory) Mappings() int {
+	return len(fake.mapped)
+}
+
+//Allocated returns the number of bytes currently allocated from the fake heap
+func (fake *FakeMemory) Allocated(heap int) uint64 {
+	return fake.usage[heap]
 }
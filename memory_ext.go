@@ -0,0 +1,261 @@
+//go:build !windows
+// +build !windows
+
+package dieselvk
+
+/*
+#cgo LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+
+#define DIESEL_MAX_MEMORY_HEAPS 16
+#define DIESEL_STRUCTURE_TYPE_MEMORY_PROPERTIES_2 1000059006
+#define DIESEL_STRUCTURE_TYPE_MEMORY_BUDGET_PROPERTIES 1000237000
+#define DIESEL_STRUCTURE_TYPE_BUFFER_MEMORY_REQUIREMENTS_INFO_2 1000146000
+#define DIESEL_STRUCTURE_TYPE_IMAGE_MEMORY_REQUIREMENTS_INFO_2 1000146001
+#define DIESEL_STRUCTURE_TYPE_MEMORY_REQUIREMENTS_2 1000146003
+#define DIESEL_STRUCTURE_TYPE_MEMORY_DEDICATED_REQUIREMENTS 1000127000
+#define DIESEL_STRUCTURE_TYPE_PHYSICAL_DEVICE_FEATURES_2 1000059000
+#define DIESEL_STRUCTURE_TYPE_BUFFER_DEVICE_ADDRESS_FEATURES 1000257000
+#define DIESEL_STRUCTURE_TYPE_BUFFER_DEVICE_ADDRESS_INFO 1000244001
+
+// VkPhysicalDeviceMemoryBudgetPropertiesEXT, not declared by the vulkan-go headers
+typedef struct {
+	int32_t  sType;
+	void*    pNext;
+	uint64_t heapBudget[DIESEL_MAX_MEMORY_HEAPS];
+	uint64_t heapUsage[DIESEL_MAX_MEMORY_HEAPS];
+} diesel_memory_budget;
+
+// VkPhysicalDeviceMemoryProperties2 with the 520 byte VkPhysicalDeviceMemoryProperties kept opaque
+typedef struct {
+	int32_t  sType;
+	void*    pNext;
+	uint64_t memoryProperties[65];
+} diesel_memory_properties2;
+
+// VkBufferMemoryRequirementsInfo2 and VkImageMemoryRequirementsInfo2
+typedef struct {
+	int32_t sType;
+	void*   pNext;
+	void*   handle;
+} diesel_requirements_info2;
+
+typedef struct {
+	int32_t  sType;
+	void*    pNext;
+	uint32_t prefersDedicatedAllocation;
+	uint32_t requiresDedicatedAllocation;
+} diesel_dedicated_requirements;
+
+typedef struct {
+	int32_t  sType;
+	void*    pNext;
+	uint64_t size;
+	uint64_t alignment;
+	uint32_t memoryTypeBits;
+} diesel_memory_requirements2;
+
+// VkPhysicalDeviceBufferDeviceAddressFeaturesKHR
+typedef struct {
+	int32_t  sType;
+	void*    pNext;
+	uint32_t bufferDeviceAddress;
+	uint32_t bufferDeviceAddressCaptureReplay;
+	uint32_t bufferDeviceAddressMultiDevice;
+} diesel_device_address_features;
+
+// VkPhysicalDeviceFeatures2 with the 55 VkBool32 VkPhysicalDeviceFeatures kept opaque
+typedef struct {
+	int32_t  sType;
+	void*    pNext;
+	uint32_t features[55];
+} diesel_features2;
+
+// VkBufferDeviceAddressInfoKHR
+typedef struct {
+	int32_t sType;
+	void*   pNext;
+	void*   buffer;
+} diesel_address_info;
+
+typedef void (*diesel_get_memory_properties2)(void* physical, diesel_memory_properties2* properties);
+typedef void (*diesel_get_memory_requirements2)(void* device, diesel_requirements_info2* info, diesel_memory_requirements2* requirements);
+typedef void (*diesel_get_features2)(void* physical, diesel_features2* features);
+typedef void* (*diesel_get_device_proc_addr)(void* device, const char* name);
+typedef uint64_t (*diesel_get_buffer_device_address)(void* device, diesel_address_info* info);
+
+// Core 1.1 entry points are exported by the Vulkan loader, MoltenVK links them into the binary
+static void* diesel_load_symbol(const char* name) {
+	void* sym = dlsym(RTLD_DEFAULT, name);
+	if (sym == NULL) {
+		void* libvulkan = dlopen("libvulkan.so", RTLD_NOW | RTLD_LOCAL);
+		if (libvulkan == NULL) {
+			return NULL;
+		}
+		sym = dlsym(libvulkan, name);
+	}
+	return sym;
+}
+
+static int diesel_query_memory_budget(void* physical, uint64_t* budget, uint64_t* usage) {
+	static diesel_get_memory_properties2 get_properties = NULL;
+	if (get_properties == NULL) {
+		get_properties = (diesel_get_memory_properties2)diesel_load_symbol("vkGetPhysicalDeviceMemoryProperties2");
+		if (get_properties == NULL) {
+			return 0;
+		}
+	}
+
+	diesel_memory_budget budget_props;
+	diesel_memory_properties2 props;
+	memset(&budget_props, 0, sizeof(budget_props));
+	memset(&props, 0, sizeof(props));
+	budget_props.sType = DIESEL_STRUCTURE_TYPE_MEMORY_BUDGET_PROPERTIES;
+	props.sType = DIESEL_STRUCTURE_TYPE_MEMORY_PROPERTIES_2;
+	props.pNext = &budget_props;
+	get_properties(physical, &props);
+
+	memcpy(budget, budget_props.heapBudget, sizeof(budget_props.heapBudget));
+	memcpy(usage, budget_props.heapUsage, sizeof(budget_props.heapUsage));
+	return 1;
+}
+
+static int diesel_query_dedicated(void* device, void* buffer, void* image, uint64_t* size, uint64_t* alignment, uint32_t* type_bits, uint32_t* prefers, uint32_t* requires) {
+	static diesel_get_memory_requirements2 get_buffer = NULL;
+	static diesel_get_memory_requirements2 get_image = NULL;
+	if (get_buffer == NULL || get_image == NULL) {
+		get_buffer = (diesel_get_memory_requirements2)diesel_load_symbol("vkGetBufferMemoryRequirements2");
+		get_image = (diesel_get_memory_requirements2)diesel_load_symbol("vkGetImageMemoryRequirements2");
+		if (get_buffer == NULL || get_image == NULL) {
+			return 0;
+		}
+	}
+
+	diesel_dedicated_requirements dedicated;
+	diesel_memory_requirements2 requirements;
+	diesel_requirements_info2 info;
+	memset(&dedicated, 0, sizeof(dedicated));
+	memset(&requirements, 0, sizeof(requirements));
+	memset(&info, 0, sizeof(info));
+	dedicated.sType = DIESEL_STRUCTURE_TYPE_MEMORY_DEDICATED_REQUIREMENTS;
+	requirements.sType = DIESEL_STRUCTURE_TYPE_MEMORY_REQUIREMENTS_2;
+	requirements.pNext = &dedicated;
+
+	if (buffer != NULL) {
+		info.sType = DIESEL_STRUCTURE_TYPE_BUFFER_MEMORY_REQUIREMENTS_INFO_2;
+		info.handle = buffer;
+		get_buffer(device, &info, &requirements);
+	} else {
+		info.sType = DIESEL_STRUCTURE_TYPE_IMAGE_MEMORY_REQUIREMENTS_INFO_2;
+		info.handle = image;
+		get_image(device, &info, &requirements);
+	}
+
+	*size = requirements.size;
+	*alignment = requirements.alignment;
+	*type_bits = requirements.memoryTypeBits;
+	*prefers = dedicated.prefersDedicatedAllocation;
+	*requires = dedicated.requiresDedicatedAllocation;
+	return 1;
+}
+
+static int diesel_query_device_address(void* physical) {
+	static diesel_get_features2 get_features = NULL;
+	if (get_features == NULL) {
+		get_features = (diesel_get_features2)diesel_load_symbol("vkGetPhysicalDeviceFeatures2");
+		if (get_features == NULL) {
+			return 0;
+		}
+	}
+
+	diesel_device_address_features address;
+	diesel_features2 features;
+	memset(&address, 0, sizeof(address));
+	memset(&features, 0, sizeof(features));
+	address.sType = DIESEL_STRUCTURE_TYPE_BUFFER_DEVICE_ADDRESS_FEATURES;
+	features.sType = DIESEL_STRUCTURE_TYPE_PHYSICAL_DEVICE_FEATURES_2;
+	features.pNext = &address;
+	get_features(physical, &features);
+	return address.bufferDeviceAddress != 0;
+}
+
+// Chained into VkDeviceCreateInfo so it must outlive the Go call, released with free()
+static void* diesel_device_address_features_alloc() {
+	diesel_device_address_features* address = calloc(1, sizeof(diesel_device_address_features));
+	address->sType = DIESEL_STRUCTURE_TYPE_BUFFER_DEVICE_ADDRESS_FEATURES;
+	address->bufferDeviceAddress = 1;
+	return address;
+}
+
+// The KHR entry point is only reachable through vkGetDeviceProcAddr, Vulkan 1.2 devices also expose the core name
+static uint64_t diesel_buffer_device_address(void* device, void* buffer) {
+	static diesel_get_device_proc_addr get_proc = NULL;
+	if (get_proc == NULL) {
+		get_proc = (diesel_get_device_proc_addr)diesel_load_symbol("vkGetDeviceProcAddr");
+		if (get_proc == NULL) {
+			return 0;
+		}
+	}
+	diesel_get_buffer_device_address get_address = (diesel_get_buffer_device_address)get_proc(device, "vkGetBufferDeviceAddressKHR");
+	if (get_address == NULL) {
+		get_address = (diesel_get_buffer_device_address)get_proc(device, "vkGetBufferDeviceAddress");
+		if (get_address == NULL) {
+			return 0;
+		}
+	}
+
+	diesel_address_info info;
+	memset(&info, 0, sizeof(info));
+	info.sType = DIESEL_STRUCTURE_TYPE_BUFFER_DEVICE_ADDRESS_INFO;
+	info.buffer = buffer;
+	return get_address(device, &info);
+}
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	vk "github.com/vulkan-go/vulkan"
+)
+
+//Queries the heap budgets and process heap usage of the physical device through VK_EXT_memory_budget. The
+//extension must be enabled on the logical device
+func query_memory_budget(physical vk.PhysicalDevice) ([vk.MaxMemoryHeaps]uint64, [vk.MaxMemoryHeaps]uint64, bool) {
+	var budget, usage [vk.MaxMemoryHeaps]uint64
+	ok := C.diesel_query_memory_budget(unsafe.Pointer(physical), (*C.uint64_t)(&budget[0]), (*C.uint64_t)(&usage[0]))
+	return budget, usage, ok != 0
+}
+
+//Queries the memory requirements of the buffer, or of the image when buffer is null, through
+//vkGet*MemoryRequirements2 with a chained VkMemoryDedicatedRequirements
+func query_dedicated_requirements(handle vk.Device, buffer vk.Buffer, image vk.Image) (vk.MemoryRequirements, DedicatedRequirements, bool) {
+	var size, alignment C.uint64_t
+	var type_bits, prefers, requires C.uint32_t
+	ok := C.diesel_query_dedicated(unsafe.Pointer(handle), unsafe.Pointer(buffer), unsafe.Pointer(image), &size, &alignment, &type_bits, &prefers, &requires)
+	reqs := vk.MemoryRequirements{Size: vk.DeviceSize(size), Alignment: vk.DeviceSize(alignment), MemoryTypeBits: uint32(type_bits)}
+	return reqs, DedicatedRequirements{Prefers: prefers != 0, Requires: requires != 0}, ok != 0
+}
+
+//Queries the bufferDeviceAddress feature of VK_KHR_buffer_device_address through vkGetPhysicalDeviceFeatures2
+func query_device_address(physical vk.PhysicalDevice) bool {
+	return C.diesel_query_device_address(unsafe.Pointer(physical)) != 0
+}
+
+//Returns a VkPhysicalDeviceBufferDeviceAddressFeaturesKHR enabling the feature for the VkDeviceCreateInfo pNext chain,
+//release it with free_device_address_features once the device is created
+func device_address_features() unsafe.Pointer {
+	return C.diesel_device_address_features_alloc()
+}
+
+func free_device_address_features(features unsafe.Pointer) {
+	C.free(features)
+}
+
+//Queries the GPU address of a buffer bound to memory allocated with VK_MEMORY_ALLOCATE_DEVICE_ADDRESS_BIT
+func buffer_device_address(handle vk.Device, buffer vk.Buffer) uint64 {
+	return uint64(C.diesel_buffer_device_address(unsafe.Pointer(handle), unsafe.Pointer(buffer)))
+}
@@ -0,0 +1,38 @@
+//go:build windows
+// +build windows
+
+package dieselvk
+
+import (
+	"unsafe"
+
+	vk "github.com/vulkan-go/vulkan"
+)
+
+//The budget query is not loaded on Windows so heaps fall back to the allocator's own tracking
+func query_memory_budget(physical vk.PhysicalDevice) ([vk.MaxMemoryHeaps]uint64, [vk.MaxMemoryHeaps]uint64, bool) {
+	var budget, usage [vk.MaxMemoryHeaps]uint64
+	return budget, usage, false
+}
+
+//Dedicated requirements are not queried on Windows, resources above the dedicated threshold still get their own
+//allocation
+func query_dedicated_requirements(handle vk.Device, buffer vk.Buffer, image vk.Image) (vk.MemoryRequirements, DedicatedRequirements, bool) {
+	return vk.MemoryRequirements{}, DedicatedRequirements{}, false
+}
+
+//Buffer device addresses are not loaded on Windows so the feature is never enabled
+func query_device_address(physical vk.PhysicalDevice) bool {
+	return false
+}
+
+func device_address_features() unsafe.Pointer {
+	return nil
+}
+
+func free_device_address_features(features unsafe.Pointer) {
+}
+
+func buffer_device_address(handle vk.Device, buffer vk.Buffer) uint64 {
+	return 0
+}
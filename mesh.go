@@ -1,6 +1,10 @@
 package dieselvk
 
 import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
 	"unsafe"
 
 	vk "github.com/vulkan-go/vulkan"
@@ -50,3 +54,266 @@ func (v Vertex) GetInputDescription() *VertexInputDescription {
 	vertex.attributes[0] = p_attr
 	return &vertex
 }
+
+//Bindings returns the vertex buffer binding descriptions
+func (v *VertexInputDescription) Bindings() []vk.VertexInputBindingDescription {
+	return v.bindings
+}
+
+//Attributes returns the vertex attribute descriptions
+func (v *VertexInputDescription) Attributes() []vk.VertexInputAttributeDescription {
+	return v.attributes
+}
+
+/*
+VertexLayout is a VertexAttribute reflected from Go structs, each VertexBinding struct describes one vertex buffer
+binding and its fields are the attributes. The stride is the Go size of the struct and attribute offsets are the Go
+field offsets, so slices of the struct upload as is with AsBytes. Fields are tagged with the shader location and
+the Vulkan format name:
+
+	type StdMesh struct {
+		Position [3]float32 `vk:"location=0,format=R32G32B32_SFLOAT"`
+		Normal   [3]float32 `vk:"location=1"`
+		UV       [2]float32 `vk:"format=R32G32_SFLOAT"`
+		Color    [4]uint8   `vk:"format=R8G8B8A8_UNORM"`
+		Padding  uint32     `vk:"-"`
+	}
+
+Untagged options are inferred, the location follows the previous attribute and the format follows the field type,
+float32 and [N]float32 as SFLOAT, int32 and uint32 as SINT and UINT, float64 as 64 bit SFLOAT and [N]uint8 as
+UNORM. Fields tagged "-" are padding. Formats must be the byte size of their field and locations unique across the
+bindings.
+*/
+type VertexLayout struct {
+	description VertexInputDescription
+}
+
+//VertexBinding is one vertex buffer binding of a VertexLayout
+type VertexBinding struct {
+	Prototype interface{} //Struct value or pointer whose fields are the attributes
+	Instanced bool        //Advances once per instance rather than once per vertex
+}
+
+//VertexStream is the data of one binding of a VertexLayout, each stream is drawn from its own vertex buffer
+type VertexStream struct {
+	Vertices  interface{} //Slice of tagged vertex structs, the element type is the binding prototype
+	Instanced bool        //Advances once per instance rather than once per vertex
+}
+
+//Vulkan vertex format with the byte size of one attribute
+type VertexFormat struct {
+	format vk.Format
+	size   uintptr
+}
+
+//Vertex formats accepted by the format tag option, with or without the VK_FORMAT_ prefix
+var vertex_formats = map[string]VertexFormat{
+	"R32_SFLOAT":               {vk.FormatR32Sfloat, 4},
+	"R32G32_SFLOAT":            {vk.FormatR32g32Sfloat, 8},
+	"R32G32B32_SFLOAT":         {vk.FormatR32g32b32Sfloat, 12},
+	"R32G32B32A32_SFLOAT":      {vk.FormatR32g32b32a32Sfloat, 16},
+	"R32_SINT":                 {vk.FormatR32Sint, 4},
+	"R32G32_SINT":              {vk.FormatR32g32Sint, 8},
+	"R32G32B32_SINT":           {vk.FormatR32g32b32Sint, 12},
+	"R32G32B32A32_SINT":        {vk.FormatR32g32b32a32Sint, 16},
+	"R32_UINT":                 {vk.FormatR32Uint, 4},
+	"R32G32_UINT":              {vk.FormatR32g32Uint, 8},
+	"R32G32B32_UINT":           {vk.FormatR32g32b32Uint, 12},
+	"R32G32B32A32_UINT":        {vk.FormatR32g32b32a32Uint, 16},
+	"R64_SFLOAT":               {vk.FormatR64Sfloat, 8},
+	"R64G64_SFLOAT":            {vk.FormatR64g64Sfloat, 16},
+	"R64G64B64_SFLOAT":         {vk.FormatR64g64b64Sfloat, 24},
+	"R64G64B64A64_SFLOAT":      {vk.FormatR64g64b64a64Sfloat, 32},
+	"R16G16_SFLOAT":            {vk.FormatR16g16Sfloat, 4},
+	"R16G16B16A16_SFLOAT":      {vk.FormatR16g16b16a16Sfloat, 8},
+	"R16G16_UNORM":             {vk.FormatR16g16Unorm, 4},
+	"R16G16B16A16_UNORM":       {vk.FormatR16g16b16a16Unorm, 8},
+	"R16G16_SNORM":             {vk.FormatR16g16Snorm, 4},
+	"R16G16B16A16_SNORM":       {vk.FormatR16g16b16a16Snorm, 8},
+	"R8_UNORM":                 {vk.FormatR8Unorm, 1},
+	"R8G8_UNORM":               {vk.FormatR8g8Unorm, 2},
+	"R8G8B8A8_UNORM":           {vk.FormatR8g8b8a8Unorm, 4},
+	"R8G8B8A8_SNORM":           {vk.FormatR8g8b8a8Snorm, 4},
+	"R8G8B8A8_UINT":            {vk.FormatR8g8b8a8Uint, 4},
+	"R8G8B8A8_SINT":            {vk.FormatR8g8b8a8Sint, 4},
+	"B8G8R8A8_UNORM":           {vk.FormatB8g8r8a8Unorm, 4},
+	"A2B10G10R10_UNORM_PACK32": {vk.FormatA2b10g10r10UnormPack32, 4},
+	"A2B10G10R10_SNORM_PACK32": {vk.FormatA2b10g10r10SnormPack32, 4},
+}
+
+//Reflects the layout of the streams, stream i is binding i, and returns the bytes of each stream with the vertex
+//count of the shortest per vertex stream and the instance count of the shortest instanced stream
+func stream_data(streams []VertexStream) (*VertexLayout, [][]byte, uint32, uint32, error) {
+	if len(streams) == 0 {
+		return nil, nil, 0, 0, fmt.Errorf("Vertex data needs at least one vertex stream\n")
+	}
+	bindings := make([]VertexBinding, len(streams))
+	data := make([][]byte, len(streams))
+	vertices, instances := uint32(0), uint32(0)
+	for i, stream := range streams {
+		bytes, elem, count, err := SliceBytes(stream.Vertices)
+		if err != nil {
+			return nil, nil, 0, 0, err
+		}
+		if count == 0 {
+			return nil, nil, 0, 0, fmt.Errorf("Vertex stream %d is empty\n", i)
+		}
+		bindings[i] = VertexBinding{Prototype: reflect.Zero(elem).Interface(), Instanced: stream.Instanced}
+		data[i] = bytes
+		if stream.Instanced && (instances == 0 || uint32(count) < instances) {
+			instances = uint32(count)
+		} else if !stream.Instanced && (vertices == 0 || uint32(count) < vertices) {
+			vertices = uint32(count)
+		}
+	}
+	if vertices == 0 {
+		return nil, nil, 0, 0, fmt.Errorf("Vertex data needs at least one per vertex stream\n")
+	}
+	if instances == 0 {
+		instances = 1
+	}
+	layout, err := NewVertexLayout(bindings...)
+	return layout, data, vertices, instances, err
+}
+
+//NewVertexLayout reflects the vertex input description of the bindings, binding i is the ith vertex buffer
+func NewVertexLayout(bindings ...VertexBinding) (*VertexLayout, error) {
+	layout := VertexLayout{}
+	layout.description.bindings = make([]vk.VertexInputBindingDescription, 0, len(bindings))
+	layout.description.attributes = make([]vk.VertexInputAttributeDescription, 0)
+	layout.description.flags = vk.PipelineVertexInputStateCreateFlags(0)
+
+	locations := make(map[uint32]string)
+	location := uint32(0)
+	for index, binding := range bindings {
+		t := reflect.TypeOf(binding.Prototype)
+		if t != nil && t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t == nil || t.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("NewVertexLayout() binding %d prototype must be a struct, got %T\n", index, binding.Prototype)
+		}
+
+		rate := vk.VertexInputRateVertex
+		if binding.Instanced {
+			rate = vk.VertexInputRateInstance
+		}
+		layout.description.bindings = append(layout.description.bindings, vk.VertexInputBindingDescription{
+			Binding:   uint32(index),
+			Stride:    uint32(t.Size()),
+			InputRate: rate,
+		})
+
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("vk")
+			if tag == "-" {
+				continue
+			}
+			attribute, err := vertex_attribute(field, tag, location)
+			if err != nil {
+				return nil, err
+			}
+			if other, ok := locations[attribute.Location]; ok {
+				return nil, fmt.Errorf("NewVertexLayout() %s.%s reuses location %d of %s\n", t.Name(), field.Name, attribute.Location, other)
+			}
+			locations[attribute.Location] = t.Name() + "." + field.Name
+			attribute.Binding = uint32(index)
+			layout.description.attributes = append(layout.description.attributes, attribute)
+			location = attribute.Location + vertex_locations(attribute.Format)
+		}
+	}
+	return &layout, nil
+}
+
+//GetInputDescription returns the reflected description for PipelineBuilder
+func (layout *VertexLayout) GetInputDescription() *VertexInputDescription {
+	description := layout.description
+	return &description
+}
+
+//Parses the vk tag of a field into an attribute at the next free location unless the tag names one
+func vertex_attribute(field reflect.StructField, tag string, location uint32) (vk.VertexInputAttributeDescription, error) {
+	attribute := vk.VertexInputAttributeDescription{Location: location, Offset: uint32(field.Offset)}
+	format, inferred := infer_vertex_format(field.Type)
+	for _, option := range strings.Split(tag, ",") {
+		if option == "" {
+			continue
+		}
+		key, value, found := strings.Cut(option, "=")
+		if !found {
+			return attribute, fmt.Errorf("Vertex field %s option %s is not key=value\n", field.Name, option)
+		}
+		switch strings.TrimSpace(key) {
+		case "location":
+			index, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+			if err != nil {
+				return attribute, fmt.Errorf("Vertex field %s location %s is not a number\n", field.Name, value)
+			}
+			attribute.Location = uint32(index)
+		case "format":
+			name := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(value)), "VK_FORMAT_")
+			named, ok := vertex_formats[name]
+			if !ok {
+				return attribute, fmt.Errorf("Vertex field %s format %s is not a known vertex format\n", field.Name, value)
+			}
+			format, inferred = named, true
+		default:
+			return attribute, fmt.Errorf("Vertex field %s has unknown option %s\n", field.Name, key)
+		}
+	}
+
+	if !inferred {
+		return attribute, fmt.Errorf("Vertex field %s of type %s needs a format option\n", field.Name, field.Type)
+	}
+	if format.size != field.Type.Size() {
+		return attribute, fmt.Errorf("Vertex field %s is %d bytes but its format is %d bytes\n", field.Name, field.Type.Size(), format.size)
+	}
+	attribute.Format = format.format
+	return attribute, nil
+}
+
+//Vertex format of a scalar or a 1 to 4 component array field
+func infer_vertex_format(t reflect.Type) (VertexFormat, bool) {
+	count := 1
+	if t.Kind() == reflect.Array {
+		count = t.Len()
+		t = t.Elem()
+	}
+	if count < 1 || count > 4 {
+		return VertexFormat{}, false
+	}
+	components := []string{"R", "G", "B", "A"}
+	channels := func(bits string) string {
+		name := ""
+		for _, c := range components[:count] {
+			name += c + bits
+		}
+		return name
+	}
+
+	name := ""
+	switch t.Kind() {
+	case reflect.Float32:
+		name = channels("32") + "_SFLOAT"
+	case reflect.Float64:
+		name = channels("64") + "_SFLOAT"
+	case reflect.Int32:
+		name = channels("32") + "_SINT"
+	case reflect.Uint32:
+		name = channels("32") + "_UINT"
+	case reflect.Uint8:
+		name = channels("8") + "_UNORM"
+	}
+	format, ok := vertex_formats[name]
+	return format, ok
+}
+
+//Shader input locations consumed by an attribute, 64 bit three and four component vectors take two
+func vertex_locations(format vk.Format) uint32 {
+	switch format {
+	case vk.FormatR64g64b64Sfloat, vk.FormatR64g64b64a64Sfloat:
+		return 2
+	}
+	return 1
+}
@@ -1,6 +1,8 @@
 package dieselvk
 
 import (
+	"sync"
+
 	vk "github.com/vulkan-go/vulkan"
 )
 
@@ -10,6 +12,7 @@ type CoreQueue struct {
 	properties []vk.QueueFamilyProperties
 	gpu        *vk.PhysicalDevice
 	queues     []vk.Queue
+	locks      []sync.Mutex //Queue access is externally synchronized per family
 }
 
 //List queue properties available for a physical device and enable queue creation
@@ -21,6 +24,7 @@ func NewCoreQueue(gpu vk.PhysicalDevice, device_name string) *CoreQueue {
 	q.properties = make([]vk.QueueFamilyProperties, count)
 	q.binded = make([]bool, count)
 	q.queues = make([]vk.Queue, count)
+	q.locks = make([]sync.Mutex, count)
 	vk.GetPhysicalDeviceQueueFamilyProperties(gpu, &count, q.properties)
 
 	if count == 0 {
@@ -141,3 +145,39 @@ func (q *CoreQueue) BindGraphicsQueue(device vk.Device) (bool, *vk.Queue, int) {
 func (q *CoreQueue) IsBound(index int) bool {
 	return q.binded[index]
 }
+
+//Function to gather a transfer capable queue. Graphics and compute families always support transfer so the first
+//family reporting any of the three is returned
+func (q *CoreQueue) BindTransferQueue(device vk.Device) (bool, *vk.Queue, int) {
+	transfer := vk.QueueFlags(vk.QueueTransferBit | vk.QueueGraphicsBit | vk.QueueComputeBit)
+	for index := 0; index < len(q.properties); index++ {
+		queue := q.properties[index]
+		queue.Deref()
+		if queue.QueueFlags&transfer != 0 {
+			return true, &q.queues[index], index
+		}
+	}
+	return false, nil, 0
+}
+
+//Submit submits to the family queue while holding the family lock so background submissions such as
+//allocator compaction can share the queue with the render loop
+func (q *CoreQueue) Submit(family int, submits []vk.SubmitInfo, fence vk.Fence) vk.Result {
+	q.locks[family].Lock()
+	defer q.locks[family].Unlock()
+	return vk.QueueSubmit(q.queues[family], uint32(len(submits)), submits, fence)
+}
+
+//Present presents on the family queue while holding the family lock
+func (q *CoreQueue) Present(family int, present_info *vk.PresentInfo) vk.Result {
+	q.locks[family].Lock()
+	defer q.locks[family].Unlock()
+	return vk.QueuePresent(q.queues[family], present_info)
+}
+
+//WaitIdle waits for the family queue to drain while holding the family lock
+func (q *CoreQueue) WaitIdle(family int) vk.Result {
+	q.locks[family].Lock()
+	defer q.locks[family].Unlock()
+	return vk.QueueWaitIdle(q.queues[family])
+}
@@ -0,0 +1,360 @@
+package dieselvk
+
+import (
+	"fmt"
+	"unsafe"
+
+	vk "github.com/vulkan-go/vulkan"
+)
+
+/*
+CoreStageAllocator places buffers in dedicated GPU memory and fills them through a host visible staging ring.
+Upload copies the data into the persistently mapped ring and records a buffer copy on a transfer capable queue.
+Every submission is guarded by a fence and the ring space is reclaimed once the fence has signaled. When the
+device local pool cannot hold a buffer it falls back to host visible pages which are written directly.
+*/
+const (
+	STAGE_ALLOCATOR_SIZE = 1 << 20 //Default staging ring bytes
+)
+
+//StageUpload is an in flight copy out of the staging ring
+type StageUpload struct {
+	id      uint64
+	offset  uint64
+	size    uint64
+	fence   vk.Fence
+	command vk.CommandBuffer
+	dst     MemRef
+}
+
+//StageRef references a staged allocation and the upload filling it. Host visible fallbacks have no upload and
+//are resident immediately
+type StageRef struct {
+	ref    MemRef
+	upload uint64
+}
+
+//Ref returns the allocator reference of the destination memory
+func (ref StageRef) Ref() MemRef {
+	return ref.ref
+}
+
+type CoreStageAllocator struct {
+	allocator *CoreAllocator
+	backend   MemoryBackend
+	handle    vk.Device
+	queues    *CoreQueue
+	family    int
+	pool      *CorePool
+	staging   *CoreBuffer
+	page      MemPage
+	mem_index uint32 //Memory type of the staging ring, flushed after writes when non-coherent
+	mapped    unsafe.Pointer
+	ring_size uint64
+	head      uint64
+	uploads   []StageUpload //Submission ordered in flight uploads
+	next_id   uint64
+}
+
+//NewCoreStageAllocator creates a staging ring of staging_size bytes whose copies are recorded on a transfer
+//capable queue. Destination memory is allocated from the shared allocator
+func NewCoreStageAllocator(physical vk.PhysicalDevice, handle vk.Device, allocator *CoreAllocator, queues *CoreQueue, staging_size uint64) (*CoreStageAllocator, error) {
+	found, _, family := queues.BindTransferQueue(handle)
+	if !found {
+		return nil, fmt.Errorf("No transfer capable device queue found\n")
+	}
+
+	staging := NewLayoutBuffer(handle, physical, uint32(staging_size), int32(vk.BufferUsageTransferSrcBit))
+	core, err := new_stage_allocator(allocator, staging_size, uint64(staging.reqs.Size), staging.reqs.MemoryTypeBits)
+	if err != nil {
+		staging.Destroy(handle)
+		return core, err
+	}
+	core.handle = handle
+	core.queues = queues
+	core.family = family
+	core.staging = staging
+
+	if err := core.backend.BindBufferMemory(staging.buffer[0], core.page.device_mem, 0); err != nil {
+		core.Destroy()
+		return core, err
+	}
+
+	if core.pool, err = NewCorePool(&core.handle, uint32(family)); err != nil {
+		core.Destroy()
+		return core, err
+	}
+	return core, nil
+}
+
+//NewCoreStageAllocatorWithBackend creates the staging ring without a device. Uploads are copied into the
+//destination memory on the host when they are retired, used to drive the allocator from a FakeMemory backend
+func NewCoreStageAllocatorWithBackend(allocator *CoreAllocator, staging_size uint64) (*CoreStageAllocator, error) {
+	return new_stage_allocator(allocator, staging_size, staging_size, ^uint32(0))
+}
+
+func new_stage_allocator(allocator *CoreAllocator, staging_size uint64, mem_size uint64, type_bits uint32) (*CoreStageAllocator, error) {
+	core := CoreStageAllocator{allocator: allocator, backend: allocator.backend, ring_size: staging_size}
+	core.uploads = make([]StageUpload, 0)
+	core.next_id = 1
+	if staging_size == 0 {
+		return &core, fmt.Errorf("Stage allocator requires a non empty staging ring\n")
+	}
+
+	//The memory type must be one the staging buffer can be bound to
+	mem_index, err := host_memory_type(core.backend.MemoryProperties(), type_bits)
+	if err != nil {
+		return &core, err
+	}
+	core.mem_index = mem_index
+	device_mem, err := core.backend.AllocateMemory(mem_size, mem_index)
+	if err != nil {
+		return &core, err
+	}
+	core.page = MemPage{device_mem: device_mem, size: mem_size}
+
+	//Persistently map the staging ring
+	if core.mapped, err = core.backend.MapMemory(device_mem, 0, mem_size); err != nil {
+		core.backend.FreeMemory(device_mem)
+		return &core, err
+	}
+	return &core, nil
+}
+
+//Upload allocates device local memory for the buffer, binds it and stages data into it. Falls back to host
+//visible memory when no device local memory is available
+func (core *CoreStageAllocator) Upload(buffer vk.Buffer, reqs vk.MemoryRequirements, data []byte) (StageRef, error) {
+	if len(data) == 0 || uint64(len(data)) > uint64(reqs.Size) {
+		return StageRef{}, fmt.Errorf("Upload() %d bytes does not fit buffer of %d bytes\n", len(data), reqs.Size)
+	}
+
+	ref, err := core.allocator.AllocateBuffer(buffer, reqs, MEMORY_DEVICE_LOCAL)
+	if err != nil {
+		if ref, err = core.allocator.AllocateBuffer(buffer, reqs, MEMORY_HOST_VISIBLE); err != nil {
+			return StageRef{}, err
+		}
+	}
+
+	if err := core.allocator.Bind(buffer, ref); err != nil {
+		core.allocator.Free(ref)
+		return StageRef{}, err
+	}
+
+	//Host visible fallback pages are written in place
+	if match_memory_desired(int32(ref.mem_type), core.allocator.MemoryType(ref), int32(vk.MemoryPropertyHostVisibleBit)) {
+		if err := core.allocator.Write(ref, 0, data); err != nil {
+			core.allocator.Free(ref)
+			return StageRef{}, err
+		}
+		return StageRef{ref: ref}, nil
+	}
+
+	offset, err := core.reserve(uint64(len(data)))
+	if err != nil {
+		core.allocator.Free(ref)
+		return StageRef{}, err
+	}
+	copy(unsafe.Slice((*byte)(unsafe.Add(core.mapped, offset)), len(data)), data)
+	if err := core.allocator.flush(core.mem_index, core.page.device_mem, core.page.size, offset, uint64(len(data))); err != nil {
+		core.allocator.Free(ref)
+		return StageRef{}, err
+	}
+
+	upload := StageUpload{id: core.next_id, offset: offset, size: uint64(len(data)), dst: ref}
+	if err := core.submit(&upload, buffer); err != nil {
+		core.allocator.Free(ref)
+		return StageRef{}, err
+	}
+	core.next_id++
+	core.head = offset + upload.size
+	core.uploads = append(core.uploads, upload)
+	return StageRef{ref: ref, upload: upload.id}, nil
+}
+
+//Records and submits the copy from the staging ring into the destination buffer
+func (core *CoreStageAllocator) submit(upload *StageUpload, buffer vk.Buffer) error {
+	if core.handle == nil {
+		return nil
+	}
+
+	commands := make([]vk.CommandBuffer, 1)
+	res := vk.AllocateCommandBuffers(core.handle, &vk.CommandBufferAllocateInfo{
+		SType:              vk.StructureTypeCommandBufferAllocateInfo,
+		CommandPool:        core.pool.pool,
+		Level:              vk.CommandBufferLevelPrimary,
+		CommandBufferCount: uint32(1),
+	}, commands)
+	if res != vk.Success {
+		return NewError(res)
+	}
+
+	vk.BeginCommandBuffer(commands[0], &vk.CommandBufferBeginInfo{
+		SType: vk.StructureTypeCommandBufferBeginInfo,
+		Flags: vk.CommandBufferUsageFlags(vk.CommandBufferUsageOneTimeSubmitBit),
+	})
+	vk.CmdCopyBuffer(commands[0], core.staging.buffer[0], buffer, 1, []vk.BufferCopy{{
+		SrcOffset: vk.DeviceSize(upload.offset),
+		DstOffset: 0,
+		Size:      vk.DeviceSize(upload.size),
+	}})
+	vk.EndCommandBuffer(commands[0])
+
+	var fence vk.Fence
+	vk.CreateFence(core.handle, &vk.FenceCreateInfo{SType: vk.StructureTypeFenceCreateInfo}, nil, &fence)
+
+	submit_info := vk.SubmitInfo{
+		SType:              vk.StructureTypeSubmitInfo,
+		CommandBufferCount: 1,
+		PCommandBuffers:    commands,
+	}
+	if res := core.queues.Submit(core.family, []vk.SubmitInfo{submit_info}, fence); res != vk.Success {
+		vk.DestroyFence(core.handle, fence, nil)
+		vk.FreeCommandBuffers(core.handle, core.pool.pool, 1, commands)
+		return NewError(res)
+	}
+
+	upload.fence = fence
+	upload.command = commands[0]
+	return nil
+}
+
+//Finds size contiguous bytes in the ring, retiring and if needed waiting on the oldest uploads to make room
+func (core *CoreStageAllocator) reserve(size uint64) (uint64, error) {
+	if size > core.ring_size {
+		return 0, fmt.Errorf("Upload() %d bytes exceeds staging ring of %d bytes\n", size, core.ring_size)
+	}
+
+	for {
+		if err := core.retire(); err != nil {
+			return 0, err
+		}
+		if offset, ok := core.fit(size); ok {
+			return offset, nil
+		}
+		if err := core.wait(core.uploads[0]); err != nil {
+			return 0, err
+		}
+	}
+}
+
+//Free space in the ring is [head, ring_size) and [0, tail) while the ring has not wrapped and [head, tail) once
+//it has, where tail is the offset of the oldest in flight upload
+func (core *CoreStageAllocator) fit(size uint64) (uint64, bool) {
+	if len(core.uploads) == 0 {
+		core.head = 0
+		return 0, true
+	}
+
+	tail := core.uploads[0].offset
+	if core.head > tail {
+		if core.head+size <= core.ring_size {
+			return core.head, true
+		}
+		return 0, size <= tail
+	}
+	return core.head, core.head+size <= tail
+}
+
+//Retires the uploads at the front of the ring whose fences have signaled. A failed host transfer is returned and
+//its upload stays in flight
+func (core *CoreStageAllocator) retire() error {
+	for len(core.uploads) > 0 {
+		upload := core.uploads[0]
+		if core.handle != nil {
+			if vk.GetFenceStatus(core.handle, upload.fence) != vk.Success {
+				return nil
+			}
+			vk.DestroyFence(core.handle, upload.fence, nil)
+			vk.FreeCommandBuffers(core.handle, core.pool.pool, 1, []vk.CommandBuffer{upload.command})
+		} else {
+			//Backend only allocators perform the transfer on the host
+			if err := core.allocator.host_transfer(upload.dst, 0, unsafe.Slice((*byte)(unsafe.Add(core.mapped, upload.offset)), upload.size)); err != nil {
+				return fmt.Errorf("Failed to retire staged upload %d %s\n", upload.id, err)
+			}
+		}
+		core.uploads = core.uploads[1:]
+	}
+	return nil
+}
+
+//Blocks until the upload fence signals then retires completed uploads
+func (core *CoreStageAllocator) wait(upload StageUpload) error {
+	if core.handle != nil {
+		res := vk.WaitForFences(core.handle, 1, []vk.Fence{upload.fence}, vk.True, vk.MaxUint64)
+		if res != vk.Success {
+			return NewError(res)
+		}
+	}
+	return core.retire()
+}
+
+//Returns the in flight upload with the given id
+func (core *CoreStageAllocator) pending(id uint64) (StageUpload, bool) {
+	for _, upload := range core.uploads {
+		if upload.id == id {
+			return upload, true
+		}
+	}
+	return StageUpload{}, false
+}
+
+//Resident reports whether the staged data has reached the destination memory
+func (core *CoreStageAllocator) Resident(ref StageRef) bool {
+	err := core.retire()
+	upload, ok := core.pending(ref.upload)
+	if !ok {
+		return true
+	}
+	return err == nil && core.handle != nil && vk.GetFenceStatus(core.handle, upload.fence) == vk.Success
+}
+
+//Wait blocks until the staged data has reached the destination memory
+func (core *CoreStageAllocator) Wait(ref StageRef) error {
+	upload, ok := core.pending(ref.upload)
+	if !ok {
+		return nil
+	}
+	return core.wait(upload)
+}
+
+//WaitIdle blocks until every in flight upload has completed
+func (core *CoreStageAllocator) WaitIdle() error {
+	for len(core.uploads) > 0 {
+		if err := core.wait(core.uploads[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Free releases the destination memory of a staged allocation once its upload has completed
+func (core *CoreStageAllocator) Free(ref StageRef) error {
+	if err := core.Wait(ref); err != nil {
+		return err
+	}
+	return core.allocator.Free(ref.ref)
+}
+
+//Pending returns the number of uploads still in flight, including failed host transfers
+func (core *CoreStageAllocator) Pending() int {
+	core.retire()
+	return len(core.uploads)
+}
+
+//Destroy waits for in flight uploads and releases the staging ring. Destination memory belongs to the allocator
+func (core *CoreStageAllocator) Destroy() {
+	core.WaitIdle()
+	if core.pool != nil {
+		core.pool.Destroy(&core.handle)
+		core.pool = nil
+	}
+	if core.mapped != nil {
+		core.backend.UnmapMemory(core.page.device_mem)
+		core.mapped = nil
+	}
+	if core.staging != nil {
+		core.staging.Destroy(core.handle)
+		core.staging = nil
+	}
+	core.backend.FreeMemory(core.page.device_mem)
+}
@@ -17,6 +17,8 @@ type CoreSwapchain struct {
 	images        []vk.Image
 	image_views   []vk.ImageView
 	viewport      vk.Viewport
+	depth_image   vk.Image
+	depth_view    vk.ImageView
 }
 
 //Initializes a new core swapchain which sets further display properties, since for right now displays
@@ -224,11 +226,24 @@ func (core *CoreSwapchain) create_frame_image_view(index int, instance *CoreRend
 
 func (core *CoreSwapchain) teardown_framebuffers(instance *CoreRenderInstance) {
 
-	vk.QueueWaitIdle(*instance.render_queue)
+	instance.queues.WaitIdle(int(instance.render_queue_family))
 	for index := 0; index < core.depth; index++ {
 		vk.DestroyFramebuffer(instance.logical_device.handle, core.framebuffers[index], nil)
 	}
 	core.framebuffers = make([]vk.Framebuffer, core.depth)
+	core.destroy_depth(instance)
+}
+
+//Destroys the depth attachment view and returns the depth image memory to the image allocator
+func (core *CoreSwapchain) destroy_depth(instance *CoreRenderInstance) {
+	if core.depth_view != vk.NullImageView {
+		vk.DestroyImageView(instance.logical_device.handle, core.depth_view, nil)
+		core.depth_view = vk.NullImageView
+	}
+	if core.depth_image != vk.NullImage {
+		instance.image_allocator.Free(core.depth_image)
+		core.depth_image = vk.NullImage
+	}
 }
 
 func (core *CoreSwapchain) create_framebuffers(instance *CoreRenderInstance, renderpass *vk.RenderPass) {
@@ -240,9 +255,10 @@ func (core *CoreSwapchain) create_framebuffers(instance *CoreRenderInstance, ren
 	}
 	core.framebuffers = make([]vk.Framebuffer, core.depth) //framebuffers attach to the swapchain images and create additional depth buffers etc..
 
-	var depthImage vk.Image
+	//Depth image memory is owned by the image allocator
+	core.destroy_depth(instance)
 	queue_fam := []uint32{uint32(instance.render_queue_family)}
-	res := vk.CreateImage(instance.logical_device.handle, &vk.ImageCreateInfo{
+	depthImage, err := instance.image_allocator.CreateImage(&vk.ImageCreateInfo{
 		SType:                 vk.StructureTypeImageCreateInfo,
 		Flags:                 vk.ImageCreateFlags(vk.ImageCreateMutableFormatBit),
 		ImageType:             vk.ImageType2d,
@@ -257,39 +273,16 @@ func (core *CoreSwapchain) create_framebuffers(instance *CoreRenderInstance, ren
 		QueueFamilyIndexCount: 1,
 		PQueueFamilyIndices:   queue_fam,
 		InitialLayout:         vk.ImageLayoutUndefined,
-	}, nil, &depthImage)
+	}, MEMORY_DEVICE_LOCAL)
 
-	if res != vk.Success {
-		Fatal(NewError(res))
+	if err != nil {
+		Fatal(err)
 	}
-
-	//Search through GPU memory properties to see if this can be device local
-	var depth_memory_req vk.MemoryRequirements
-	vk.GetImageMemoryRequirements(instance.logical_device.handle, depthImage, &depth_memory_req)
-	depth_memory_req.Deref()
-
-	mem_type_index, _ := vk.FindMemoryTypeIndex(instance.logical_device.selected_device, depth_memory_req.MemoryTypeBits,
-		vk.MemoryPropertyFlagBits(vk.MemoryHeapDeviceLocalBit))
-
-	alloc_info := vk.MemoryAllocateInfo{
-		SType:           vk.StructureTypeMemoryAllocateInfo,
-		AllocationSize:  depth_memory_req.Size,
-		MemoryTypeIndex: mem_type_index,
-	}
-
-	var depth_memory vk.DeviceMemory
-
-	res = vk.AllocateMemory(instance.logical_device.handle, &alloc_info, nil, &depth_memory)
-
-	if res != vk.Success {
-		Fatal(NewError(res))
-	}
-
-	vk.BindImageMemory(instance.logical_device.handle, depthImage, depth_memory, 0)
+	core.depth_image = depthImage
 
 	var depth_image_view vk.ImageView
 
-	res = vk.CreateImageView(instance.logical_device.handle,
+	res := vk.CreateImageView(instance.logical_device.handle,
 		&vk.ImageViewCreateInfo{
 			SType:    vk.StructureTypeImageViewCreateInfo,
 			Flags:    vk.ImageViewCreateFlags(0),
@@ -311,6 +304,7 @@ func (core *CoreSwapchain) create_framebuffers(instance *CoreRenderInstance, ren
 	if res != vk.Success {
 		Fatal(NewError(res))
 	}
+	core.depth_view = depth_image_view
 
 	for index := 0; index < len(core.images); index++ {
 
@@ -0,0 +1,145 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/andewx/dieselvk"
+	vk "github.com/vulkan-go/vulkan"
+)
+
+func TestTexelFormat(t *testing.T) {
+
+	uniform := vk.BufferUsageFlags(vk.BufferUsageUniformTexelBufferBit)
+	storage := vk.BufferUsageFlags(vk.BufferUsageStorageTexelBufferBit)
+
+	//A lookup table format readable by shaders but not writable
+	props := vk.FormatProperties{BufferFeatures: vk.FormatFeatureFlags(vk.FormatFeatureUniformTexelBufferBit)}
+	if err := dieselvk.CheckTexelFormat(vk.FormatR32g32b32a32Sfloat, props, uniform); err != nil {
+		t.Errorf("Expected uniform texel usage to be supported %v", err)
+	}
+	if err := dieselvk.CheckTexelFormat(vk.FormatR32g32b32a32Sfloat, props, storage); err == nil {
+		t.Errorf("Expected storage texel usage to be rejected")
+	}
+	if err := dieselvk.CheckTexelFormat(vk.FormatR32g32b32a32Sfloat, props, uniform|storage); err == nil {
+		t.Errorf("Expected combined usage to need both features")
+	}
+
+	//Image features do not count towards buffer views
+	props = vk.FormatProperties{OptimalTilingFeatures: vk.FormatFeatureFlags(vk.FormatFeatureUniformTexelBufferBit | vk.FormatFeatureStorageTexelBufferBit)}
+	if err := dieselvk.CheckTexelFormat(vk.FormatR8g8b8a8Unorm, props, uniform); err == nil {
+		t.Errorf("Expected tiling features to be ignored")
+	}
+
+	if err := dieselvk.CheckTexelFormat(vk.FormatR8g8b8a8Unorm, props, vk.BufferUsageFlags(vk.BufferUsageUniformBufferBit)); err == nil {
+		t.Errorf("Expected usage without a texel bit to be rejected")
+	}
+}
+
+func TestTexelElements(t *testing.T) {
+
+	//The guaranteed maxTexelBufferElements holds a 65536 entry vec4 table but not one more entry
+	if err := dieselvk.CheckTexelElements(vk.FormatR32g32b32a32Sfloat, 65536*16, 65536); err != nil {
+		t.Errorf("Expected 65536 texels to fit the limit %v", err)
+	}
+	if err := dieselvk.CheckTexelElements(vk.FormatR32g32b32a32Sfloat, 65537*16, 65536); err == nil {
+		t.Errorf("Expected 65537 texels to exceed the limit")
+	}
+	if err := dieselvk.CheckTexelElements(vk.FormatR8Unorm, 65537, 65536); err == nil {
+		t.Errorf("Expected single byte texels to be counted per byte")
+	}
+	if err := dieselvk.CheckTexelElements(vk.FormatA2b10g10r10UnormPack32, 4096, 1024); err != nil {
+		t.Errorf("Expected packed 32 bit texels to be counted per 4 bytes %v", err)
+	}
+	if err := dieselvk.CheckTexelElements(vk.FormatD16Unorm, 64, 65536); err == nil {
+		t.Errorf("Expected depth formats to be rejected")
+	}
+}
+
+func TestVertexLayout(t *testing.T) {
+
+	//The $std_mesh layout of the configuration schema
+	type StdMesh struct {
+		Position [3]float32 `vk:"location=0,format=R32G32B32_SFLOAT"`
+		Normal   [3]float32 `vk:"location=1"`
+		UV       [2]float32 `vk:"location=2,format=R32G32_SFLOAT"`
+		Color    [3]float32
+	}
+	type Instance struct {
+		Offset [4]float32 `vk:"location=6"`
+		Tint   [4]uint8   `vk:"format=VK_FORMAT_R8G8B8A8_UNORM"`
+		Pad    [3]uint32  `vk:"-"`
+	}
+
+	layout, err := dieselvk.NewVertexLayout(dieselvk.VertexBinding{Prototype: StdMesh{}}, dieselvk.VertexBinding{Prototype: &Instance{}, Instanced: true})
+	if err != nil {
+		t.Fatalf("Layout failed %v", err)
+	}
+	description := layout.GetInputDescription()
+	bindings, attributes := description.Bindings(), description.Attributes()
+	if len(bindings) != 2 || bindings[0].Stride != 44 || bindings[0].InputRate != vk.VertexInputRateVertex {
+		t.Fatalf("Expected a 44 byte per vertex mesh binding, got %+v", bindings)
+	}
+	if bindings[1].Binding != 1 || bindings[1].Stride != 32 || bindings[1].InputRate != vk.VertexInputRateInstance {
+		t.Errorf("Expected a 32 byte per instance binding 1, got %+v", bindings[1])
+	}
+
+	expected := []vk.VertexInputAttributeDescription{
+		{Location: 0, Binding: 0, Format: vk.FormatR32g32b32Sfloat, Offset: 0},
+		{Location: 1, Binding: 0, Format: vk.FormatR32g32b32Sfloat, Offset: 12},
+		{Location: 2, Binding: 0, Format: vk.FormatR32g32Sfloat, Offset: 24},
+		{Location: 3, Binding: 0, Format: vk.FormatR32g32b32Sfloat, Offset: 32},
+		{Location: 6, Binding: 1, Format: vk.FormatR32g32b32a32Sfloat, Offset: 0},
+		{Location: 7, Binding: 1, Format: vk.FormatR8g8b8a8Unorm, Offset: 16},
+	}
+	if len(attributes) != len(expected) {
+		t.Fatalf("Expected %d attributes, got %d", len(expected), len(attributes))
+	}
+	for i := range expected {
+		got := attributes[i]
+		if got.Location != expected[i].Location || got.Binding != expected[i].Binding || got.Format != expected[i].Format || got.Offset != expected[i].Offset {
+			t.Errorf("Attribute %d expected %+v, got %+v", i, expected[i], got)
+		}
+	}
+}
+
+func TestVertexLayoutErrors(t *testing.T) {
+
+	type reused struct {
+		A float32 `vk:"location=1"`
+		B float32 `vk:"location=1"`
+	}
+	type mismatched struct {
+		A [3]float32 `vk:"format=R32G32_SFLOAT"`
+	}
+	type unknown struct {
+		A float32 `vk:"format=R5G6B5"`
+	}
+	type untyped struct {
+		A [3]uint16
+	}
+	type malformed struct {
+		A float32 `vk:"location"`
+	}
+	for _, prototype := range []interface{}{reused{}, mismatched{}, unknown{}, untyped{}, malformed{}, 1.0} {
+		if _, err := dieselvk.NewVertexLayout(dieselvk.VertexBinding{Prototype: prototype}); err == nil {
+			t.Errorf("Expected %T to be rejected", prototype)
+		}
+	}
+
+	//Locations are unique across bindings
+	type first struct {
+		A float32
+	}
+	type second struct {
+		B float32 `vk:"location=0"`
+	}
+	if _, err := dieselvk.NewVertexLayout(dieselvk.VertexBinding{Prototype: first{}}, dieselvk.VertexBinding{Prototype: second{}}); err == nil {
+		t.Errorf("Expected location 0 to clash across bindings")
+	}
+
+	//Vertex slices upload as their Go memory
+	bytes, elem, count, err := dieselvk.SliceBytes([]first{{1}, {2}})
+	if err != nil || len(bytes) != 8 || count != 2 || elem.Name() != "first" {
+		t.Errorf("Expected 2 vertices in 8 bytes, got %d bytes %d vertices %v", len(bytes), count, err)
+	}
+}
@@ -0,0 +1,155 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/andewx/dieselvk"
+)
+
+func float_at(data []byte, offset int) float32 {
+	return math.Float32frombits(binary.LittleEndian.Uint32(data[offset:]))
+}
+
+func TestLayoutVectors(t *testing.T) {
+
+	//A float after a vec3 packs into its last 4 bytes, a vec3 after a float starts at 16
+	type light struct {
+		Position  [3]float32
+		Intensity float32
+		Color     [3]float32
+	}
+	data, err := dieselvk.EncodeLayout(light{Position: [3]float32{1, 2, 3}, Intensity: 4, Color: [3]float32{5, 6, 7}}, dieselvk.LAYOUT_STD140)
+	if err != nil {
+		t.Fatalf("Encode failed %v", err)
+	}
+	if len(data) != 32 || float_at(data, 8) != 3 || float_at(data, 12) != 4 || float_at(data, 16) != 5 || float_at(data, 24) != 7 {
+		t.Errorf("Expected 32 bytes with the intensity at 12 and the color at 16, got %d bytes %v", len(data), data)
+	}
+
+	type pair struct {
+		A float32
+		B [2]float32
+		C [4]int32
+	}
+	data, _ = dieselvk.EncodeLayout(pair{A: 1, B: [2]float32{2, 3}}, dieselvk.LAYOUT_STD430)
+	if len(data) != 32 || float_at(data, 8) != 2 {
+		t.Errorf("Expected the vec2 at 8 and the ivec4 at 16 in 32 bytes, got %d bytes", len(data))
+	}
+}
+
+func TestLayoutArrays(t *testing.T) {
+
+	type weights struct {
+		W [3]float32 `layout:"array"`
+		N uint32
+	}
+	value := weights{W: [3]float32{1, 2, 3}, N: 9}
+
+	//std140 strides scalar arrays by a vec4, std430 packs them
+	data, _ := dieselvk.EncodeLayout(value, dieselvk.LAYOUT_STD140)
+	if len(data) != 64 || float_at(data, 16) != 2 || float_at(data, 32) != 3 || binary.LittleEndian.Uint32(data[48:]) != 9 {
+		t.Errorf("Expected std140 strides of 16 and the count at 48, got %d bytes", len(data))
+	}
+	data, _ = dieselvk.EncodeLayout(value, dieselvk.LAYOUT_STD430)
+	if len(data) != 16 || float_at(data, 4) != 2 || binary.LittleEndian.Uint32(data[12:]) != 9 {
+		t.Errorf("Expected packed std430 floats and the count at 12, got %d bytes", len(data))
+	}
+
+	//Arrays of vec3 are strided as vec4 in both layouts, so is a mat3
+	mat3 := [3][3]float32{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}}
+	for _, layout := range []int{dieselvk.LAYOUT_STD140, dieselvk.LAYOUT_STD430} {
+		data, _ = dieselvk.EncodeLayout(mat3, layout)
+		if len(data) != 48 || float_at(data, 16) != 4 || float_at(data, 40) != 9 {
+			t.Errorf("Expected mat3 columns 16 bytes apart in layout %d, got %d bytes", layout, len(data))
+		}
+	}
+
+	//A mat4 is laid out exactly as Go stores it
+	mvp := [4][4]float32{{1, 0, 0, 0}, {0, 1, 0, 0}, {0, 0, 1, 0}, {0, 0, 0, 1}}
+	data, _ = dieselvk.EncodeLayout(mvp, dieselvk.LAYOUT_STD140)
+	raw, _ := dieselvk.AsBytes(mvp[:])
+	if !bytes.Equal(data, raw) {
+		t.Errorf("Expected mat4 to match its Go memory")
+	}
+
+	//Slices are arrays
+	data, _ = dieselvk.EncodeLayout([]float32{1, 2}, dieselvk.LAYOUT_STD140)
+	if len(data) != 32 || float_at(data, 16) != 2 {
+		t.Errorf("Expected a 2 element std140 float array to take 32 bytes, got %d", len(data))
+	}
+}
+
+func TestLayoutNested(t *testing.T) {
+
+	type material struct {
+		Roughness float32
+	}
+	type object struct {
+		Scale    float32
+		Material material
+		Index    int32
+		Skip     string `layout:"-"`
+	}
+	value := object{Scale: 2, Material: material{Roughness: 0.5}, Index: 7, Skip: "ignored"}
+
+	//std140 aligns nested structs to 16 and pads them to 16
+	data, err := dieselvk.EncodeLayout(value, dieselvk.LAYOUT_STD140)
+	if err != nil {
+		t.Fatalf("Encode failed %v", err)
+	}
+	if len(data) != 48 || float_at(data, 16) != 0.5 || binary.LittleEndian.Uint32(data[32:]) != 7 {
+		t.Errorf("Expected the material at 16 and the index at 32 in 48 bytes, got %d bytes", len(data))
+	}
+	data, _ = dieselvk.EncodeLayout(value, dieselvk.LAYOUT_STD430)
+	if len(data) != 12 || float_at(data, 4) != 0.5 || binary.LittleEndian.Uint32(data[8:]) != 7 {
+		t.Errorf("Expected std430 to pack the material at 4, got %d bytes", len(data))
+	}
+
+	if _, err := dieselvk.EncodeLayout(struct{ Name string }{"a"}, dieselvk.LAYOUT_STD140); err == nil {
+		t.Errorf("Expected strings to be rejected")
+	}
+	if _, err := dieselvk.EncodeLayout(struct{ Count int }{1}, dieselvk.LAYOUT_STD140); err == nil {
+		t.Errorf("Expected platform sized ints to be rejected")
+	}
+}
+
+func TestLayoutDynamic(t *testing.T) {
+
+	type object struct {
+		Model [4][4]float32
+		Tint  [4]float32
+	}
+	objects := []object{{Tint: [4]float32{1, 0, 0, 1}}, {Tint: [4]float32{0, 1, 0, 1}}, {Tint: [4]float32{0, 0, 1, 1}}}
+
+	//Elements are padded to the offset alignment of the device so each starts at a valid dynamic offset
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	alignment := uint64(fake.Limits().MinUniformBufferOffsetAlignment)
+	data, stride, err := dieselvk.EncodeDynamicLayout(objects, dieselvk.LAYOUT_STD140, alignment)
+	if err != nil {
+		t.Fatalf("Encode failed %v", err)
+	}
+	if stride != 256 || len(data) != 768 {
+		t.Errorf("Expected 80 byte elements padded to a 256 byte stride, got stride %d and %d bytes", stride, len(data))
+	}
+	for i := range objects {
+		if float_at(data, i*int(stride)+64+4*i) != 1 || float_at(data, i*int(stride)+76) != 1 {
+			t.Errorf("Expected element %d to start at offset %d", i, i*int(stride))
+		}
+	}
+
+	//Elements larger than the alignment round up to the next multiple
+	_, stride, _ = dieselvk.EncodeDynamicLayout([2][80]float32{}, dieselvk.LAYOUT_STD430, alignment)
+	if stride != 512 {
+		t.Errorf("Expected a 320 byte element to take a 512 byte stride, got %d", stride)
+	}
+
+	if _, _, err := dieselvk.EncodeDynamicLayout(object{}, dieselvk.LAYOUT_STD140, alignment); err == nil {
+		t.Errorf("Expected a single struct to be rejected")
+	}
+	if _, _, err := dieselvk.EncodeDynamicLayout([]object{}, dieselvk.LAYOUT_STD140, alignment); err == nil {
+		t.Errorf("Expected no elements to be rejected")
+	}
+}
@@ -0,0 +1,975 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/andewx/dieselvk"
+	vk "github.com/vulkan-go/vulkan"
+)
+
+func TestFakeAllocate(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, err := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 2)
+	if err != nil {
+		t.Fatalf("Unable to create allocator %v", err)
+	}
+
+	if fake.Allocated(1) != 4096 {
+		t.Errorf("Expected 4096 bytes of host visible device memory, got %d", fake.Allocated(1))
+	}
+	allocator.SetPoolCeiling(4096)
+
+	//Two 2KB pages hold sixteen 128 byte aligned blocks each
+	for i := 0; i < 32; i++ {
+		if _, err := allocator.Allocate(100, 64); err != nil {
+			t.Fatalf("Allocation %d failed %v", i, err)
+		}
+	}
+
+	if _, err := allocator.Allocate(100, 64); err == nil {
+		t.Errorf("Expected allocation to fail once both pages are full")
+	}
+
+	usage := allocator.Usage()
+	if !strings.Contains(usage, "Page 1: (2048)bytes") {
+		t.Errorf("Usage is missing the second page\n%s", usage)
+	}
+
+	allocator.Reset()
+	if _, err := allocator.Allocate(2048, 64); err != nil {
+		t.Errorf("Expected a full page allocation after Reset %v", err)
+	}
+
+	allocator.Destroy()
+	if fake.Allocated(1) != 0 {
+		t.Errorf("Expected Destroy to release all device memory, %d bytes remain", fake.Allocated(1))
+	}
+}
+
+func TestFakeAllocateHeapLimit(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1024)
+	if _, err := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 1); err == nil {
+		t.Errorf("Expected pool larger than the heap to be rejected")
+	}
+}
+
+func TestFakePoolGrowth(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 2048, 1)
+	defer allocator.Destroy()
+	allocator.SetPoolCeiling(8192)
+
+	//A full pool grows by a page of the pool page size
+	allocator.Allocate(2048, 256)
+	ref, err := allocator.Allocate(1024, 256)
+	if err != nil {
+		t.Fatalf("Expected the pool to grow %v", err)
+	}
+	if ref.Page() != 1 || fake.Allocated(1) != 4096 {
+		t.Errorf("Expected a second 2048 byte page, page %d allocated %d", ref.Page(), fake.Allocated(1))
+	}
+
+	//Requests larger than a page get a page of their own until the ceiling is reached
+	if ref, err = allocator.Allocate(3000, 256); err != nil || ref.Page() != 2 {
+		t.Fatalf("Expected a page sized for the request, page %d %v", ref.Page(), err)
+	}
+	if _, err := allocator.Allocate(2048, 256); err == nil || !strings.Contains(err.Error(), "ceiling") {
+		t.Errorf("Expected allocation past the pool ceiling to fail, got %v", err)
+	}
+
+	//Heap budgets reported by the device stop growth before the ceiling
+	allocator.SetPoolCeiling(1 << 20)
+	fake.SetHeapBudget(1, 8192)
+	if _, err := allocator.Allocate(2048, 256); err == nil || !strings.Contains(err.Error(), "budget") {
+		t.Errorf("Expected allocation past the heap budget to fail, got %v", err)
+	}
+	if stats := allocator.Stats(); stats["type1.heap_budget"] != "8192" || stats["type1.heap_usage"] != "7168" {
+		t.Errorf("Expected heap budget 8192 and usage 7168, got %s %s", stats["type1.heap_budget"], stats["type1.heap_usage"])
+	}
+}
+
+func TestFakeWrite(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 2)
+
+	//Host visible pages are mapped once when they are created
+	if fake.Mappings() != 2 {
+		t.Errorf("Expected both host visible pages mapped, got %d", fake.Mappings())
+	}
+
+	ref, _ := allocator.Allocate(256, 64)
+	if err := allocator.Write(ref, 16, []byte{1, 2, 3, 4}); err != nil {
+		t.Errorf("Write failed %v", err)
+	}
+	if err := allocator.WriteFloat32(ref, 0, make([]float32, 64)); err != nil {
+		t.Errorf("WriteFloat32 of the whole block failed %v", err)
+	}
+	if err := allocator.WriteInt32(ref, 4, make([]int32, 64)); err == nil {
+		t.Errorf("Expected write past the end of the block to fail")
+	}
+	if fake.Mappings() != 2 {
+		t.Errorf("Expected writes to reuse the persistent mappings, got %d", fake.Mappings())
+	}
+
+	//Device local pages are never mapped
+	local, _ := allocator.AllocateType(vk.MemoryRequirements{Size: 256, Alignment: 64, MemoryTypeBits: 0x1}, dieselvk.MEMORY_DEVICE_LOCAL)
+	if err := allocator.Write(local, 0, []byte{1}); err == nil {
+		t.Errorf("Expected write to device local memory to fail")
+	}
+
+	allocator.Destroy()
+	if fake.Mappings() != 0 {
+		t.Errorf("Expected Destroy to unmap every page, %d remain", fake.Mappings())
+	}
+}
+
+func TestFakeUpload(t *testing.T) {
+
+	type vertex struct {
+		position [3]float32
+		color    uint32
+	}
+
+	//Byte sizes follow the element type
+	indices, _ := dieselvk.AsBytes([]uint16{0, 1, 2})
+	doubles, _ := dieselvk.AsBytes([]float64{1.0, 2.0})
+	vertices, _ := dieselvk.AsBytes([]vertex{{color: 0xff0000ff}, {}})
+	if len(indices) != 6 || len(doubles) != 16 || len(vertices) != 32 {
+		t.Errorf("Expected 6, 16 and 32 bytes, got %d %d %d", len(indices), len(doubles), len(vertices))
+	}
+	if vertices[12] != 0xff || vertices[15] != 0xff {
+		t.Errorf("Expected the packed color at byte 12, got % x", vertices[12:16])
+	}
+	if _, err := dieselvk.AsBytes([]struct{ name string }{{"a"}}); err == nil {
+		t.Errorf("Expected element types holding pointers to be rejected")
+	}
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 1)
+	defer allocator.Destroy()
+	buddy, _ := dieselvk.NewCoreBuddyAllocatorWithBackend(fake, 4096, 256)
+	defer buddy.Destroy()
+
+	for _, alloc := range []dieselvk.Allocator{allocator, buddy} {
+		ref, _ := alloc.Allocate(256, 64)
+		if err := dieselvk.UploadSlice(alloc, vk.Buffer(vk.NullHandle), ref, []uint16{0, 1, 2}); err != nil {
+			t.Errorf("Index upload failed %v", err)
+		}
+		if err := dieselvk.UploadSlice(alloc, vk.Buffer(vk.NullHandle), ref, make([]float64, 33)); err == nil {
+			t.Errorf("Expected 264 byte upload into a 256 byte block to fail")
+		}
+	}
+}
+
+func TestFakeReadback(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 1)
+	defer allocator.Destroy()
+
+	//Storage results are read back as typed slices, from non-coherent memory too
+	type particle struct {
+		Position [3]float32
+		Age      uint32
+	}
+	particles := []particle{{Position: [3]float32{1, 2, 3}, Age: 4}, {Position: [3]float32{5, 6, 7}, Age: 8}}
+	for _, memory := range []vk.MemoryPropertyFlags{dieselvk.MEMORY_HOST_VISIBLE, dieselvk.MEMORY_HOST_CACHED} {
+		ref, _ := allocator.AllocateType(vk.MemoryRequirements{Size: 256, Alignment: 64, MemoryTypeBits: 0x6}, memory)
+		if err := dieselvk.WriteSlice(allocator, ref, 0, particles); err != nil {
+			t.Fatalf("Write failed %v", err)
+		}
+		read, err := dieselvk.ReadSlice[particle](allocator, ref, 0, 2)
+		if err != nil {
+			t.Fatalf("Read failed %v", err)
+		}
+		if len(read) != 2 || read[1] != particles[1] {
+			t.Errorf("Expected the particles back from memory %x, got %v", memory, read)
+		}
+		ages, _ := dieselvk.ReadSlice[uint32](allocator, ref, 12, 1)
+		if len(ages) != 1 || ages[0] != 4 {
+			t.Errorf("Expected to read the age at byte 12, got %v", ages)
+		}
+		if _, err := dieselvk.ReadSlice[particle](allocator, ref, 0, 17); err == nil {
+			t.Errorf("Expected a read past the block to fail")
+		}
+	}
+
+	if _, err := dieselvk.FromBytes[uint32](make([]byte, 6)); err == nil {
+		t.Errorf("Expected a partial element to be rejected")
+	}
+	if _, err := dieselvk.FromBytes[string](make([]byte, 16)); err == nil {
+		t.Errorf("Expected element types holding pointers to be rejected")
+	}
+}
+
+func TestFakeDedicated(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 1)
+	allocator.SetDedicatedSize(8192)
+
+	backing := make([]uint64, 1)
+	buffer := vk.Buffer(unsafe.Pointer(&backing[0]))
+	fake.SetDedicated(buffer, vk.NullImage, dieselvk.DedicatedRequirements{Requires: true})
+
+	//Buffers requiring dedicated memory get a page of their own regardless of size
+	reqs := vk.MemoryRequirements{Size: 512, Alignment: 64, MemoryTypeBits: 0x2}
+	owned, err := allocator.AllocateBuffer(buffer, reqs, dieselvk.MEMORY_HOST_VISIBLE)
+	if err != nil {
+		t.Fatalf("Dedicated allocation failed %v", err)
+	}
+	if owned.Page() != 1 || fake.Dedicated() != 1 {
+		t.Errorf("Expected a dedicated page 1, page %d dedicated %d", owned.Page(), fake.Dedicated())
+	}
+	if err := allocator.Write(owned, 0, make([]byte, 512)); err != nil {
+		t.Errorf("Expected dedicated host visible page to be mapped %v", err)
+	}
+
+	//Requests above the threshold are dedicated while small ones share pages
+	large, _ := allocator.AllocateType(vk.MemoryRequirements{Size: 10000, Alignment: 256, MemoryTypeBits: 0x2}, dieselvk.MEMORY_HOST_VISIBLE)
+	small, _ := allocator.AllocateType(reqs, dieselvk.MEMORY_HOST_VISIBLE)
+	if large.Page() != 2 || small.Page() != 0 {
+		t.Errorf("Expected large on dedicated page 2 and small on page 0, got %d %d", large.Page(), small.Page())
+	}
+
+	stats := allocator.Stats()
+	if stats["dedicated"] != "2" || stats["type1.page2.allocations"] != "1" || stats["size"] != "14608" {
+		t.Errorf("Expected dedicated pages in the stats, got dedicated %s size %s", stats["dedicated"], stats["size"])
+	}
+	if !strings.Contains(allocator.Usage(), "Page 2: (10000)bytes dedicated") {
+		t.Errorf("Usage is missing the dedicated page\n%s", allocator.Usage())
+	}
+
+	//Freeing releases the device memory and the slot is reused
+	if err := allocator.Free(owned); err != nil {
+		t.Fatalf("Free failed %v", err)
+	}
+	if fake.Dedicated() != 1 || allocator.Stats()["dedicated"] != "1" {
+		t.Errorf("Expected one dedicated allocation after Free, got %d", fake.Dedicated())
+	}
+	if err := allocator.Free(owned); err == nil {
+		t.Errorf("Expected double free of dedicated memory to be rejected")
+	}
+	reused, _ := allocator.AllocateType(vk.MemoryRequirements{Size: 9000, Alignment: 256, MemoryTypeBits: 0x2}, dieselvk.MEMORY_HOST_VISIBLE)
+	if reused.Page() != 1 {
+		t.Errorf("Expected the released slot to be reused, got page %d", reused.Page())
+	}
+
+	allocator.Destroy()
+	if fake.Dedicated() != 0 || fake.Allocated(1) != 0 {
+		t.Errorf("Expected Destroy to release dedicated memory, %d remain", fake.Dedicated())
+	}
+}
+
+func TestFakeNonCoherent(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 1)
+	defer allocator.Destroy()
+
+	//Coherent writes are never flushed
+	coherent, _ := allocator.Allocate(256, 64)
+	allocator.Write(coherent, 0, []byte{1, 2, 3})
+	if len(fake.Flushed()) != 0 {
+		t.Errorf("Expected no flushes for coherent memory, got %v", fake.Flushed())
+	}
+
+	reqs := vk.MemoryRequirements{Size: 256, Alignment: 64, MemoryTypeBits: 0x6}
+	cached, err := allocator.AllocateType(reqs, dieselvk.MEMORY_HOST_CACHED)
+	if err != nil {
+		t.Fatalf("Host cached allocation failed %v", err)
+	}
+	if allocator.MemoryType(cached)&vk.MemoryPropertyFlags(vk.MemoryPropertyHostCoherentBit) != 0 {
+		t.Fatalf("Expected the non-coherent cached memory type")
+	}
+
+	//Ranges widen to whole 64 byte atoms
+	if err := allocator.Write(cached, 70, []byte{4, 5, 6, 7}); err != nil {
+		t.Fatalf("Write failed %v", err)
+	}
+	flushed := fake.Flushed()
+	if len(flushed) != 1 || flushed[0].Offset != 64 || flushed[0].Size != 64 {
+		t.Errorf("Expected one flush of 64 bytes at 64, got %v", flushed)
+	}
+
+	data := make([]byte, 4)
+	if err := allocator.Read(cached, 70, data); err != nil {
+		t.Fatalf("Read failed %v", err)
+	}
+	invalid := fake.Invalidated()
+	if len(invalid) != 1 || invalid[0].Offset != 64 || invalid[0].Size != 64 {
+		t.Errorf("Expected one invalidate of 64 bytes at 64, got %v", invalid)
+	}
+	if data[0] != 4 || data[3] != 7 {
+		t.Errorf("Expected the written bytes back, got %v", data)
+	}
+
+	if err := dieselvk.UploadSlice[uint32](allocator, vk.Buffer(vk.NullHandle), cached, []uint32{1, 2, 3}); err != nil {
+		t.Fatalf("Upload failed %v", err)
+	}
+	if flushed = fake.Flushed(); len(flushed) != 2 || flushed[1].Offset != 0 || flushed[1].Size != 64 {
+		t.Errorf("Expected the upload to flush the first atom, got %v", flushed)
+	}
+}
+
+func TestFakeTrace(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 1)
+	defer allocator.Destroy()
+
+	var trace bytes.Buffer
+	if err := allocator.TraceTo(&trace); err != nil {
+		t.Fatalf("TraceTo failed %v", err)
+	}
+	refs := make([]dieselvk.MemRef, 4)
+	for i := range refs {
+		refs[i], _ = allocator.Allocate(1024, 64)
+	}
+	allocator.Free(refs[1])
+	allocator.Clean()
+	allocator.Allocate(3000, 256)
+	if err := allocator.StopTrace(); err != nil {
+		t.Fatalf("StopTrace failed %v", err)
+	}
+
+	ops, err := dieselvk.ReadTrace(&trace)
+	if err != nil {
+		t.Fatalf("ReadTrace failed %v", err)
+	}
+	if len(ops) != 7 || ops[4].Op != dieselvk.TRACE_FREE || ops[4].ID != 1 || ops[5].Op != dieselvk.TRACE_CLEAN {
+		t.Fatalf("Expected 4 allocations, a free of id 1, a clean and an allocation, got %v", ops)
+	}
+	if ops[6].Op != dieselvk.TRACE_ALLOCATE || ops[6].ID != 4 || ops[6].Size != 3000 || ops[6].Align != 256 {
+		t.Errorf("Expected allocation 4 of 3000 bytes aligned to 256, got %v", ops[6])
+	}
+
+	//A single 4KB page cannot hold the last allocation
+	small, _ := dieselvk.NewCoreAllocatorWithBackend(dieselvk.NewFakeMemory(1<<20), 4096, 1)
+	small.SetPoolCeiling(4096)
+	defer small.Destroy()
+	report := dieselvk.Replay(small, ops, 1)
+	if len(report.Failures) != 1 || report.Failures[0].Op != 6 {
+		t.Errorf("Expected the last allocation to fail, got %v", report.Failures)
+	}
+	if report.PeakLive != 4096 || report.PeakSize != 4096 || len(report.Samples) != 7 {
+		t.Errorf("Expected a 4096 byte peak over 7 samples, got %d %d %d", report.PeakLive, report.PeakSize, len(report.Samples))
+	}
+
+	buddy, _ := dieselvk.NewCoreBuddyAllocatorWithBackend(dieselvk.NewFakeMemory(1<<20), 8192, 256)
+	defer buddy.Destroy()
+	report = dieselvk.Replay(buddy, ops, 4)
+	if len(report.Failures) != 0 || report.PeakLive != 6072 || len(report.Samples) != 2 {
+		t.Errorf("Expected the buddy replay to fit with 2 samples, got %s", report)
+	}
+
+	if _, err := dieselvk.ReadTrace(strings.NewReader("not a trace")); err == nil {
+		t.Errorf("Expected input without the trace header to be rejected")
+	}
+}
+
+func TestFakeLeakTracker(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 1)
+	defer allocator.Destroy()
+
+	untracked, _ := allocator.Allocate(64, 64)
+	allocator.TrackLeaks(true)
+	_, _, line, _ := runtime.Caller(0)
+	kept, _ := allocator.Allocate(256, 64)
+	freed, _ := allocator.Allocate(128, 64)
+	allocator.Free(freed)
+	allocator.Free(untracked)
+
+	leaks := allocator.Leaks()
+	if len(leaks) != 1 || leaks[0].Ref != kept {
+		t.Fatalf("Expected only the kept allocation to be live, got %v", leaks)
+	}
+	if leaks[0].Size != 256 || leaks[0].Frame.LineNumber != line+1 || !strings.HasSuffix(leaks[0].Frame.File, "memory_test.go") {
+		t.Errorf("Expected 256 bytes from memory_test.go:%d, got %d bytes from %s:%d", line+1, leaks[0].Size, leaks[0].Frame.File, leaks[0].Frame.LineNumber)
+	}
+	if report := allocator.LeakReport(); !strings.Contains(report, "256 bytes") || !strings.Contains(report, "TestFakeLeakTracker") {
+		t.Errorf("Expected the report to name the size and function, got %s", report)
+	}
+
+	allocator.Free(kept)
+	if len(allocator.Leaks()) != 0 {
+		t.Errorf("Expected no live allocations after freeing")
+	}
+}
+
+func TestFakeFreeCoalesce(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 2048, 1)
+	defer allocator.Destroy()
+
+	refs := make([]dieselvk.MemRef, 4)
+	for i := range refs {
+		ref, err := allocator.Allocate(512, 256)
+		if err != nil {
+			t.Fatalf("Allocation %d failed %v", i, err)
+		}
+		refs[i] = ref
+	}
+
+	//Free the middle blocks out of order, both sides must merge into one 1KB block
+	if err := allocator.Free(refs[2]); err != nil {
+		t.Fatalf("Free failed %v", err)
+	}
+	if err := allocator.Free(refs[1]); err != nil {
+		t.Fatalf("Free failed %v", err)
+	}
+	if err := allocator.Free(refs[1]); err == nil {
+		t.Errorf("Expected double free to be rejected")
+	}
+
+	ref, err := allocator.Allocate(1024, 256)
+	if err != nil {
+		t.Fatalf("Expected the coalesced block to hold 1KB %v", err)
+	}
+	if ref.Offset() != 512 {
+		t.Errorf("Expected coalesced allocation at offset 512, got %d", ref.Offset())
+	}
+
+	//Releasing everything leaves a single free block spanning the page
+	for _, r := range []dieselvk.MemRef{refs[0], ref, refs[3]} {
+		if err := allocator.Free(r); err != nil {
+			t.Fatalf("Free failed %v", err)
+		}
+	}
+	if _, err := allocator.Allocate(2048, 256); err != nil {
+		t.Errorf("Expected full page after freeing every block %v", err)
+	}
+}
+
+func TestFakeBestFit(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 1)
+	defer allocator.Destroy()
+
+	//Leave a 1KB hole and a 256 byte hole separated by used blocks
+	large, _ := allocator.Allocate(1024, 256)
+	allocator.Allocate(256, 256)
+	small, _ := allocator.Allocate(256, 256)
+	allocator.Allocate(256, 256)
+	allocator.Free(large)
+	allocator.Free(small)
+
+	ref, err := allocator.Allocate(200, 64)
+	if err != nil {
+		t.Fatalf("Allocation failed %v", err)
+	}
+	if ref.Offset() != small.Offset() {
+		t.Errorf("Expected best fit into the 256 byte hole at %d, got %d", small.Offset(), ref.Offset())
+	}
+
+	//Alignment padding is returned to the free tree
+	aligned, err := allocator.Allocate(64, 1024)
+	if err != nil {
+		t.Fatalf("Aligned allocation failed %v", err)
+	}
+	if aligned.Offset()%1024 != 0 {
+		t.Errorf("Expected 1KB aligned offset, got %d", aligned.Offset())
+	}
+}
+
+func TestFakeBuddy(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	buddy, err := dieselvk.NewCoreBuddyAllocatorWithBackend(fake, 3000, 256)
+	if err != nil {
+		t.Fatalf("Unable to create buddy allocator %v", err)
+	}
+	var allocator dieselvk.Allocator = buddy
+	defer allocator.Destroy()
+
+	//Pool is rounded up to a 4KB power of two page
+	if fake.Allocated(1) != 4096 {
+		t.Errorf("Expected 4096 byte buddy page, got %d", fake.Allocated(1))
+	}
+
+	a, _ := allocator.Allocate(100, 16)
+	b, _ := allocator.Allocate(300, 16)
+	c, err := allocator.Allocate(1024, 1024)
+	if err != nil {
+		t.Fatalf("Allocation failed %v", err)
+	}
+	if a.Offset() != 0 || b.Offset() != 512 || c.Offset() != 1024 {
+		t.Errorf("Unexpected buddy offsets %d %d %d", a.Offset(), b.Offset(), c.Offset())
+	}
+
+	stats := allocator.Stats()
+	if stats["used"] != "1792" || stats["allocations"] != "3" {
+		t.Errorf("Unexpected buddy stats %v", stats)
+	}
+
+	if _, err := allocator.Allocate(4096, 16); err == nil {
+		t.Errorf("Expected allocation larger than the free space to fail")
+	}
+
+	//Freeing every block merges the buddies back into the top order
+	for _, ref := range []dieselvk.MemRef{b, c, a} {
+		if err := allocator.Free(ref); err != nil {
+			t.Fatalf("Free failed %v", err)
+		}
+	}
+	if err := allocator.Free(a); err == nil {
+		t.Errorf("Expected double free to be rejected")
+	}
+	whole, err := allocator.Allocate(4096, 16)
+	if err != nil {
+		t.Errorf("Expected whole page after merging buddies %v", err)
+	}
+
+	//Resizing an empty buddy allocator replaces the mapped page and Destroy may run twice
+	allocator.Free(whole)
+	if err := allocator.Resize(8192); err != nil {
+		t.Fatalf("Resize failed %v", err)
+	}
+	if fake.Allocated(1) != 8192 || fake.Mappings() != 1 {
+		t.Errorf("Expected one mapped 8192 byte page after Resize, got %d bytes %d mappings", fake.Allocated(1), fake.Mappings())
+	}
+
+	progress := make(chan int, 1)
+	allocator.Run(progress)
+	if done := <-progress; done != dieselvk.DEFRAG_DONE {
+		t.Errorf("Expected DEFRAG_DONE from the buddy allocator, got %d", done)
+	}
+
+	//A Resize failing on the heap size leaves no page to allocate from
+	if err := allocator.Resize(1 << 21); err == nil {
+		t.Errorf("Expected Resize beyond the heap size to fail")
+	}
+	if _, err := allocator.Allocate(256, 16); err == nil {
+		t.Errorf("Expected allocation after a failed Resize to fail")
+	}
+	if err := allocator.Resize(4096); err != nil {
+		t.Fatalf("Resize failed %v", err)
+	}
+
+	allocator.Destroy()
+	if fake.Allocated(1) != 0 || fake.Mappings() != 0 {
+		t.Errorf("Expected Destroy to release the page, got %d bytes %d mappings", fake.Allocated(1), fake.Mappings())
+	}
+	if _, err := allocator.Allocate(256, 16); err == nil {
+		t.Errorf("Expected allocation after Destroy to fail")
+	}
+}
+
+func TestFakeFrameAllocator(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	frames, err := dieselvk.NewCoreFrameAllocatorWithBackend(fake, 3, 1000, 256, 0x7)
+	if err != nil {
+		t.Fatalf("Unable to create frame allocator %v", err)
+	}
+	defer frames.Destroy()
+
+	//Regions are rounded to the alignment, 3 x 1024 bytes
+	if fake.Allocated(1) != 3072 {
+		t.Errorf("Expected 3072 bytes of frame memory, got %d", fake.Allocated(1))
+	}
+
+	a, _ := frames.Write(1, []byte{1, 2, 3})
+	b, err := frames.Write(1, []byte{4, 5, 6, 7})
+	if err != nil {
+		t.Fatalf("Frame write failed %v", err)
+	}
+	if a.Offset() != 1024 || b.Offset() != 1280 {
+		t.Errorf("Unexpected frame offsets %d %d", a.Offset(), b.Offset())
+	}
+	if got := frames.Bytes(b); got[0] != 4 || got[3] != 7 {
+		t.Errorf("Frame bytes do not hold written data %v", got)
+	}
+
+	if _, err := frames.Allocate(1, 768); err == nil {
+		t.Errorf("Expected frame region overflow to fail")
+	}
+
+	//Other regions are untouched and the frame region rewinds on Begin
+	if frames.Used(0) != 0 || frames.Used(2) != 0 {
+		t.Errorf("Expected other frame regions to be empty")
+	}
+	if !frames.Begin(1) || frames.Used(1) != 0 {
+		t.Errorf("Expected untracked frame region to rewind")
+	}
+	if ref, _ := frames.Allocate(1, 768); ref.Offset() != 1024 {
+		t.Errorf("Expected rewound region to start at 1024, got %d", ref.Offset())
+	}
+	if len(fake.Flushed()) != 0 {
+		t.Errorf("Expected no flushes for coherent frame memory, got %v", fake.Flushed())
+	}
+
+	//Buffers only allowed the non-coherent cached type get flushed writes, and none with no host visible type
+	cached, err := dieselvk.NewCoreFrameAllocatorWithBackend(fake, 2, 1000, 256, 0x4)
+	if err != nil {
+		t.Fatalf("Unable to create non-coherent frame allocator %v", err)
+	}
+	defer cached.Destroy()
+	if fake.Allocated(1) != 3072+2048 {
+		t.Errorf("Expected 2048 more bytes of host visible memory, got %d", fake.Allocated(1))
+	}
+	if _, err := cached.Write(1, []byte{1, 2, 3}); err != nil {
+		t.Fatalf("Frame write failed %v", err)
+	}
+	if flushed := fake.Flushed(); len(flushed) != 1 || flushed[0].Offset != 1024 || flushed[0].Size != 64 {
+		t.Errorf("Expected the write to flush one atom at 1024, got %v", flushed)
+	}
+	if _, err := dieselvk.NewCoreFrameAllocatorWithBackend(fake, 2, 1000, 256, 0x1); err == nil {
+		t.Errorf("Expected frame memory without a host visible type to fail")
+	}
+}
+
+func TestFakeMemoryTypes(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, err := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 1)
+	if err != nil {
+		t.Fatalf("Unable to create allocator %v", err)
+	}
+	defer allocator.Destroy()
+
+	//Device local pool is created on first use from heap 0
+	reqs := vk.MemoryRequirements{Size: 1000, Alignment: 256, MemoryTypeBits: 0x3}
+	local, err := allocator.AllocateType(reqs, dieselvk.MEMORY_DEVICE_LOCAL)
+	if err != nil {
+		t.Fatalf("Device local allocation failed %v", err)
+	}
+	if fake.Allocated(0) != 4096 {
+		t.Errorf("Expected a 4096 byte device local pool, got %d", fake.Allocated(0))
+	}
+	if allocator.MemoryType(local)&vk.MemoryPropertyFlags(vk.MemoryPropertyDeviceLocalBit) == 0 {
+		t.Errorf("Expected device local memory type")
+	}
+
+	host, err := allocator.AllocateType(reqs, dieselvk.MEMORY_HOST_VISIBLE)
+	if err != nil {
+		t.Fatalf("Host visible allocation failed %v", err)
+	}
+	if allocator.MemoryType(host)&vk.MemoryPropertyFlags(vk.MemoryPropertyHostVisibleBit) == 0 {
+		t.Errorf("Expected host visible memory type")
+	}
+
+	//Both pools start at offset zero and free independently
+	if local.Offset() != 0 || host.Offset() != 0 {
+		t.Errorf("Expected independent pools, got offsets %d %d", local.Offset(), host.Offset())
+	}
+	if err := allocator.Free(local); err != nil {
+		t.Errorf("Free failed %v", err)
+	}
+	if err := allocator.Free(local); err == nil {
+		t.Errorf("Expected double free to be rejected")
+	}
+
+	//Memory type bits exclude the only matching type
+	reqs.MemoryTypeBits = 0x2
+	if _, err := allocator.AllocateType(reqs, dieselvk.MEMORY_DEVICE_LOCAL); err == nil {
+		t.Errorf("Expected allocation to fail when type bits exclude device local memory")
+	}
+	if _, err := allocator.AllocateType(reqs, dieselvk.MEMORY_HOST_CACHED); err == nil {
+		t.Errorf("Expected host cached allocation to fail without a cached memory type")
+	}
+
+	if !strings.Contains(allocator.Usage(), "Memory Type 0") {
+		t.Errorf("Usage is missing the device local pool\n%s", allocator.Usage())
+	}
+}
+
+func TestFakeStageAllocator(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 2048, 1)
+	allocator.SetPoolCeiling(2048)
+	defer allocator.Destroy()
+	stage, err := dieselvk.NewCoreStageAllocatorWithBackend(allocator, 1024)
+	if err != nil {
+		t.Fatalf("Unable to create stage allocator %v", err)
+	}
+	defer stage.Destroy()
+
+	reqs := vk.MemoryRequirements{Size: 768, Alignment: 256, MemoryTypeBits: 0x3}
+	data := make([]byte, 768)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	//Two uploads overflow the ring so the first one is retired to make room
+	a, err := stage.Upload(vk.Buffer(vk.NullHandle), reqs, data)
+	if err != nil {
+		t.Fatalf("Upload failed %v", err)
+	}
+	b, err := stage.Upload(vk.Buffer(vk.NullHandle), reqs, data)
+	if err != nil {
+		t.Fatalf("Upload failed %v", err)
+	}
+	if stage.Pending() != 0 || !stage.Resident(a) || !stage.Resident(b) {
+		t.Errorf("Expected backend uploads to be retired")
+	}
+	if allocator.MemoryType(a.Ref())&vk.MemoryPropertyFlags(vk.MemoryPropertyDeviceLocalBit) == 0 {
+		t.Errorf("Expected staged upload in device local memory")
+	}
+	if b.Ref().Offset() != 768 {
+		t.Errorf("Expected second upload at offset 768, got %d", b.Ref().Offset())
+	}
+
+	//Device local pool is at its ceiling so the third upload falls back to host visible memory
+	c, err := stage.Upload(vk.Buffer(vk.NullHandle), reqs, data)
+	if err != nil {
+		t.Fatalf("Fallback upload failed %v", err)
+	}
+	if allocator.MemoryType(c.Ref())&vk.MemoryPropertyFlags(vk.MemoryPropertyHostVisibleBit) == 0 {
+		t.Errorf("Expected host visible fallback memory")
+	}
+
+	if _, err := stage.Upload(vk.Buffer(vk.NullHandle), reqs, make([]byte, 1024)); err == nil {
+		t.Errorf("Expected upload larger than the buffer to fail")
+	}
+	if err := stage.Free(a); err != nil {
+		t.Errorf("Free failed %v", err)
+	}
+
+	//A host transfer into released memory fails to retire and stays in flight
+	d, err := stage.Upload(vk.Buffer(vk.NullHandle), vk.MemoryRequirements{Size: 256, Alignment: 256, MemoryTypeBits: 0x3}, data[:256])
+	if err != nil {
+		t.Fatalf("Upload failed %v", err)
+	}
+	allocator.Free(d.Ref())
+	if stage.Pending() != 1 || stage.Resident(d) {
+		t.Errorf("Expected the failed transfer to stay in flight")
+	}
+	if err := stage.Wait(d); err == nil {
+		t.Errorf("Expected waiting on the failed transfer to fail")
+	}
+}
+
+func TestFakeImageAllocator(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 1)
+	defer allocator.Destroy()
+	images := dieselvk.NewCoreImageAllocator(nil, allocator)
+
+	//Image handles only serve as map keys without a device
+	backing := make([]uint64, 3)
+	handles := make([]vk.Image, 3)
+	for i := range handles {
+		handles[i] = vk.Image(unsafe.Pointer(&backing[i]))
+	}
+
+	reqs := vk.MemoryRequirements{Size: 100, Alignment: 64, MemoryTypeBits: 0x1}
+	linear, err := allocator.AllocateType(reqs, dieselvk.MEMORY_DEVICE_LOCAL)
+	if err != nil {
+		t.Fatalf("Buffer allocation failed %v", err)
+	}
+
+	//Optimal image may not share the 1KB granularity page of the buffer
+	image_reqs := vk.MemoryRequirements{Size: 512, Alignment: 256, MemoryTypeBits: 0x1}
+	depth, err := images.AllocateImage(handles[0], image_reqs, vk.ImageTilingOptimal, dieselvk.MEMORY_DEVICE_LOCAL)
+	if err != nil {
+		t.Fatalf("Image allocation failed %v", err)
+	}
+	if depth.Offset() != 1024 {
+		t.Errorf("Expected optimal image on the next granularity page at 1024, got %d", depth.Offset())
+	}
+
+	//Linear images share pages with buffers freely and the buffer gap is reused
+	linear_image, err := images.AllocateImage(handles[1], reqs, vk.ImageTilingLinear, dieselvk.MEMORY_DEVICE_LOCAL)
+	if err != nil {
+		t.Fatalf("Linear image allocation failed %v", err)
+	}
+	if linear_image.Offset() != linear.Offset()+128 {
+		t.Errorf("Expected linear image next to the buffer, got %d", linear_image.Offset())
+	}
+
+	//Images larger than a pool page get a page of their own
+	large, err := images.AllocateImage(handles[2], vk.MemoryRequirements{Size: 10000, Alignment: 256, MemoryTypeBits: 0x1}, vk.ImageTilingOptimal, dieselvk.MEMORY_DEVICE_LOCAL)
+	if err != nil {
+		t.Fatalf("Large image allocation failed %v", err)
+	}
+	if large.Page() != 1 || fake.Allocated(0) != 4096+10240 {
+		t.Errorf("Expected a 10240 byte image page, page %d allocated %d", large.Page(), fake.Allocated(0))
+	}
+
+	if err := images.Free(handles[0]); err != nil {
+		t.Errorf("Image free failed %v", err)
+	}
+	if err := images.Free(handles[0]); err == nil {
+		t.Errorf("Expected double image free to be rejected")
+	}
+
+	//Destroy releases the remaining image blocks back to the pool
+	images.Destroy()
+	allocator.Free(linear)
+	if _, err := allocator.AllocateType(vk.MemoryRequirements{Size: 4096, Alignment: 256, MemoryTypeBits: 0x1}, dieselvk.MEMORY_DEVICE_LOCAL); err != nil {
+		t.Errorf("Expected the first page to be free after Destroy %v", err)
+	}
+}
+
+func TestFakeStats(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 2)
+	defer allocator.Destroy()
+
+	//Fill the first page then punch two separate holes into it
+	refs := make([]dieselvk.MemRef, 4)
+	for i := range refs {
+		refs[i], _ = allocator.Allocate(512, 256)
+	}
+	allocator.Free(refs[1])
+	allocator.Free(refs[3])
+
+	stats := allocator.Stats()
+	expected := map[string]string{
+		"pages":                   "2",
+		"used":                    "1024",
+		"free":                    "3072",
+		"allocations":             "2",
+		"max_free":                "2048",
+		"fragmentation":           "0.333333",
+		"type1.mean_frag":         "0.250000",
+		"type1.frag_variance":     "0.062500",
+		"type1.free_blocks":       "3",
+		"type1.page0.mean_frag":   "0.500000",
+		"type1.page0.mean_usage":  "0.500000",
+		"type1.page1.allocations": "0",
+	}
+	for key, value := range expected {
+		if stats[key] != value {
+			t.Errorf("Expected stats[%s] = %s, got %s", key, value, stats[key])
+		}
+	}
+
+	out, err := allocator.ShowMemoryMap()
+	if err != nil {
+		t.Fatalf("ShowMemoryMap failed %v", err)
+	}
+	var memory_map struct {
+		Pools []struct {
+			Type  uint32
+			Pages []struct {
+				Blocks []struct {
+					Offset uint64
+					Size   uint64
+					Used   bool
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(out), &memory_map); err != nil {
+		t.Fatalf("Memory map is not valid JSON %v", err)
+	}
+	if len(memory_map.Pools) != 1 || len(memory_map.Pools[0].Pages) != 2 {
+		t.Fatalf("Unexpected memory map layout %s", out)
+	}
+	blocks := memory_map.Pools[0].Pages[0].Blocks
+	if len(blocks) != 4 || !blocks[0].Used || blocks[1].Used || blocks[3].Offset != 1536 {
+		t.Errorf("Unexpected page block layout %s", out)
+	}
+}
+
+func TestFakeDefrag(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 1)
+	defer allocator.Destroy()
+
+	//Fill the page with tracked buffers and free every other one
+	refs := make([]dieselvk.MemRef, 8)
+	buffers := make([]*dieselvk.CoreBuffer, 8)
+	for i := range refs {
+		refs[i], _ = allocator.Allocate(512, 256)
+		buffers[i] = &dieselvk.CoreBuffer{}
+		if err := allocator.Track(refs[i], buffers[i]); err != nil {
+			t.Fatalf("Track failed %v", err)
+		}
+	}
+	for i := 1; i < len(refs); i += 2 {
+		allocator.Free(refs[i])
+	}
+
+	progress := make(chan int, 4)
+	allocator.Run(progress)
+	if moved := <-progress; moved != 4 {
+		t.Errorf("Expected 4 blocks moved, got %d", moved)
+	}
+	if done := <-progress; done != dieselvk.DEFRAG_DONE {
+		t.Errorf("Expected DEFRAG_DONE, got %d", done)
+	}
+
+	allocator.Clean()
+	if frag := allocator.Stats()["fragmentation"]; frag != "0.000000" {
+		t.Errorf("Expected no fragmentation after compaction, got %s", frag)
+	}
+	for i := 0; i < len(refs); i += 2 {
+		if offset := buffers[i].MemoryRef().Offset(); offset != uint64(i/2*512) {
+			t.Errorf("Expected buffer %d packed at %d, got %d", i, i/2*512, offset)
+		}
+	}
+
+	//Stale references are forwarded to the moved blocks
+	if err := allocator.Free(refs[2]); err != nil {
+		t.Errorf("Free of moved reference failed %v", err)
+	}
+	if err := allocator.Free(buffers[2].MemoryRef()); err == nil {
+		t.Errorf("Expected double free of moved block to fail")
+	}
+
+	//The destination page counts as pool growth so a pool at its ceiling is left as it is
+	allocator.Free(buffers[0].MemoryRef())
+	allocator.SetPoolCeiling(4096)
+	allocator.Run(progress)
+	if done := <-progress; done != dieselvk.DEFRAG_DONE {
+		t.Errorf("Expected no blocks moved at the pool ceiling, got %d", done)
+	}
+	if frag := allocator.Stats()["fragmentation"]; frag == "0.000000" {
+		t.Errorf("Expected the page to stay fragmented at the pool ceiling")
+	}
+}
+
+func TestFakeDefragAlignment(t *testing.T) {
+
+	fake := dieselvk.NewFakeMemory(1 << 20)
+	allocator, _ := dieselvk.NewCoreAllocatorWithBackend(fake, 4096, 1)
+	defer allocator.Destroy()
+
+	//The third block asks for more alignment than packing it behind the first block would give it
+	sizes := []int{256, 768, 512, 1024, 512}
+	aligns := []int{256, 256, 1024, 256, 256}
+	refs := make([]dieselvk.MemRef, len(sizes))
+	buffers := make([]*dieselvk.CoreBuffer, len(sizes))
+	for i := range refs {
+		refs[i], _ = allocator.Allocate(sizes[i], aligns[i])
+		buffers[i] = &dieselvk.CoreBuffer{}
+		if err := allocator.Track(refs[i], buffers[i]); err != nil {
+			t.Fatalf("Track failed %v", err)
+		}
+	}
+	allocator.Free(refs[1])
+	allocator.Free(refs[3])
+
+	progress := make(chan int, 4)
+	allocator.Run(progress)
+	if moved := <-progress; moved != 3 {
+		t.Errorf("Expected 3 blocks moved, got %d", moved)
+	}
+	allocator.Clean()
+	expected := map[int]uint64{0: 0, 2: 1024, 4: 2048}
+	for i, offset := range expected {
+		if got := buffers[i].MemoryRef().Offset(); got != offset {
+			t.Errorf("Expected buffer %d packed at %d, got %d", i, offset, got)
+		}
+	}
+}
@@ -106,19 +106,43 @@ func TestRender(t *testing.T) {
 		0.0, 0.0, f2, 0.0,
 	}
 
-	mvp := []float32{}
-	mvp = append(mvp, model...)
-	mvp = append(mvp, view...)
-	mvp = append(mvp, proj...)
+	//Mirrors the UniformBufferObject block of the vertex shader
+	type UniformBufferObject struct {
+		Model [4][4]float32
+		View  [4][4]float32
+		Proj  [4][4]float32
+	}
+	mvp := UniformBufferObject{}
+	for i := 0; i < 16; i++ {
+		mvp.Model[i/4][i%4] = model[i]
+		mvp.View[i/4][i%4] = view[i]
+		mvp.Proj[i/4][i%4] = proj[i]
+	}
 
 	//Adds Layout buffers to "uniform bufffer objects"
 	bindings := []int{0, 0, 0}
-	render.AddLayoutBuffer(mvp, "mvp", vk.BufferUsageFlags(vk.BufferUsageUniformBufferBit))
+	if err := render.AddLayoutStruct(mvp, "mvp", vk.BufferUsageFlags(vk.BufferUsageUniformBufferBit)); err != nil {
+		t.Errorf("Failed to add uniform buffer %v", err)
+	}
 	render.BindUniforms(render.GetLayoutBuffers(), bindings)
 
+	//Per object transforms are selected per draw through dynamic offsets
+	type PerObject struct {
+		Model [4][4]float32
+	}
+	objects := []PerObject{{Model: mvp.Model}, {Model: mvp.Model}}
+	if err := render.AddDynamicLayoutStruct(objects, "objects"); err != nil {
+		t.Errorf("Failed to add dynamic uniform buffer %v", err)
+	}
+	render.BindDynamicUniform("objects")
+	render.SetDynamicElements([]uint32{0, 1})
+
 	//Add in vertex buffers
 	vertices := []float32{-1.0, 1.0, -1.0, 0.0, -1.0, -1.0, 1.0, 1.0, -1.0}
 	render.AddVertexBuffer(vertices, "triangle")
+	if err := render.AddIndexBuffer([]uint16{0, 1, 2}, "triangle"); err != nil {
+		t.Errorf("Failed to add index buffer %v", err)
+	}
 
 	//Configure renderpasses + pipelines
 	render.NewSwapchain()
@@ -126,7 +150,18 @@ func TestRender(t *testing.T) {
 	render.AddPipeline("pipe0", "default", *render.GetVertexBuffer("triangle"), "rp0")
 	render.SetupCommands()
 
+	//Spin the model about y, each frame in flight keeps its own copy of the matrices. The stale copy bookkeeping
+	//and per name failures of UpdateLayoutBuffer need a render instance with a swapchain, so they are only
+	//exercised here on a GPU
+	angle := 0.0
 	for !window.ShouldClose() {
+		angle += 0.01
+		cs, ss := float32(math.Cos(angle)), float32(math.Sin(angle))
+		mvp.Model[0] = [4]float32{cs, 0, -ss, 0}
+		mvp.Model[2] = [4]float32{ss, 0, cs, 0}
+		if err := render.UpdateLayoutBuffer("mvp", mvp); err != nil {
+			t.Errorf("Failed to update uniform buffer %v", err)
+		}
 		render.Update(0.0)
 		glfw.PollEvents()
 	}
@@ -0,0 +1,289 @@
+package dieselvk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+Allocation traces record the Allocate, Free and Clean calls made on a CoreAllocator so a session can be replayed
+offline against any Allocator strategy backed by FakeMemory. Tuning page sizes, ceilings and strategies then only
+needs the trace and not the GPU or the game which produced it.
+
+A trace is the TRACE_MAGIC header followed by one record per call. Records start with the op byte and carry their
+fields as unsigned varints:
+
+	TRACE_ALLOCATE  id size alignment
+	TRACE_FREE      id
+	TRACE_CLEAN
+
+Allocation ids count up from 0 in call order, failed allocations included, so frees name the allocation they
+release independently of where a strategy placed it.
+*/
+
+const (
+	TRACE_MAGIC    = "DVKTRACE1"
+	TRACE_ALLOCATE = 0
+	TRACE_FREE     = 1
+	TRACE_CLEAN    = 2
+)
+
+//TraceOp is a single recorded allocator call
+type TraceOp struct {
+	Op    uint8
+	ID    uint64
+	Size  uint64
+	Align uint64
+}
+
+//Records allocator calls to the trace output, accessed under the allocator lock
+type TraceWriter struct {
+	out  *bufio.Writer
+	ids  map[MemRef]uint64
+	next uint64
+	err  error
+	buf  [3 * binary.MaxVarintLen64]byte
+}
+
+//TraceTo starts recording every Allocate, Free and Clean call to out. Allocations made before tracing starts are
+//not in the trace and their frees are not recorded
+func (core *CoreAllocator) TraceTo(out io.Writer) error {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	if core.trace != nil {
+		return fmt.Errorf("TraceTo() allocator is already tracing\n")
+	}
+	trace := &TraceWriter{out: bufio.NewWriter(out), ids: make(map[MemRef]uint64)}
+	if _, err := trace.out.WriteString(TRACE_MAGIC); err != nil {
+		return err
+	}
+	core.trace = trace
+	return nil
+}
+
+//StopTrace flushes and stops the trace, returning the first error met while writing it
+func (core *CoreAllocator) StopTrace() error {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	return core.stop_trace()
+}
+
+func (core *CoreAllocator) stop_trace() error {
+	if core.trace == nil {
+		return nil
+	}
+	trace := core.trace
+	core.trace = nil
+	if trace.err != nil {
+		return trace.err
+	}
+	return trace.out.Flush()
+}
+
+//Records an allocation call, the caller holds the allocator lock
+func (trace *TraceWriter) allocate(ref MemRef, size uint64, align uint64, err error) {
+	if trace == nil {
+		return
+	}
+	id := trace.next
+	trace.next++
+	if err == nil {
+		trace.ids[ref] = id
+	}
+	trace.write(TRACE_ALLOCATE, id, size, align)
+}
+
+//Records the free of a traced allocation, the caller holds the allocator lock
+func (trace *TraceWriter) free(ref MemRef) {
+	if trace == nil {
+		return
+	}
+	if id, ok := trace.ids[ref]; ok {
+		delete(trace.ids, ref)
+		trace.write(TRACE_FREE, id)
+	}
+}
+
+//Records a clean call, the caller holds the allocator lock
+func (trace *TraceWriter) clean() {
+	if trace != nil {
+		trace.write(TRACE_CLEAN)
+	}
+}
+
+//Keeps the id of an allocation moved by compaction, the caller holds the allocator lock
+func (trace *TraceWriter) move(from MemRef, to MemRef) {
+	if trace == nil {
+		return
+	}
+	if id, ok := trace.ids[from]; ok {
+		delete(trace.ids, from)
+		trace.ids[to] = id
+	}
+}
+
+func (trace *TraceWriter) write(op uint8, fields ...uint64) {
+	if trace.err != nil {
+		return
+	}
+	if trace.err = trace.out.WriteByte(op); trace.err != nil {
+		return
+	}
+	n := 0
+	for _, field := range fields {
+		n += binary.PutUvarint(trace.buf[n:], field)
+	}
+	_, trace.err = trace.out.Write(trace.buf[:n])
+}
+
+//ReadTrace decodes a trace written by CoreAllocator.TraceTo
+func ReadTrace(in io.Reader) ([]TraceOp, error) {
+	reader := bufio.NewReader(in)
+	magic := make([]byte, len(TRACE_MAGIC))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != TRACE_MAGIC {
+		return nil, fmt.Errorf("ReadTrace() input is not an allocation trace\n")
+	}
+
+	ops := make([]TraceOp, 0)
+	for {
+		code, err := reader.ReadByte()
+		if err == io.EOF {
+			return ops, nil
+		}
+		if err != nil {
+			return ops, err
+		}
+
+		op := TraceOp{Op: code}
+		switch code {
+		case TRACE_ALLOCATE:
+			err = read_uvarints(reader, &op.ID, &op.Size, &op.Align)
+		case TRACE_FREE:
+			err = read_uvarints(reader, &op.ID)
+		case TRACE_CLEAN:
+		default:
+			err = fmt.Errorf("unknown op %d", code)
+		}
+		if err != nil {
+			return ops, fmt.Errorf("ReadTrace() record %d is corrupt %s\n", len(ops), err)
+		}
+		ops = append(ops, op)
+	}
+}
+
+func read_uvarints(reader *bufio.Reader, fields ...*uint64) error {
+	for _, field := range fields {
+		value, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return err
+		}
+		*field = value
+	}
+	return nil
+}
+
+//ReplaySample is the allocator state after a replayed op. Live is the requested bytes of live allocations, Used and
+//Size are the allocator's own used and device memory bytes
+type ReplaySample struct {
+	Op            int
+	Live          uint64
+	Used          uint64
+	Size          uint64
+	Fragmentation float32
+}
+
+//ReplayFailure is a replayed op the allocator rejected
+type ReplayFailure struct {
+	Op    int
+	Trace TraceOp
+	Live  uint64
+	Err   error
+}
+
+//ReplayReport summarizes a trace replayed against an allocator
+type ReplayReport struct {
+	Ops      int
+	PeakLive uint64
+	PeakUsed uint64
+	PeakSize uint64
+	Failures []ReplayFailure
+	Samples  []ReplaySample
+}
+
+//Replay runs the traced calls against the allocator and samples its Stats every interval ops and after the last
+//op. Peaks are taken over the samples so an interval of 1 gives exact peaks. Frees of allocations which failed in
+//the replay are skipped
+func Replay(allocator Allocator, ops []TraceOp, interval int) ReplayReport {
+	report := ReplayReport{Ops: len(ops), Failures: make([]ReplayFailure, 0), Samples: make([]ReplaySample, 0)}
+	refs := make(map[uint64]MemRef)
+	sizes := make(map[uint64]uint64)
+	live := uint64(0)
+	if interval < 1 {
+		interval = 1
+	}
+
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case TRACE_ALLOCATE:
+			var ref MemRef
+			if ref, err = allocator.Allocate(int(op.Size), int(op.Align)); err == nil {
+				refs[op.ID] = ref
+				sizes[op.ID] = op.Size
+				live += op.Size
+			}
+		case TRACE_FREE:
+			if ref, ok := refs[op.ID]; ok {
+				if err = allocator.Free(ref); err == nil {
+					delete(refs, op.ID)
+					live -= sizes[op.ID]
+					delete(sizes, op.ID)
+				}
+			}
+		case TRACE_CLEAN:
+			allocator.Clean()
+		}
+
+		if err != nil {
+			report.Failures = append(report.Failures, ReplayFailure{Op: i, Trace: op, Live: live, Err: err})
+		}
+		if live > report.PeakLive {
+			report.PeakLive = live
+		}
+		if (i+1)%interval == 0 || i == len(ops)-1 {
+			report.sample(allocator, i, live)
+		}
+	}
+	return report
+}
+
+func (report *ReplayReport) sample(allocator Allocator, op int, live uint64) {
+	stats := allocator.Stats()
+	sample := ReplaySample{Op: op, Live: live}
+	sample.Used, _ = strconv.ParseUint(stats["used"], 10, 64)
+	sample.Size, _ = strconv.ParseUint(stats["size"], 10, 64)
+	fragmentation, _ := strconv.ParseFloat(stats["fragmentation"], 32)
+	sample.Fragmentation = float32(fragmentation)
+
+	report.PeakUsed = max_u64(report.PeakUsed, sample.Used)
+	report.PeakSize = max_u64(report.PeakSize, sample.Size)
+	report.Samples = append(report.Samples, sample)
+}
+
+//String formats the peaks, every failure and the fragmentation samples
+func (report ReplayReport) String() string {
+	out := fmt.Sprintf("Ops: %d\nPeak live: %d bytes\nPeak used: %d bytes\nPeak size: %d bytes\n", report.Ops, report.PeakLive, report.PeakUsed, report.PeakSize)
+	out += fmt.Sprintf("Failures: %d\n", len(report.Failures))
+	for _, failure := range report.Failures {
+		out += fmt.Sprintf("    op %d: allocation %d of %d bytes with %d bytes live %s\n", failure.Op, failure.Trace.ID, failure.Trace.Size, failure.Live, strings.TrimSpace(failure.Err.Error()))
+	}
+	out += "Samples\n"
+	for _, sample := range report.Samples {
+		out += fmt.Sprintf("    op %d: live %d used %d size %d fragmentation %f\n", sample.Op, sample.Live, sample.Used, sample.Size, sample.Fragmentation)
+	}
+	return out
+}
@@ -0,0 +1,133 @@
+package dieselvk
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+
+	vk "github.com/vulkan-go/vulkan"
+)
+
+/*
+Typed uploads into allocator memory. Any element type of fixed size is accepted: integer and float scalars,
+arrays and structs built from them. The byte size of a slice is len(data) * unsafe.Sizeof(T) so index buffers of
+uint16, float64 attributes and packed vertex structs are laid out exactly as in Go memory. Types holding
+pointers, slices, strings or maps are rejected since their Go memory is not the data they reference.
+*/
+
+//AsBytes reinterprets a slice of fixed size elements as its bytes without copying
+func AsBytes[T any](data []T) ([]byte, error) {
+	var zero T
+	if !fixed_size(reflect.TypeOf(zero)) {
+		return nil, fmt.Errorf("AsBytes() element type %T has no fixed size layout\n", zero)
+	}
+	if len(data) == 0 {
+		return []byte{}, nil
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(&data[0])), len(data)*int(unsafe.Sizeof(zero))), nil
+}
+
+//SliceBytes is AsBytes for a slice only known at run time, e.g. vertices of any struct, returning the element type
+//and count alongside the bytes
+func SliceBytes(data interface{}) ([]byte, reflect.Type, int, error) {
+	v := reflect.ValueOf(data)
+	if v.Kind() != reflect.Slice {
+		return nil, nil, 0, fmt.Errorf("SliceBytes() expected a slice, got %T\n", data)
+	}
+	elem := v.Type().Elem()
+	if !fixed_size(elem) {
+		return nil, elem, 0, fmt.Errorf("SliceBytes() element type %s has no fixed size layout\n", elem)
+	}
+	if v.Len() == 0 {
+		return []byte{}, elem, 0, nil
+	}
+	return unsafe.Slice((*byte)(v.UnsafePointer()), v.Len()*int(elem.Size())), elem, v.Len(), nil
+}
+
+//UploadSlice binds the buffer to the referenced block and copies the elements into it, see Allocator.Upload
+func UploadSlice[T any](allocator Allocator, buffer vk.Buffer, ref MemRef, data []T) error {
+	bytes, err := AsBytes(data)
+	if err != nil {
+		return err
+	}
+	return allocator.Upload(buffer, ref, bytes)
+}
+
+//WriteSlice copies the elements into the referenced block at a byte offset, see CoreAllocator.Write
+func WriteSlice[T any](allocator *CoreAllocator, ref MemRef, offset uint64, data []T) error {
+	bytes, err := AsBytes(data)
+	if err != nil {
+		return err
+	}
+	return allocator.Write(ref, offset, bytes)
+}
+
+//FromBytes copies bytes read back from the GPU into a new slice of elements, the inverse of AsBytes
+func FromBytes[T any](data []byte) ([]T, error) {
+	var zero T
+	if !fixed_size(reflect.TypeOf(zero)) {
+		return nil, fmt.Errorf("FromBytes() element type %T has no fixed size layout\n", zero)
+	}
+	size := int(unsafe.Sizeof(zero))
+	if size == 0 || len(data)%size != 0 {
+		return nil, fmt.Errorf("FromBytes() %d bytes is not a whole number of %d byte %T elements\n", len(data), size, zero)
+	}
+	out := make([]T, len(data)/size)
+	if len(out) > 0 {
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&out[0])), len(data)), data)
+	}
+	return out, nil
+}
+
+//ReadSlice reads count elements from the referenced block at a byte offset, see CoreAllocator.Read
+func ReadSlice[T any](allocator BufferAllocator, ref MemRef, offset uint64, count int) ([]T, error) {
+	var zero T
+	data := make([]byte, count*int(unsafe.Sizeof(zero)))
+	if err := allocator.Read(ref, offset, data); err != nil {
+		return nil, err
+	}
+	return FromBytes[T](data)
+}
+
+//ReadBufferSlice waits for the GPU to finish with the named storage buffer and returns its contents as elements
+func ReadBufferSlice[T any](instance CoreInstance, name string) ([]T, error) {
+	data, err := instance.ReadBuffer(name)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes[T](data)
+}
+
+//CmdHostReadBarrier records a barrier making shader writes from the given pipeline stages visible to host reads. End
+//command buffers passed to CoreDeviceInstance.Submit with it before reading storage buffers back with ReadBuffer
+func CmdHostReadBarrier(cmd vk.CommandBuffer, stages vk.PipelineStageFlags) {
+	barriers := []vk.MemoryBarrier{{
+		SType:         vk.StructureTypeMemoryBarrier,
+		SrcAccessMask: vk.AccessFlags(vk.AccessShaderWriteBit),
+		DstAccessMask: vk.AccessFlags(vk.AccessHostReadBit),
+	}}
+	vk.CmdPipelineBarrier(cmd, stages, vk.PipelineStageFlags(vk.PipelineStageHostBit), 0, 1, barriers, 0, nil, 0, nil)
+}
+
+//Reports whether values of the type are plain memory which can be copied to the GPU byte for byte
+func fixed_size(t reflect.Type) bool {
+	if t == nil {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Array:
+		return fixed_size(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if !fixed_size(t.Field(i).Type) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,265 @@
+package dieselvk
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+	"github.com/vulkan-go/vma"
+	vk "github.com/vulkan-go/vulkan"
+)
+
+/*
+CoreVMAAllocator implements Allocator on top of the Vulkan Memory Allocator so the red-black tree CoreAllocator can be
+compared against the industry standard one. Instances use it for their host visible buffers when the BaseCore
+config sets config["allocator"] = "vma". Staging, images and compaction stay on CoreAllocator since they rely on its
+pages and moves.
+
+VMA owns its blocks so references do not address pages, the key of a MemRef is the id of the VMA allocation.
+Allocations are persistently mapped when their memory type is host visible and flushed after every upload, which is
+a no-op for coherent memory.
+*/
+
+const (
+	ALLOCATOR_CORE = "core"
+	ALLOCATOR_VMA  = "vma"
+)
+
+//BufferAllocator is an Allocator which places known buffers by their memory requirements. Instances allocate their
+//host visible buffers through it so the strategy can be selected by config["allocator"]
+type BufferAllocator interface {
+	Allocator
+	AllocateBuffer(buffer vk.Buffer, reqs vk.MemoryRequirements, properties vk.MemoryPropertyFlags) (MemRef, error)
+	Write(ref MemRef, offset uint64, data []byte) error
+	Read(ref MemRef, offset uint64, data []byte) error
+}
+
+type VMAAllocation struct {
+	allocation vma.Allocation
+	info       vma.AllocationInfo
+}
+
+type CoreVMAAllocator struct {
+	lock        sync.Mutex
+	vma         *vma.Allocator
+	allocations map[int]VMAAllocation //Key: MemRef key
+	next        int
+}
+
+//NewCoreVMAAllocator creates a VMA allocator for the device. Vulkan entry points are loaded through the GLFW
+//vkGetInstanceProcAddr so GLFW must be initialized
+func NewCoreVMAAllocator(instance vk.Instance, physical vk.PhysicalDevice, handle vk.Device) (*CoreVMAAllocator, error) {
+	core := CoreVMAAllocator{allocations: make(map[int]VMAAllocation)}
+	//Instances enable buffer device addresses whenever the device supports them
+	flags := uint32(0)
+	if supports_device_address(physical) {
+		flags |= vma.AllocatorCreateBufferDeviceAddress
+	}
+	allocator, err := vma.NewAllocator(&vma.AllocatorCreateInfo{
+		VulkanProcAddr:   glfw.GetVulkanGetInstanceProcAddress(),
+		PhysicalDevice:   physical,
+		Device:           handle,
+		Instance:         instance,
+		Flags:            flags,
+		VulkanAPIVersion: vk.MakeVersion(1, 1, 0),
+	})
+	if err != nil {
+		return &core, fmt.Errorf("NewCoreVMAAllocator() failed to create the VMA allocator %s\n", err)
+	}
+	core.vma = allocator
+	return &core, nil
+}
+
+//Creates the buffer allocator named by config["allocator"], the CoreAllocator is used unless VMA is selected
+func new_buffer_allocator(kind string, core *CoreAllocator, instance vk.Instance, physical vk.PhysicalDevice, handle vk.Device) (BufferAllocator, error) {
+	switch kind {
+	case "", ALLOCATOR_CORE:
+		return core, nil
+	case ALLOCATOR_VMA:
+		return NewCoreVMAAllocator(instance, physical, handle)
+	}
+	return nil, fmt.Errorf("Unknown allocator %s, expected %s or %s\n", kind, ALLOCATOR_CORE, ALLOCATOR_VMA)
+}
+
+//Allocate allocates persistently mapped host visible memory which can hold size bytes aligned to min_align
+func (core *CoreVMAAllocator) Allocate(size int, min_align int) (MemRef, error) {
+	reqs := vk.MemoryRequirements{Size: vk.DeviceSize(size), Alignment: vk.DeviceSize(max_u64(uint64(min_align), 1)), MemoryTypeBits: ^uint32(0)}
+	create := vma.AllocationCreateInfo{
+		Flags:         vma.AllocationCreateMapped,
+		Usage:         vma.MemoryUsageCPUToGPU,
+		RequiredFlags: uint32(vk.MemoryPropertyHostVisibleBit),
+	}
+	allocation, info, err := core.vma.AllocateMemory(&reqs, &create, true)
+	if err != nil {
+		return MemRef{}, fmt.Errorf("Allocate() VMA failed to allocate %d bytes %s\n", size, err)
+	}
+	return core.track(allocation, info), nil
+}
+
+//AllocateBuffer allocates memory suited to the buffer from a memory type with every bit in properties
+func (core *CoreVMAAllocator) AllocateBuffer(buffer vk.Buffer, reqs vk.MemoryRequirements, properties vk.MemoryPropertyFlags) (MemRef, error) {
+	create := vma.AllocationCreateInfo{
+		Flags:          vma.AllocationCreateMapped,
+		RequiredFlags:  uint32(properties),
+		MemoryTypeBits: reqs.MemoryTypeBits,
+	}
+	allocation, info, err := core.vma.AllocateMemoryForBuffer(buffer, &create, true)
+	if err != nil {
+		return MemRef{}, fmt.Errorf("AllocateBuffer() VMA failed to allocate %d bytes %s\n", reqs.Size, err)
+	}
+	return core.track(allocation, info), nil
+}
+
+func (core *CoreVMAAllocator) track(allocation vma.Allocation, info vma.AllocationInfo) MemRef {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	key := core.next
+	core.next++
+	core.allocations[key] = VMAAllocation{allocation: allocation, info: info}
+	return MemRef{key: key, usage: MEM_REF, mem_type: info.MemoryType()}
+}
+
+//Looks up a live allocation
+func (core *CoreVMAAllocator) lookup(ref MemRef) (VMAAllocation, bool) {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	allocation, ok := core.allocations[ref.key]
+	return allocation, ok && ref.usage == MEM_REF
+}
+
+//Upload binds the buffer to the allocation and copies data into its mapping
+func (core *CoreVMAAllocator) Upload(buffer vk.Buffer, ref MemRef, data []byte) error {
+	allocation, ok := core.lookup(ref)
+	if !ok || allocation.info.MappedData() == nil {
+		return NewError(vk.ErrorMemoryMapFailed)
+	}
+	if uint64(len(data)) > uint64(allocation.info.Size()) {
+		return fmt.Errorf("Upload() %d bytes overflows allocation of %d bytes\n", len(data), allocation.info.Size())
+	}
+
+	if err := core.vma.BindBufferMemory(allocation.allocation, buffer); err != nil {
+		return err
+	}
+	copy(unsafe.Slice((*byte)(allocation.info.MappedData()), len(data)), data)
+	core.vma.FlushAllocation(allocation.allocation, 0, vk.DeviceSize(len(data)))
+	return nil
+}
+
+//Write copies data into the mapping of an allocation already bound by Upload at offset and flushes it
+func (core *CoreVMAAllocator) Write(ref MemRef, offset uint64, data []byte) error {
+	allocation, ok := core.lookup(ref)
+	if !ok || allocation.info.MappedData() == nil {
+		return NewError(vk.ErrorMemoryMapFailed)
+	}
+	if offset+uint64(len(data)) > uint64(allocation.info.Size()) {
+		return fmt.Errorf("Write() %d bytes at offset %d overflows allocation of %d bytes\n", len(data), offset, allocation.info.Size())
+	}
+
+	copy(unsafe.Slice((*byte)(allocation.info.MappedData()), offset+uint64(len(data)))[offset:], data)
+	core.vma.FlushAllocation(allocation.allocation, vk.DeviceSize(offset), vk.DeviceSize(len(data)))
+	return nil
+}
+
+//Read invalidates the allocation and copies len(data) bytes from its mapping at offset
+func (core *CoreVMAAllocator) Read(ref MemRef, offset uint64, data []byte) error {
+	allocation, ok := core.lookup(ref)
+	if !ok || allocation.info.MappedData() == nil {
+		return NewError(vk.ErrorMemoryMapFailed)
+	}
+	if offset+uint64(len(data)) > uint64(allocation.info.Size()) {
+		return fmt.Errorf("Read() %d bytes at offset %d overflows allocation of %d bytes\n", len(data), offset, allocation.info.Size())
+	}
+
+	core.vma.InvalidateAllocation(allocation.allocation, vk.DeviceSize(offset), vk.DeviceSize(len(data)))
+	copy(data, unsafe.Slice((*byte)(allocation.info.MappedData()), offset+uint64(len(data)))[offset:])
+	return nil
+}
+
+//Free releases the allocation back to VMA
+func (core *CoreVMAAllocator) Free(ref MemRef) error {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	allocation, ok := core.allocations[ref.key]
+	if !ok || ref.usage != MEM_REF {
+		return fmt.Errorf("Free() memory reference key %d is not allocated\n", ref.key)
+	}
+	core.vma.FreeMemory(allocation.allocation)
+	delete(core.allocations, ref.key)
+	return nil
+}
+
+//Clean is a no-op since VMA merges free ranges as they are freed
+func (core *CoreVMAAllocator) Clean() {
+}
+
+//Resize is not supported, VMA sizes its own blocks
+func (core *CoreVMAAllocator) Resize(desired_size int) error {
+	return fmt.Errorf("Resize() VMA allocator manages its own block sizes\n")
+}
+
+//Totals of the VMA JSON statistics
+type VMAStatInfo struct {
+	Blocks          uint64
+	Allocations     uint64
+	UnusedRanges    uint64
+	UsedBytes       uint64
+	UnusedBytes     uint64
+	UnusedRangeSize struct {
+		Max uint64
+	}
+}
+
+//Stats returns the VMA totals under the aggregate keys of CoreAllocator.Stats
+func (core *CoreVMAAllocator) Stats() map[string]string {
+	stats := make(map[string]string)
+	var document struct {
+		Total VMAStatInfo
+	}
+	if err := json.Unmarshal([]byte(core.vma.BuildStatsString(false)), &document); err != nil {
+		return stats
+	}
+
+	total := document.Total
+	max_free := total.UnusedRangeSize.Max
+	if total.UnusedRanges == 1 {
+		max_free = total.UnusedBytes
+	}
+	stats["pages"] = fmt.Sprintf("%d", total.Blocks)
+	stats["size"] = fmt.Sprintf("%d", total.UsedBytes+total.UnusedBytes)
+	stats["used"] = fmt.Sprintf("%d", total.UsedBytes)
+	stats["free"] = fmt.Sprintf("%d", total.UnusedBytes)
+	stats["allocations"] = fmt.Sprintf("%d", total.Allocations)
+	stats["free_blocks"] = fmt.Sprintf("%d", total.UnusedRanges)
+	stats["max_free"] = fmt.Sprintf("%d", max_free)
+	stats["fragmentation"] = fmt.Sprintf("%f", fragmentation(total.UnusedBytes, max_free))
+	return stats
+}
+
+//Usage returns the detailed VMA JSON memory map
+func (core *CoreVMAAllocator) Usage() string {
+	return "VMA Memory Map\n" + core.vma.BuildStatsString(true) + "\n----------------------\n"
+}
+
+//Destroy frees the live allocations and the VMA allocator
+func (core *CoreVMAAllocator) Destroy() {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	if core.vma == nil {
+		return
+	}
+	for key, allocation := range core.allocations {
+		core.vma.FreeMemory(allocation.allocation)
+		delete(core.allocations, key)
+	}
+	core.vma.Destroy()
+	core.vma = nil
+}
+
+//Run reports completion straight away, VMA defragmentation needs the caller to move buffers so it is not run
+func (core *CoreVMAAllocator) Run(x chan int) {
+	if x != nil {
+		x <- DEFRAG_DONE
+	}
+}